@@ -0,0 +1,81 @@
+package processagent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// AdminAuth secures an admin endpoint. The wrapped handler is called only if
+// the request carries the given token as a bearer token in the Authorization
+// header. If the token is empty, the admin endpoint is disabled and all
+// requests are rejected.
+func AdminAuth(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if token == "" {
+			rw.WriteHeader(404)
+			return
+		}
+		expected := []byte("Bearer " + token)
+		actual := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(expected, actual) != 1 {
+			rw.WriteHeader(401)
+			return
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// writeJSON serializes the value as JSON and writes it as an HTTP response
+// with the given status code.
+func writeJSON(rw http.ResponseWriter, statusCode int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Println("Admin: Failed to serialize response: ", err.Error())
+		rw.WriteHeader(500)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(data)
+}
+
+// ConfigHandler returns an http.Handler that serves the effective Config of
+// the agent as JSON, with the secret values redacted.
+func ConfigHandler(cfg *Config) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, 200, cfg.Redacted())
+	})
+}
+
+// commandStatus is the JSON body of the command admin endpoint.
+type commandStatus struct {
+	Command string `json:"command"`
+}
+
+// CommandHandler returns an http.Handler that serves the command run by the
+// agent as JSON. A PUT request with a JSON body like {"command": "wc -l"} swaps
+// the command at runtime (see LocalProcessAgent SetCommand). Invalid commands
+// are rejected with 400.
+func CommandHandler(agent *LocalProcessAgent) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "PUT" {
+			update := commandStatus{}
+			if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+				rw.WriteHeader(400)
+				rw.Write([]byte("invalid JSON body: " + err.Error()))
+				return
+			}
+			if err := agent.SetCommand(update.Command); err != nil {
+				rw.WriteHeader(400)
+				rw.Write([]byte(err.Error()))
+				return
+			}
+			log.Println("Admin: Command changed to: ", update.Command)
+		}
+		writeJSON(rw, 200, commandStatus{
+			Command: agent.Command(),
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package processagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	handler := AdminAuth("secret", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(200)
+	}))
+
+	tests := map[string]int{
+		"":              401,
+		"Bearer wrong":  401,
+		"Bearer secret": 200,
+	}
+	for authorization, expected := range tests {
+		req := httptest.NewRequest("GET", "/config", nil)
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Fatalf("Expected status %d for %q, but got %d", expected, authorization, rec.Code)
+		}
+	}
+}
+
+func TestAdminAuthDisabled(t *testing.T) {
+	handler := AdminAuth("", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(200)
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+	if rec.Code != 404 {
+		t.Fatal("Expected admin endpoint to be disabled without a token, but got: ", rec.Code)
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	port := 8080
+	command := "curl -u user:password https://example.com"
+	onStart := "mount-volume --key secret"
+	onStop := ""
+	maxWorkers := 5
+	token := "secret"
+	cfg := &Config{
+		Port:           &port,
+		Command:        &command,
+		OnStartCommand: &onStart,
+		OnStopCommand:  &onStop,
+		MaxWorkers:     &maxWorkers,
+		AdminToken:     &token,
+	}
+
+	req := httptest.NewRequest("GET", "/config", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	AdminAuth(token, ConfigHandler(cfg)).ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatal("Expected status 200, but got: ", rec.Code)
+	}
+
+	result := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result["port"] != float64(8080) || result["maxWorkers"] != float64(5) || result["onStopCommand"] != "" {
+		t.Fatal("Expected the effective configuration, but got: ", rec.Body.String())
+	}
+	if result["adminToken"] != redactedValue {
+		t.Fatal("Expected the admin token to be redacted, but got: ", result["adminToken"])
+	}
+	if result["command"] != redactedValue || result["onStartCommand"] != redactedValue {
+		t.Fatal("Expected the commands to be redacted, but got: ", rec.Body.String())
+	}
+	if *cfg.AdminToken != "secret" || *cfg.Command != command {
+		t.Fatal("Expected the original configuration not to be changed.")
+	}
+}
+
+func TestCommandHandler(t *testing.T) {
+	agent := NewProcessAgent("echo old", 0)
+	handler := CommandHandler(agent)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/command", strings.NewReader(`{"command": "echo new"}`)))
+	status := commandStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || rec.Code != 200 {
+		t.Fatal("Expected the command status, but got: ", rec.Code, rec.Body.String())
+	}
+	if status.Command != "echo new" || agent.Command() != "echo new" {
+		t.Fatal("Expected the command to be swapped, but got: ", status.Command)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/command", strings.NewReader(`{"command": "/no/such/executable"}`)))
+	if rec.Code != 400 || agent.Command() != "echo new" {
+		t.Fatal("Expected an invalid command to be rejected, but got: ", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/command", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "echo new") {
+		t.Fatal("Expected the current command, but got: ", rec.Body.String())
+	}
+}
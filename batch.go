@@ -0,0 +1,174 @@
+package processagent
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy defines what the BatchWriter does with new entries when its
+// buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the writer until the buffered entries are flushed
+	// (backpressure).
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest buffered entry to make room for the
+	// new one, so the writer never blocks.
+	OverflowDropOldest
+)
+
+// errBatchWriterClosed is returned when writing to a closed BatchWriter.
+var errBatchWriterClosed = fmt.Errorf("batch writer closed")
+
+// BatchWriter is an io.Writer that buffers the written entries (each Write is
+// one entry, like a log line) and writes them to the underlying writer in
+// batches, asynchronously. Meant for sinks that are slow to write to (like
+// audit logs or metrics on a network or disk), so writing does not add to the
+// latency of the requests.
+// The buffered entries are flushed periodically, when the buffer is full and on
+// Close. When the buffer is full, new entries are handled according to the
+// OverflowPolicy.
+type BatchWriter struct {
+	writer   io.Writer
+	capacity int
+	policy   OverflowPolicy
+	entries  [][]byte
+	dropped  int64
+	closed   bool
+	lock     sync.Mutex
+	// space is signaled when the buffered entries have been taken for flushing.
+	space *sync.Cond
+	// flushLock makes sure the batches are written in order.
+	flushLock sync.Mutex
+	flushNow  chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// Write buffers a copy of the entry. Returns an error if the BatchWriter is
+// closed.
+func (b *BatchWriter) Write(p []byte) (int, error) {
+	entry := append([]byte(nil), p...)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for !b.closed && len(b.entries) >= b.capacity {
+		if b.policy == OverflowDropOldest {
+			b.entries = b.entries[1:]
+			b.dropped++
+			break
+		}
+		b.signalFlush()
+		b.space.Wait()
+	}
+	if b.closed {
+		return 0, errBatchWriterClosed
+	}
+	b.entries = append(b.entries, entry)
+	if len(b.entries) >= b.capacity {
+		b.signalFlush()
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of entries dropped because the buffer was full.
+func (b *BatchWriter) Dropped() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.dropped
+}
+
+// Flush writes all of the buffered entries to the underlying writer as a single
+// batch.
+func (b *BatchWriter) Flush() error {
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+
+	b.lock.Lock()
+	entries := b.entries
+	b.entries = nil
+	b.space.Broadcast()
+	b.lock.Unlock()
+
+	if len(entries) == 0 {
+		return nil
+	}
+	_, err := b.writer.Write(bytes.Join(entries, nil))
+	return err
+}
+
+// Close stops the periodic flushing and flushes the remaining entries. Any
+// Write after Close fails.
+func (b *BatchWriter) Close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.space.Broadcast()
+	b.lock.Unlock()
+
+	close(b.done)
+	<-b.stopped
+	return b.Flush()
+}
+
+// signalFlush asks the flushing goroutine to flush, without waiting for the
+// interval. Must be called with the lock held.
+func (b *BatchWriter) signalFlush() {
+	select {
+	case b.flushNow <- struct{}{}:
+	default:
+	}
+}
+
+// run flushes the buffered entries periodically and when signaled, until the
+// BatchWriter is closed.
+func (b *BatchWriter) run(interval time.Duration) {
+	defer close(b.stopped)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-b.flushNow:
+		case <-b.done:
+			return
+		}
+		if err := b.Flush(); err != nil {
+			log.Println("BatchWriter: Failed to write batch: ", err.Error())
+		}
+	}
+}
+
+// NewBatchWriter creates new BatchWriter that buffers up to capacity entries
+// and writes them to the given writer every interval (or sooner, when the
+// buffer is full). If interval is 0, the entries are flushed only when the
+// buffer is full and on Close. The BatchWriter must be closed to flush the
+// pending entries on shutdown.
+func NewBatchWriter(writer io.Writer, capacity int, interval time.Duration, policy OverflowPolicy) *BatchWriter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	b := &BatchWriter{
+		writer:   writer,
+		capacity: capacity,
+		policy:   policy,
+		flushNow: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	b.space = sync.NewCond(&b.lock)
+	go b.run(interval)
+	return b
+}
@@ -0,0 +1,149 @@
+package processagent
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingWriter records the writes made to it. If release is set, each write
+// blocks until release is closed and started is signaled when a write begins.
+type countingWriter struct {
+	buffer  bytes.Buffer
+	calls   int
+	lock    sync.Mutex
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.release != nil {
+		select {
+		case c.started <- struct{}{}:
+		default:
+		}
+		<-c.release
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls++
+	return c.buffer.Write(p)
+}
+
+func (c *countingWriter) result() (string, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.buffer.String(), c.calls
+}
+
+func TestBatchWriterBatches(t *testing.T) {
+	writer := &countingWriter{}
+	batch := NewBatchWriter(writer, 10, time.Hour, OverflowBlock)
+
+	expected := ""
+	for i := 0; i < 100; i++ {
+		line := fmt.Sprintf("entry %d\n", i)
+		expected += line
+		if _, err := batch.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := batch.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	output, calls := writer.result()
+	if output != expected {
+		t.Fatal("Expected all entries written in order, but got: ", output)
+	}
+	if calls > 10 {
+		t.Fatal("Expected the entries to be written in batches, but got write calls: ", calls)
+	}
+}
+
+func TestBatchWriterFlushesPeriodically(t *testing.T) {
+	writer := &countingWriter{}
+	batch := NewBatchWriter(writer, 100, 10*time.Millisecond, OverflowBlock)
+	defer batch.Close()
+
+	batch.Write([]byte("first\n"))
+	batch.Write([]byte("second\n"))
+	time.Sleep(100 * time.Millisecond)
+
+	if output, calls := writer.result(); output != "first\nsecond\n" || calls != 1 {
+		t.Fatal("Expected the entries to be flushed in a single batch, but got: ", output, calls)
+	}
+}
+
+func TestBatchWriterCloseFlushes(t *testing.T) {
+	writer := &countingWriter{}
+	batch := NewBatchWriter(writer, 100, 0, OverflowBlock)
+
+	batch.Write([]byte("pending\n"))
+	if output, _ := writer.result(); output != "" {
+		t.Fatal("Expected the entry to be buffered, but got: ", output)
+	}
+	batch.Close()
+	if output, _ := writer.result(); output != "pending\n" {
+		t.Fatal("Expected the pending entry to be flushed on close, but got: ", output)
+	}
+	if _, err := batch.Write([]byte("late\n")); err != errBatchWriterClosed {
+		t.Fatal("Expected writes after close to fail, but got: ", err)
+	}
+}
+
+func TestBatchWriterDropOldest(t *testing.T) {
+	writer := &countingWriter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	batch := NewBatchWriter(writer, 2, 0, OverflowDropOldest)
+
+	// the first batch gets stuck in the slow writer
+	batch.Write([]byte("a"))
+	batch.Write([]byte("b"))
+	<-writer.started
+
+	for _, entry := range []string{"c", "d", "e", "f"} {
+		batch.Write([]byte(entry))
+	}
+	if batch.Dropped() != 2 {
+		t.Fatal("Expected 2 dropped entries, but got: ", batch.Dropped())
+	}
+
+	close(writer.release)
+	batch.Close()
+	if output, _ := writer.result(); output != "abef" {
+		t.Fatal("Expected the oldest entries to be dropped, but got: ", output)
+	}
+}
+
+func TestBatchWriterBlock(t *testing.T) {
+	writer := &countingWriter{started: make(chan struct{}, 1), release: make(chan struct{})}
+	batch := NewBatchWriter(writer, 2, 0, OverflowBlock)
+
+	batch.Write([]byte("a"))
+	batch.Write([]byte("b"))
+	<-writer.started
+	batch.Write([]byte("c"))
+	batch.Write([]byte("d"))
+
+	written := make(chan bool)
+	go func() {
+		batch.Write([]byte("e"))
+		written <- true
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("Expected the write to block while the buffer is full.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(writer.release)
+	<-written
+	batch.Close()
+	if output, _ := writer.result(); !strings.HasPrefix(output, "abcd") || len(output) != 5 || batch.Dropped() != 0 {
+		t.Fatal("Expected all entries to be written, but got: ", output)
+	}
+}
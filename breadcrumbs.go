@@ -0,0 +1,80 @@
+package processagent
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Request Metadata (HTTP headers) used for debugging.
+const (
+	// DebugHeader requests the debug information to be included in the
+	// Response, if present in the Request.
+	DebugHeader = "X-Debug"
+	// BreadcrumbsHeader holds the breadcrumb trail in the Response.
+	BreadcrumbsHeader = "X-Breadcrumbs"
+)
+
+// breadcrumbsKey is the context key of the breadcrumb trail.
+type breadcrumbsKey struct{}
+
+// breadcrumbs holds the names of the middlewares executed for a request, in
+// the order of execution.
+type breadcrumbs struct {
+	names []string
+	lock  sync.Mutex
+}
+
+// Breadcrumbs returns the breadcrumb trail recorded in the context so far, or
+// nil if no trail is recorded.
+func Breadcrumbs(ctx context.Context) []string {
+	trail, ok := ctx.Value(breadcrumbsKey{}).(*breadcrumbs)
+	if !ok {
+		return nil
+	}
+	trail.lock.Lock()
+	defer trail.lock.Unlock()
+	return append([]string{}, trail.names...)
+}
+
+// TraceMiddleware decorates the middleware so that its name is appended to the
+// breadcrumb trail in the context when it executes.
+func TraceMiddleware(name string, middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		if trail, ok := ctx.Value(breadcrumbsKey{}).(*breadcrumbs); ok {
+			trail.lock.Lock()
+			trail.names = append(trail.names, name)
+			trail.lock.Unlock()
+		}
+		return middleware(ctx, req, resp)
+	}
+}
+
+// Traced decorates the Handler so that its name is appended to the breadcrumb
+// trail when it executes (see TraceMiddleware).
+func Traced(name string, handler Handler) Handler {
+	return func(middleware Middleware) Middleware {
+		return TraceMiddleware(name, handler(middleware))
+	}
+}
+
+// BreadcrumbTrail is a Handler that records the breadcrumb trail of the
+// middlewares (decorated with Traced or TraceMiddleware) executed for the
+// request. If the request fails, the trail is logged.
+// If the Request carries the DebugHeader, the trail is set in the Response
+// Metadata under BreadcrumbsHeader.
+func BreadcrumbTrail(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		ctx = context.WithValue(ctx, breadcrumbsKey{}, &breadcrumbs{})
+		err := middleware(ctx, req, resp)
+		trail := strings.Join(Breadcrumbs(ctx), " > ")
+		if err != nil || (resp.Error != nil && *resp.Error) {
+			log.Printf("Request %s failed. Breadcrumbs: %s\n", req.ID, trail)
+		}
+		if req.Metadata[DebugHeader] != "" {
+			resp.SetMetadata(BreadcrumbsHeader, trail)
+		}
+		return err
+	}
+}
@@ -0,0 +1,53 @@
+package processagent
+
+import (
+	"context"
+	"testing"
+)
+
+func TestBreadcrumbTrail(t *testing.T) {
+	var trail []string
+	worker := TraceMiddleware("worker", func(ctx context.Context, req *Request, resp *Response) error {
+		trail = Breadcrumbs(ctx)
+		return nil
+	})
+
+	middleware := worker
+	for _, handler := range []Handler{Traced("timestamp", RequestTimestamp), Traced("id", RequestID(9)), BreadcrumbTrail} {
+		middleware = handler(middleware)
+	}
+
+	resp := &Response{}
+	if err := middleware(context.Background(), &Request{
+		Metadata: map[string]string{
+			DebugHeader: "true",
+		},
+	}, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trail) != 3 || trail[0] != "id" || trail[1] != "timestamp" || trail[2] != "worker" {
+		t.Fatal("Expected the breadcrumbs to reflect the executed chain, but got: ", trail)
+	}
+	if resp.Metadata[BreadcrumbsHeader] != "id > timestamp > worker" {
+		t.Fatal("Expected the breadcrumbs in the response, but got: ", resp.Metadata[BreadcrumbsHeader])
+	}
+}
+
+func TestBreadcrumbTrailNoDebug(t *testing.T) {
+	middleware := BreadcrumbTrail(TraceMiddleware("worker", func(ctx context.Context, req *Request, resp *Response) error {
+		return nil
+	}))
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if _, ok := resp.Metadata[BreadcrumbsHeader]; ok {
+		t.Fatal("Expected no breadcrumbs in the response without the debug header.")
+	}
+}
+
+func TestBreadcrumbsWithoutTrail(t *testing.T) {
+	if Breadcrumbs(context.Background()) != nil {
+		t.Fatal("Expected no breadcrumbs without a trail.")
+	}
+}
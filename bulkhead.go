@@ -0,0 +1,47 @@
+package processagent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Bulkhead is a Handler that limits the number of requests in flight with the
+// same key (as returned by keyFn, for example the tenant) to perKeyLimit, so a
+// single noisy key cannot take up all of the workers. Requests over the limit
+// of their key are rejected with error code 429 (Too Many Requests), even if
+// there is capacity left for the other keys.
+// Requests with an empty key are not limited.
+// The keys are forgotten as soon as they have no requests in flight, so the
+// memory used stays proportional to the number of the active keys.
+func Bulkhead(perKeyLimit int, keyFn func(*Request) string) Handler {
+	inFlight := map[string]int{}
+	lock := sync.Mutex{}
+
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			key := keyFn(req)
+			if key == "" {
+				return middleware(ctx, req, resp)
+			}
+
+			lock.Lock()
+			if inFlight[key] >= perKeyLimit {
+				lock.Unlock()
+				setErrorResponse(resp, 429, fmt.Sprintf("too many requests in flight for %s", key))
+				return nil
+			}
+			inFlight[key]++
+			lock.Unlock()
+
+			defer func() {
+				lock.Lock()
+				if inFlight[key]--; inFlight[key] == 0 {
+					delete(inFlight, key)
+				}
+				lock.Unlock()
+			}()
+			return middleware(ctx, req, resp)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package processagent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBulkhead(t *testing.T) {
+	release := make(chan bool)
+	var lock sync.Mutex
+	running := map[string]int{}
+	middleware := Bulkhead(2, func(req *Request) string {
+		return req.Metadata["tenant"]
+	})(func(ctx context.Context, req *Request, resp *Response) error {
+		lock.Lock()
+		running[req.Metadata["tenant"]]++
+		lock.Unlock()
+		<-release
+		return nil
+	})
+	run := func(tenant string) *Response {
+		resp := &Response{}
+		if err := middleware(context.Background(), &Request{Metadata: map[string]string{"tenant": tenant}}, resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	inFlight := func(tenant string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return running[tenant]
+	}
+
+	// the noisy tenant takes up its limit
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := run("noisy"); resp.Error != nil {
+				t.Error("Expected the requests within the limit to be processed.")
+			}
+		}()
+	}
+	deadline := time.Now().Add(time.Duration(5) * time.Second)
+	for inFlight("noisy") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the requests within the limit to be in flight.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	resp := run("noisy")
+	if resp.ErrorCode == nil || *resp.ErrorCode != 429 {
+		t.Fatal("Expected the request over the limit of the key to be rejected with 429.")
+	}
+
+	// another tenant proceeds
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if resp := run("quiet"); resp.Error != nil {
+			t.Error("Expected a request with another key to be processed.")
+		}
+	}()
+	for inFlight("quiet") < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a request with another key to be in flight.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	if resp := run("noisy"); resp.Error != nil {
+		t.Fatal("Expected the key to accept requests once its requests completed.")
+	}
+	if resp := run(""); resp.Error != nil {
+		t.Fatal("Expected a request without a key not to be limited.")
+	}
+}
@@ -0,0 +1,138 @@
+package processagent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// cacheEntry holds a cached Response.
+type cacheEntry struct {
+	resp    *Response
+	expires time.Time
+}
+
+// ResponseCache caches the Responses for requests made with safe methods (GET
+// and HEAD). The requests are cached by method, path, query and payload, as
+// found in the Request Metadata. Requests with any other method (like POST)
+// bypass the cache and are always processed.
+// Only successful responses are cached, for the configured TTL, including
+// their Metadata (like the status). The expired responses are evicted at most
+// once per TTL, and once the cache holds MaxEntries responses, the oldest one
+// is evicted to make room for a new one.
+type ResponseCache struct {
+	// MaxEntries is the maximal number of cached responses. If 0,
+	// DefaultMaxCacheEntries is used.
+	MaxEntries int
+	ttl        time.Duration
+	entries    map[string]*cacheEntry
+	lastSweep  time.Time
+	lock       sync.Mutex
+}
+
+// DefaultMaxCacheEntries is the default maximal number of responses cached by a
+// ResponseCache.
+const DefaultMaxCacheEntries = 1000
+
+// isCacheable checks whether the Request method is a safe method, so the
+// Response can be cached.
+func isCacheable(req *Request) bool {
+	method := req.Metadata[MetadataMethod]
+	return method == "GET" || method == "HEAD"
+}
+
+// cacheKey generates the cache key for the given Request.
+func cacheKey(req *Request) string {
+	hash := sha256.Sum256([]byte(req.Payload))
+	return req.Metadata[MetadataMethod] + " " + req.Metadata[MetadataPath] + "?" +
+		req.Metadata[MetadataQuery] + " " + hex.EncodeToString(hash[:])
+}
+
+// get looks up a valid (not expired) cache entry.
+func (c *ResponseCache) get(key string) *cacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// put stores a copy of the Response in the cache.
+func (c *ResponseCache) put(key string, resp *Response) {
+	now := time.Now()
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxCacheEntries
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.Sub(c.lastSweep) >= c.ttl {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxEntries {
+		// all entries have the same TTL, so the oldest expires first
+		oldest := ""
+		for key, entry := range c.entries {
+			if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = &cacheEntry{
+		resp:    copyResponse(resp),
+		expires: now.Add(c.ttl),
+	}
+}
+
+// Handler is a Handler that serves the Response from the cache if available,
+// otherwise processes the request and caches the Response.
+func (c *ResponseCache) Handler(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		if !isCacheable(req) {
+			return middleware(ctx, req, resp)
+		}
+		key := cacheKey(req)
+		if entry := c.get(key); entry != nil {
+			cached := copyResponse(entry.resp)
+			resp.Payload = cached.Payload
+			resp.Error = cached.Error
+			resp.ErrorCode = cached.ErrorCode
+			resp.ExitCode = cached.ExitCode
+			resp.Stderr = cached.Stderr
+			for key, value := range cached.Metadata {
+				resp.SetMetadata(key, value)
+			}
+			return nil
+		}
+		if err := middleware(ctx, req, resp); err != nil {
+			return err
+		}
+		if resp.Error == nil || !*resp.Error {
+			c.put(key, resp)
+		}
+		return nil
+	}
+}
+
+// NewResponseCache creates new ResponseCache that keeps the cached responses
+// for the given ttl.
+func NewResponseCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		ttl:     ttl,
+		entries: map[string]*cacheEntry{},
+	}
+}
@@ -0,0 +1,120 @@
+package processagent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// countingMiddleware returns a middleware that counts how many times it was
+// called and returns the count as payload.
+func countingMiddleware(calls *int) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		*calls++
+		resp.Payload = fmt.Sprintf("call-%d", *calls)
+		return nil
+	}
+}
+
+func httpRequest(method, path, payload string) *Request {
+	return &Request{
+		Payload: payload,
+		Metadata: map[string]string{
+			MetadataMethod: method,
+			MetadataPath:   path,
+		},
+	}
+}
+
+func TestResponseCacheGET(t *testing.T) {
+	calls := 0
+	middleware := NewResponseCache(time.Minute).Handler(countingMiddleware(&calls))
+
+	for i := 0; i < 3; i++ {
+		resp := &Response{}
+		if err := middleware(context.Background(), httpRequest("GET", "/a", ""), resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Payload != "call-1" {
+			t.Fatal("Expected the cached response, but got: ", resp.Payload)
+		}
+	}
+	if calls != 1 {
+		t.Fatal("Expected GET to be processed once, but was processed times: ", calls)
+	}
+
+	resp := &Response{}
+	middleware(context.Background(), httpRequest("GET", "/b", ""), resp)
+	if calls != 2 {
+		t.Fatal("Expected GET on different path not to be served from cache.")
+	}
+}
+
+func TestResponseCachePOST(t *testing.T) {
+	calls := 0
+	middleware := NewResponseCache(time.Minute).Handler(countingMiddleware(&calls))
+
+	for i := 0; i < 3; i++ {
+		if err := middleware(context.Background(), httpRequest("POST", "/a", "data"), &Response{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 3 {
+		t.Fatal("Expected POST to bypass the cache, but was processed times: ", calls)
+	}
+}
+
+func TestResponseCacheExpires(t *testing.T) {
+	calls := 0
+	middleware := NewResponseCache(time.Duration(50) * time.Millisecond).Handler(countingMiddleware(&calls))
+
+	middleware(context.Background(), httpRequest("GET", "/a", ""), &Response{})
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	middleware(context.Background(), httpRequest("GET", "/a", ""), &Response{})
+	if calls != 2 {
+		t.Fatal("Expected the cached response to expire.")
+	}
+}
+
+func TestResponseCacheMetadata(t *testing.T) {
+	middleware := NewResponseCache(time.Minute).Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "created"
+		resp.SetMetadata(MetadataStatus, "201")
+		resp.SetMetadata("Content-Type", "text/plain")
+		return nil
+	})
+
+	middleware(context.Background(), httpRequest("GET", "/a", ""), &Response{})
+	resp := &Response{}
+	middleware(context.Background(), httpRequest("GET", "/a", ""), resp)
+	if resp.Payload != "created" || resp.Metadata[MetadataStatus] != "201" || resp.Metadata["Content-Type"] != "text/plain" {
+		t.Fatal("Expected the cached response with its metadata, but got: ", resp.Payload, resp.Metadata)
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	calls := 0
+	cache := NewResponseCache(time.Duration(20) * time.Millisecond)
+	middleware := cache.Handler(countingMiddleware(&calls))
+
+	middleware(context.Background(), httpRequest("GET", "/old", ""), &Response{})
+	time.Sleep(time.Duration(30) * time.Millisecond)
+	middleware(context.Background(), httpRequest("GET", "/new", ""), &Response{})
+	if len(cache.entries) != 1 {
+		t.Fatal("Expected the expired response to be evicted, but got entries: ", len(cache.entries))
+	}
+
+	cache = NewResponseCache(time.Minute)
+	cache.MaxEntries = 2
+	middleware = cache.Handler(countingMiddleware(&calls))
+	for _, path := range []string{"/a", "/b", "/c"} {
+		middleware(context.Background(), httpRequest("GET", path, ""), &Response{})
+	}
+	if len(cache.entries) != 2 {
+		t.Fatal("Expected the cache to hold at most 2 responses, but got: ", len(cache.entries))
+	}
+	if cache.get(cacheKey(httpRequest("GET", "/a", ""))) != nil {
+		t.Fatal("Expected the oldest response to be evicted.")
+	}
+}
@@ -0,0 +1,182 @@
+package processagent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request Metadata (HTTP headers) used for chunked uploads.
+const (
+	// UploadIDHeader holds the ID of the upload, shared by all of its chunks.
+	UploadIDHeader = "X-Upload-Id"
+	// ChunkIndexHeader holds the index of the chunk, starting from 0.
+	ChunkIndexHeader = "X-Chunk-Index"
+	// ChunkTotalHeader holds the total number of chunks of the upload.
+	ChunkTotalHeader = "X-Chunk-Total"
+)
+
+// upload holds the chunks received so far for a single upload.
+type upload struct {
+	total   int
+	chunks  map[int]string
+	size    int64
+	started time.Time
+}
+
+// ChunkAssembler reassembles uploads sent in multiple chunks.
+// Each chunk is a separate request carrying the upload ID, the index of the
+// chunk and the total number of chunks (see UploadIDHeader, ChunkIndexHeader
+// and ChunkTotalHeader). The chunks may arrive in any order. Once all chunks
+// have arrived, they are joined in order into the full payload, which is then
+// processed once.
+// Uploads that are not complete within the timeout are discarded.
+// The uploads are held in memory, so their number and size are limited, see
+// MaxChunks, MaxUploads and MaxUploadSize.
+type ChunkAssembler struct {
+	// MaxChunks is the maximal number of chunks of an upload. Chunks with a
+	// larger X-Chunk-Total are rejected with 413 (Payload Too Large). If 0,
+	// DefaultMaxChunks is used.
+	MaxChunks int
+	// MaxUploads is the maximal number of incomplete uploads held at the same
+	// time. The first chunk of a new upload over the limit is rejected with 413
+	// (Payload Too Large). If 0, DefaultMaxUploads is used.
+	MaxUploads int
+	// MaxUploadSize is the maximal size of the chunks of an upload together.
+	// The chunk that exceeds it is rejected with 413 (Payload Too Large) and
+	// the upload is discarded. If 0, DefaultMaxUploadSize is used.
+	MaxUploadSize int64
+	timeout       time.Duration
+	uploads       map[string]*upload
+	lock          sync.Mutex
+}
+
+// Default limits of a ChunkAssembler.
+const (
+	// DefaultMaxChunks is the default maximal number of chunks of an upload.
+	DefaultMaxChunks = 1000
+	// DefaultMaxUploads is the default maximal number of incomplete uploads.
+	DefaultMaxUploads = 100
+	// DefaultMaxUploadSize is the default maximal size of an upload.
+	DefaultMaxUploadSize int64 = 64 << 20
+)
+
+// parseChunk parses the chunk index and total from the Request Metadata.
+func parseChunk(req *Request) (index int, total int, err error) {
+	if index, err = strconv.Atoi(req.Metadata[ChunkIndexHeader]); err != nil {
+		return 0, 0, fmt.Errorf("invalid chunk index")
+	}
+	if total, err = strconv.Atoi(req.Metadata[ChunkTotalHeader]); err != nil || total < 1 {
+		return 0, 0, fmt.Errorf("invalid chunk total")
+	}
+	if index < 0 || index >= total {
+		return 0, 0, fmt.Errorf("chunk index out of range")
+	}
+	return index, total, nil
+}
+
+// addChunk adds the chunk to the upload. If this was the last missing chunk,
+// the upload is removed and the full payload is returned. On error, the status
+// code to respond with is returned as well.
+func (c *ChunkAssembler) addChunk(id string, index, total int, payload string) (string, bool, int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	maxChunks := c.MaxChunks
+	if maxChunks <= 0 {
+		maxChunks = DefaultMaxChunks
+	}
+	maxUploads := c.MaxUploads
+	if maxUploads <= 0 {
+		maxUploads = DefaultMaxUploads
+	}
+	maxSize := c.MaxUploadSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxUploadSize
+	}
+	if total > maxChunks {
+		return "", false, 413, fmt.Errorf("too many chunks")
+	}
+
+	now := time.Now()
+	for uploadID, u := range c.uploads {
+		if now.Sub(u.started) > c.timeout {
+			delete(c.uploads, uploadID)
+		}
+	}
+
+	u, ok := c.uploads[id]
+	if !ok {
+		if len(c.uploads) >= maxUploads {
+			return "", false, 413, fmt.Errorf("too many uploads")
+		}
+		u = &upload{
+			total:   total,
+			chunks:  map[int]string{},
+			started: now,
+		}
+		c.uploads[id] = u
+	}
+	if u.total != total {
+		return "", false, 400, fmt.Errorf("chunk total does not match the upload")
+	}
+	// a chunk sent again replaces the previous one
+	u.size += int64(len(payload)) - int64(len(u.chunks[index]))
+	if u.size > maxSize {
+		delete(c.uploads, id)
+		return "", false, 413, fmt.Errorf("upload too large")
+	}
+	u.chunks[index] = payload
+	if len(u.chunks) < u.total {
+		return "", false, 200, nil
+	}
+
+	delete(c.uploads, id)
+	parts := make([]string, u.total)
+	for i := range parts {
+		parts[i] = u.chunks[i]
+	}
+	return strings.Join(parts, ""), true, 200, nil
+}
+
+// Handler is a Handler that collects the chunks of the uploads and processes
+// the request with the full payload once all chunks have arrived.
+// Until then, each chunk is acknowledged with status 202 (Accepted).
+// Requests that are not part of a chunked upload are processed as usual.
+func (c *ChunkAssembler) Handler(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		id := req.Metadata[UploadIDHeader]
+		if id == "" {
+			return middleware(ctx, req, resp)
+		}
+		index, total, err := parseChunk(req)
+		if err != nil {
+			setErrorResponse(resp, 400, err.Error())
+			return nil
+		}
+		payload, complete, code, err := c.addChunk(id, index, total, req.Payload)
+		if err != nil {
+			setErrorResponse(resp, code, err.Error())
+			return nil
+		}
+		if !complete {
+			resp.SetMetadata(MetadataStatus, "202")
+			resp.Payload = fmt.Sprintf("chunk %d of %d received", index+1, total)
+			return nil
+		}
+		req.Payload = payload
+		return middleware(ctx, req, resp)
+	}
+}
+
+// NewChunkAssembler creates new ChunkAssembler that discards incomplete
+// uploads after the given timeout.
+func NewChunkAssembler(timeout time.Duration) *ChunkAssembler {
+	return &ChunkAssembler{
+		timeout: timeout,
+		uploads: map[string]*upload{},
+	}
+}
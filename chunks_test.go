@@ -0,0 +1,110 @@
+package processagent
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func chunkRequest(id string, index, total int, payload string) *Request {
+	return &Request{
+		Payload: payload,
+		Metadata: map[string]string{
+			UploadIDHeader:   id,
+			ChunkIndexHeader: strconv.Itoa(index),
+			ChunkTotalHeader: strconv.Itoa(total),
+		},
+	}
+}
+
+func TestChunkAssemblerOutOfOrder(t *testing.T) {
+	processed := []string{}
+	middleware := NewChunkAssembler(time.Minute).Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		processed = append(processed, req.Payload)
+		return nil
+	})
+
+	for _, index := range []int{2, 0, 1} {
+		resp := &Response{}
+		if err := middleware(context.Background(), chunkRequest("upload", index, 3, []string{"a", "b", "c"}[index]), resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error != nil {
+			t.Fatal("Expected the chunk to be accepted, but got: ", resp.Payload)
+		}
+	}
+
+	if len(processed) != 1 {
+		t.Fatal("Expected the upload to be processed exactly once, but got: ", processed)
+	}
+	if processed[0] != "abc" {
+		t.Fatal("Expected the chunks to be reassembled in order, but got: ", processed[0])
+	}
+}
+
+func TestChunkAssemblerTimeout(t *testing.T) {
+	processed := 0
+	middleware := NewChunkAssembler(time.Duration(50) * time.Millisecond).Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		processed++
+		return nil
+	})
+
+	middleware(context.Background(), chunkRequest("upload", 0, 2, "a"), &Response{})
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	middleware(context.Background(), chunkRequest("upload", 1, 2, "b"), &Response{})
+
+	if processed != 0 {
+		t.Fatal("Expected the incomplete upload to be discarded after the timeout.")
+	}
+}
+
+func TestChunkAssemblerInvalidChunk(t *testing.T) {
+	middleware := NewChunkAssembler(time.Minute).Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), chunkRequest("upload", 3, 2, "a"), resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 400 {
+		t.Fatal("Expected an out of range chunk to be rejected with 400.")
+	}
+}
+
+func TestChunkAssemblerLimits(t *testing.T) {
+	assembler := NewChunkAssembler(time.Minute)
+	assembler.MaxChunks = 3
+	assembler.MaxUploads = 1
+	assembler.MaxUploadSize = 4
+	middleware := assembler.Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), chunkRequest("upload", 0, 4, "a"), resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 413 {
+		t.Fatal("Expected an upload with too many chunks to be rejected with 413.")
+	}
+
+	resp = &Response{}
+	middleware(context.Background(), chunkRequest("upload", 0, 3, "aa"), resp)
+	if resp.Error != nil {
+		t.Fatal("Expected the chunk to be accepted, but got: ", resp.Payload)
+	}
+	resp = &Response{}
+	middleware(context.Background(), chunkRequest("other", 0, 3, "a"), resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 413 {
+		t.Fatal("Expected a new upload over the limit to be rejected with 413.")
+	}
+
+	// the same chunk sent again does not count twice
+	middleware(context.Background(), chunkRequest("upload", 0, 3, "aa"), &Response{})
+	resp = &Response{}
+	middleware(context.Background(), chunkRequest("upload", 1, 3, "bbb"), resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 413 {
+		t.Fatal("Expected an upload over the size limit to be rejected with 413.")
+	}
+	if len(assembler.uploads) != 0 {
+		t.Fatal("Expected the upload over the size limit to be discarded.")
+	}
+}
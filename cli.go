@@ -1,12 +1,171 @@
 package processagent
 
-import "flag"
+import (
+	"flag"
+	"os"
+	"time"
+)
 
 // Config holds the program arguments values as configuration.
 type Config struct {
-	Port       *int
-	Command    *string
-	MaxWorkers *int
+	Port       *int    `json:"port"`
+	Command    *string `json:"command"`
+	MaxWorkers *int    `json:"maxWorkers"`
+	// CommandArgs is the command as a JSON array of the executable and its
+	// arguments. If set, it is used instead of Command.
+	CommandArgs *string `json:"commandArgs"`
+	// Host is the host interface to listen on. If empty, all interfaces.
+	Host *string `json:"host"`
+	// MaxConnections is the maximal number of open connections to the HTTP
+	// port.
+	MaxConnections *int `json:"maxConnections"`
+	// HTTPTimeout is the maximal time to process an HTTP request.
+	HTTPTimeout *time.Duration `json:"httpTimeout"`
+	// PoolSize is the number of the goroutines processing the requests.
+	PoolSize *int `json:"poolSize"`
+	// PoolQueue is the number of the requests waiting for a free goroutine.
+	PoolQueue *int `json:"poolQueue"`
+	// StartupPolicy is the name of the StartupPolicy applied on startup errors.
+	StartupPolicy *string `json:"startupPolicy"`
+	// HealthPort is the port on which the health endpoint is served on its own.
+	HealthPort *int `json:"healthPort"`
+	// InputFD is the file descriptor on which the payload is passed to the
+	// process.
+	InputFD *int `json:"inputFd"`
+	// OutputFD is the file descriptor from which the process output is read.
+	OutputFD *int `json:"outputFd"`
+	// FramedOutput enables reading length-prefixed framed output.
+	FramedOutput *bool `json:"framedOutput"`
+	// MaxErrorLength is the maximal length of error messages returned to clients.
+	MaxErrorLength *int `json:"maxErrorLength"`
+	// StdinTrimSpace enables trimming whitespace from the process input.
+	StdinTrimSpace *bool `json:"stdinTrimSpace"`
+	// StdinNewline enables appending a trailing newline to the process input.
+	StdinNewline *bool `json:"stdinNewline"`
+	// StdinDelivery is the name of the StdinDelivery of the process input.
+	StdinDelivery *string `json:"stdinDelivery"`
+	// StdinChunkSize is the size of the chunks of the process input.
+	StdinChunkSize *int `json:"stdinChunkSize"`
+	// StdinInterval is the pause between the chunks or lines of the process
+	// input.
+	StdinInterval *time.Duration `json:"stdinInterval"`
+	// RequestIDHeader is the name of the header holding the incoming request ID.
+	RequestIDHeader *string `json:"requestIdHeader"`
+	// Negotiate enables serializing the response by the Accept header or the
+	// format query parameter.
+	Negotiate *bool `json:"negotiate"`
+	// JSONIndent is the indentation of the JSON responses.
+	JSONIndent *string `json:"jsonIndent"`
+	// JSONNoHTMLEscape disables escaping of HTML characters in the JSON
+	// responses.
+	JSONNoHTMLEscape *bool `json:"jsonNoHtmlEscape"`
+	// RequestIDPattern is the regular expression the incoming request IDs must
+	// match.
+	RequestIDPattern *string `json:"requestIdPattern"`
+	// RequestIDMaxLength is the maximal length of the incoming request IDs.
+	RequestIDMaxLength *int `json:"requestIdMaxLength"`
+	// InvalidRequestID is the name of the InvalidIDPolicy.
+	InvalidRequestID *string `json:"invalidRequestId"`
+	// CGIOutput enables parsing the headers from the process output.
+	CGIOutput *bool `json:"cgiOutput"`
+	// JSONOutput is the JSON validation of the process output: "repair" or
+	// "strict". If empty, the output is not validated.
+	JSONOutput *string `json:"jsonOutput"`
+	// ETag enables the entity tags of the responses.
+	ETag *bool `json:"etag"`
+	// NormalizeNewlines is the newline style the payload line endings are
+	// converted to. If empty, the line endings are not converted.
+	NormalizeNewlines *string `json:"normalizeNewlines"`
+	// RequestFormat is the format of the incoming requests, see
+	// ParseRequestDecoder.
+	RequestFormat *string `json:"requestFormat"`
+	// Nice is the niceness of the processes.
+	Nice *int `json:"nice"`
+	// RunAsUser is the user the processes run as.
+	RunAsUser *string `json:"runAsUser"`
+	// RunAsGroup is the group the processes run as.
+	RunAsGroup *string `json:"runAsGroup"`
+	// PTY enables running the processes attached to a pseudo-terminal.
+	PTY *bool `json:"pty"`
+	// ProcessTimeout is the maximal time a process may run.
+	ProcessTimeout *time.Duration `json:"processTimeout"`
+	// OnStartCommand is the command run when the agent starts.
+	OnStartCommand *string `json:"onStartCommand"`
+	// OnStopCommand is the command run when the agent shuts down.
+	OnStopCommand *string `json:"onStopCommand"`
+	// StderrAsError fails the requests when the process writes to STDERR.
+	StderrAsError *bool `json:"stderrAsError"`
+	// MaxOutputSize is the maximal size of the process output.
+	MaxOutputSize *int64 `json:"maxOutputSize"`
+	// ReportUsage enables reporting of the resources used by the processes.
+	ReportUsage *bool `json:"reportUsage"`
+	// MaxCPUShare caps the share of the host CPU used by the processes.
+	MaxCPUShare *float64 `json:"maxCpuShare"`
+	// ExecutableAllowlist is the comma-separated list of the executables the
+	// agent may run.
+	ExecutableAllowlist *string `json:"executableAllowlist"`
+	// RequestDeadline is the deadline of the requests passed to the processes.
+	RequestDeadline *time.Duration `json:"requestDeadline"`
+	// MaxSpawnsPerSecond limits the rate of process starts.
+	MaxSpawnsPerSecond *int `json:"maxSpawnsPerSecond"`
+	// MemoryBudget limits the total size of the payloads of the requests in
+	// flight.
+	MemoryBudget *int64 `json:"memoryBudget"`
+	// Async enables running the requests asynchronously as jobs.
+	Async *bool `json:"async"`
+	// JobTTL is the time the results of finished jobs are kept.
+	JobTTL *time.Duration `json:"jobTtl"`
+	// MaxJobs is the maximal number of jobs kept in async mode.
+	MaxJobs *int `json:"maxJobs"`
+	// SelfTestPayload is the payload sent to the ports by the selftest command.
+	SelfTestPayload *string `json:"selfTestPayload"`
+	// DrainMode is the name of the DrainMode used on shutdown.
+	DrainMode *string `json:"drainMode"`
+	// DrainTimeout is the drain deadline on shutdown.
+	DrainTimeout *time.Duration `json:"drainTimeout"`
+	// MaxUptime is the time after which the agent shuts down gracefully.
+	MaxUptime *time.Duration `json:"maxUptime"`
+	// Debug enables recording of the breadcrumb trail of the middlewares.
+	Debug *bool `json:"debug"`
+	// ServerTiming enables reporting of the time spent in the chain and the
+	// process in the Server-Timing header.
+	ServerTiming *bool `json:"serverTiming"`
+	// IntakeQueue enables queuing the requests while the intake is paused,
+	// instead of rejecting them.
+	IntakeQueue *bool `json:"intakeQueue"`
+	// IntakeQueueDepth is the maximal number of the queued requests.
+	IntakeQueueDepth *int `json:"intakeQueueDepth"`
+	// TailSize is the number of the last requests kept for the tail admin
+	// endpoint.
+	TailSize *int `json:"tailSize"`
+	// AdminToken is the secret token required to access the admin endpoints.
+	// If empty, the admin endpoints are disabled.
+	AdminToken *string `json:"adminToken"`
+}
+
+// redactedValue replaces the values of secrets in the Config.
+const redactedValue = "<redacted>"
+
+// redactString returns the redacted value in place of the set value.
+func redactString(value *string) *string {
+	if value == nil || *value == "" {
+		return value
+	}
+	redacted := redactedValue
+	return &redacted
+}
+
+// Redacted returns a copy of the Config with the secret values redacted, so
+// the Config can be safely exposed. The commands are redacted as well, as they
+// often carry credentials in their arguments.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.AdminToken = redactString(c.AdminToken)
+	redacted.Command = redactString(c.Command)
+	redacted.CommandArgs = redactString(c.CommandArgs)
+	redacted.OnStartCommand = redactString(c.OnStartCommand)
+	redacted.OnStopCommand = redactString(c.OnStopCommand)
+	return &redacted
 }
 
 // RunCommand runs a CLI command with the given Config.
@@ -16,16 +175,79 @@ func configureFlags() *Config {
 	cfg := Config{}
 
 	cfg.Port = flag.Int("p", 8080, "Expose on port. Default 8080.")
+	cfg.Host = flag.String("host", "", "Listen on this host interface only (for example 127.0.0.1). Default is all interfaces.")
+	cfg.MaxConnections = flag.Int("max-connections", 0, "Maximal number of simultaneously open connections. Excess connections are refused with 503. Set 0 for unlimited.")
+	cfg.HTTPTimeout = flag.Duration("http-timeout", 0, "Respond with 504 if an HTTP request is not processed within this time. Set 0 for no timeout.")
+	cfg.PoolSize = flag.Int("pool-size", 0, "Process the requests on this many goroutines. Requests over the pool size and queue are rejected with 503. Unless -max-connections is set, the connections are limited to the pool size and queue. Set 0 for a goroutine per request.")
+	cfg.PoolQueue = flag.Int("pool-queue", 100, "Number of the requests waiting for a free goroutine of the pool, with -pool-size.")
 	cfg.MaxWorkers = flag.Int("max-workers", 0, "Maximal number of parallel workers. Set 0 for unlimited.")
 	cfg.Command = flag.String("c", "", "Command to execute.")
+	cfg.CommandArgs = flag.String("c-json", "", "Command to execute as a JSON array of the executable and its arguments, like [\"/bin/sh\", \"-c\", \"echo hi\"]. Used instead of -c, without tokenization.")
+	cfg.StartupPolicy = flag.String("startup-policy", string(FailFast), "Behavior on startup errors: 'fail-fast' or 'degraded'.")
+	cfg.HealthPort = flag.Int("health-port", 0, "Also serve /health on this port, bound before the HTTP port, so the degraded state can be observed while the HTTP port is not bound. Set 0 to serve it on the HTTP port only.")
+	cfg.InputFD = flag.Int("input-fd", 0, "Pass the request to the process on this file descriptor (3 or greater). Default is STDIN.")
+	cfg.OutputFD = flag.Int("output-fd", 0, "Read the process output from this file descriptor (3 or greater). Default is STDOUT.")
+	cfg.FramedOutput = flag.Bool("framed-output", false, "Read a single length-prefixed frame from the process output as a response.")
+	cfg.MaxErrorLength = flag.Int("max-error-length", 0, "Truncate error messages returned to clients to this length. Set 0 for no limit.")
+	cfg.StdinTrimSpace = flag.Bool("stdin-trim", false, "Trim leading and trailing whitespace from the input passed to the process.")
+	cfg.StdinNewline = flag.Bool("stdin-newline", false, "Make sure the input passed to the process ends with a newline.")
+	cfg.StdinDelivery = flag.String("stdin-delivery", "all", "Write the input to the process 'all' at once, in 'chunks' of -stdin-chunk-size bytes or line by line with 'lines'.")
+	cfg.StdinChunkSize = flag.Int("stdin-chunk-size", 4096, "Size of the chunks of the input with -stdin-delivery chunks.")
+	cfg.StdinInterval = flag.Duration("stdin-interval", 0, "Pause between writing the chunks or lines of the input to the process.")
+	cfg.RequestIDHeader = flag.String("request-id-header", "", "Use the request ID from this header (like X-Request-Id) if present, instead of generating a new one.")
+	cfg.Negotiate = flag.Bool("negotiate", false, "Serialize the response as JSON, MessagePack, YAML or raw text, as accepted by the client in the Accept header or selected with the format query parameter (json, msgpack, yaml or raw). Default is JSON.")
+	cfg.JSONIndent = flag.String("json-indent", "", "Pretty-print the JSON responses with this indentation, like '  '. Default is compact JSON.")
+	cfg.JSONNoHTMLEscape = flag.Bool("json-no-html-escape", false, "Do not escape <, > and & in the JSON responses.")
+	cfg.RequestIDPattern = flag.String("request-id-pattern", DefaultRequestIDPattern.String(), "Regular expression the incoming request IDs must match.")
+	cfg.RequestIDMaxLength = flag.Int("request-id-max-length", DefaultRequestIDMaxLength, "Maximal length of the incoming request IDs. Set 0 for no limit.")
+	cfg.InvalidRequestID = flag.String("invalid-request-id", "regenerate", "What to do with invalid incoming request IDs: 'regenerate' or 'reject' the request with 400.")
+	cfg.CGIOutput = flag.Bool("cgi-output", false, "Parse the process output like CGI: header lines, an empty line, then the body. The headers are returned as response headers.")
+	cfg.JSONOutput = flag.String("json-output", "", "Make sure the process output is strict JSON: 'repair' slightly broken JSON (comments, trailing commas) or fail on invalid JSON with 'strict'. Invalid output fails with 502.")
+	cfg.ETag = flag.Bool("etag", false, "Set the ETag header (a hash of the process output) and respond with 304 Not Modified when it matches the If-None-Match header of the request.")
+	cfg.NormalizeNewlines = flag.String("normalize-newlines", "", "Convert the line endings of the payload to 'lf' or 'crlf' before passing it to the process.")
+	cfg.RequestFormat = flag.String("request-format", "raw", "Format of the incoming requests: 'raw' or 'json-envelope' (with id, metadata and payload).")
+	cfg.Nice = flag.Int("nice", 0, "Run the processes with this niceness, from -20 (highest priority) to 19 (lowest priority). Linux only.")
+	cfg.RunAsUser = flag.String("run-as-user", "", "Run the processes as this user (name or UID). Linux only, usually requires root.")
+	cfg.RunAsGroup = flag.String("run-as-group", "", "Run the processes with this group (name or GID). Default is the primary group of -run-as-user. Linux only.")
+	cfg.PTY = flag.Bool("pty", false, "Run the processes attached to a pseudo-terminal. Linux only.")
+	cfg.ProcessTimeout = flag.Duration("process-timeout", 0, "Kill the processes running longer than this and fail the request with 504. Set 0 for no timeout.")
+	cfg.OnStartCommand = flag.String("on-start", "", "Command to run once when the agent starts, before serving any request. If it fails, the agent does not start.")
+	cfg.OnStopCommand = flag.String("on-stop", "", "Command to run once when the agent shuts down, after the running processes are done.")
+	cfg.StderrAsError = flag.Bool("stderr-as-error", false, "Fail the request when the process writes to STDERR, even if it exits successfully (the old behavior).")
+	cfg.MaxOutputSize = flag.Int64("max-output-size", 0, "Maximal size in bytes of the process output (and of the error output). A process writing more is killed and the request fails. Set 0 for no limit.")
+	cfg.ReportUsage = flag.Bool("report-usage", false, "Report the CPU time and the maximal memory (RSS, Linux only) used by the process in X-Process-Cpu-Time and X-Process-Max-Rss headers.")
+	cfg.MaxCPUShare = flag.Float64("max-cpu-share", 0, "Maximal share of the host CPU capacity (0 to 1) used by all processes together. New processes wait while the running ones use more. Linux only. Set 0 for no limit.")
+	cfg.ExecutableAllowlist = flag.String("executable-allowlist", "", "Comma-separated absolute paths of the executables the agent may run. Any other executable fails the request. Default is any executable.")
+	cfg.RequestDeadline = flag.Duration("request-deadline", 0, "Deadline of the requests. The time remaining is passed to the process in PA_DEADLINE_MS environment variable. Set 0 for no deadline.")
+	cfg.MaxSpawnsPerSecond = flag.Int("max-spawn-rate", 0, "Maximal number of processes started per second. Set 0 for unlimited.")
+	cfg.MemoryBudget = flag.Int64("memory-budget", 0, "Maximal total size in bytes of the payloads of the requests in flight. Requests over the budget are rejected with 503. Set 0 for no limit.")
+	cfg.Async = flag.Bool("async", false, "Run requests asynchronously. Responds with 202 and the location of the job result.")
+	cfg.JobTTL = flag.Duration("job-ttl", 10*time.Minute, "How long to keep the results of finished jobs in async mode.")
+	cfg.MaxJobs = flag.Int("max-jobs", DefaultMaxJobs, "Maximal number of jobs kept in async mode (pending or finished). New jobs over the limit are rejected with 503.")
+	cfg.SelfTestPayload = flag.String("selftest-payload", "", "Payload of the request sent to each port by the selftest command.")
+	cfg.DrainMode = flag.String("drain-mode", "terminate", "On shutdown, 'terminate' running processes or let them 'finish' until the drain timeout.")
+	cfg.DrainTimeout = flag.Duration("drain-timeout", 10*time.Second, "Maximal time to wait for running processes to finish on shutdown.")
+	cfg.MaxUptime = flag.Duration("max-uptime", 0, "Shut down gracefully (as on SIGTERM) after running for this long, so the agent can be restarted fresh. Set 0 to run indefinitely.")
+	cfg.Debug = flag.Bool("debug", false, "Record the middlewares executed for each request. The trail is logged on failure and returned in X-Breadcrumbs header if X-Debug header is set.")
+	cfg.ServerTiming = flag.Bool("server-timing", false, "Report the time spent processing the request and running the process in the Server-Timing header.")
+	cfg.IntakeQueue = flag.Bool("intake-queue", false, "Queue the requests while the intake is paused (with the /intake admin endpoint), instead of rejecting them with 503.")
+	cfg.IntakeQueueDepth = flag.Int("intake-queue-depth", 0, "Maximal number of the requests queued with -intake-queue. Requests over the limit are rejected with 503. Set 0 for no limit.")
+	cfg.TailSize = flag.Int("tail-size", 100, "Number of the last requests whose summaries are served by the /tail admin endpoint. Set 0 to disable.")
+	cfg.AdminToken = flag.String("admin-token", "", "Token required to access the admin endpoints. Admin endpoints are disabled if not set.")
 
 	return &cfg
 }
 
 // RunCLI configures the flags, parses the program arguments then runs the given
 // command with the Config extracted from those arguments.
+// If "selftest" is given as argument after the flags, then instead of running
+// the command, a self-test is run against the ports of an agent already running
+// with the same configuration (see SelfTest).
 func RunCLI(command RunCommand) error {
 	config := configureFlags()
 	flag.Parse()
+	if flag.Arg(0) == "selftest" {
+		return SelfTest(config, *config.SelfTestPayload, os.Stdout)
+	}
 	return command(config)
 }
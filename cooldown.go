@@ -0,0 +1,65 @@
+package processagent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Cooldown is a Handler that enforces a minimal time between the requests with
+// the same key (as returned by keyFn). A request is rejected with error code 429
+// (Too Many Requests) if a request with the same key completed successfully
+// within the cooldown window. The time remaining until the window expires is
+// set in the Retry-After Response Metadata, in seconds.
+// Failed requests do not start the cooldown, so they can be retried right away.
+// Requests with an empty key are not limited.
+// The keys whose window has expired are evicted, so the memory used stays
+// proportional to the number of keys in cooldown.
+func Cooldown(window time.Duration, keyFn func(*Request) string) Handler {
+	completed := map[string]time.Time{}
+	lastEviction := time.Now()
+	lock := sync.Mutex{}
+
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			key := keyFn(req)
+			if key == "" {
+				return middleware(ctx, req, resp)
+			}
+
+			now := time.Now()
+			lock.Lock()
+			if now.Sub(lastEviction) >= window {
+				for k, at := range completed {
+					if now.Sub(at) >= window {
+						delete(completed, k)
+					}
+				}
+				lastEviction = now
+			}
+			at, ok := completed[key]
+			lock.Unlock()
+
+			if ok {
+				if remaining := window - now.Sub(at); remaining > 0 {
+					resp.SetMetadata("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+					setErrorResponse(resp, 429, fmt.Sprintf("cooldown: retry in %s", remaining.Round(time.Millisecond)))
+					return nil
+				}
+			}
+
+			if err := middleware(ctx, req, resp); err != nil {
+				return err
+			}
+			if resp.Error == nil || !*resp.Error {
+				lock.Lock()
+				completed[key] = time.Now()
+				lock.Unlock()
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package processagent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCooldown(t *testing.T) {
+	executions := 0
+	fail := false
+	cooldown := Cooldown(time.Duration(100)*time.Millisecond, func(req *Request) string {
+		return req.Metadata["key"]
+	})
+	middleware := cooldown(func(ctx context.Context, req *Request, resp *Response) error {
+		executions++
+		if fail {
+			setErrorResponse(resp, 500, "failed")
+		}
+		return nil
+	})
+	run := func(key string) *Response {
+		resp := &Response{}
+		if err := middleware(context.Background(), &Request{Metadata: map[string]string{"key": key}}, resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := run("a"); resp.Error != nil {
+		t.Fatal("Expected the first request to be processed.")
+	}
+	resp := run("a")
+	if resp.Error == nil || *resp.ErrorCode != 429 {
+		t.Fatal("Expected the second request within the window to be rejected with 429.")
+	}
+	if resp.Metadata["Retry-After"] != "1" {
+		t.Fatal("Expected Retry-After to be set, but got: ", resp.Metadata["Retry-After"])
+	}
+	if resp := run("b"); resp.Error != nil {
+		t.Fatal("Expected a request with another key to be processed.")
+	}
+	if resp := run(""); resp.Error != nil {
+		t.Fatal("Expected a request without a key to be processed.")
+	}
+	if executions != 3 {
+		t.Fatal("Expected 3 executions, but got: ", executions)
+	}
+
+	time.Sleep(time.Duration(120) * time.Millisecond)
+	if resp := run("a"); resp.Error != nil {
+		t.Fatal("Expected the request after the window to be processed.")
+	}
+
+	fail = true
+	run("c")
+	fail = false
+	if resp := run("c"); resp.Error != nil {
+		t.Fatal("Expected a failed request not to start the cooldown.")
+	}
+}
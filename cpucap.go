@@ -0,0 +1,149 @@
+package processagent
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// cpuSampleInterval is the interval at which the CPU usage of the processes is
+// sampled, when MaxCPUShare is set.
+const cpuSampleInterval = 100 * time.Millisecond
+
+// cpuAccount accounts the CPU time used by all processes of the agent, to
+// calculate the share of the host CPU capacity they use together.
+type cpuAccount struct {
+	lock sync.Mutex
+	// seen is the CPU time of each process at the last sample. The entries are
+	// removed when the processes end, see processEnded.
+	seen map[int]time.Duration
+	// ended is the CPU time of the processes that finished since the last
+	// sample, not yet accounted.
+	ended time.Duration
+	// share is the share of the host CPU capacity used by the processes in the
+	// last sampling interval.
+	share      float64
+	lastSample time.Time
+	// startOnce guards the start of the sampling loop, which runs until stop is
+	// closed.
+	startOnce sync.Once
+	stop      chan struct{}
+}
+
+// start starts the sampling loop, unless already started. The loop calls
+// sample on every cpuSampleInterval.
+func (a *cpuAccount) start(sample func()) {
+	a.startOnce.Do(func() {
+		a.lock.Lock()
+		a.stop = make(chan struct{})
+		a.lastSample = time.Now()
+		stop := a.stop
+		a.lock.Unlock()
+		go func() {
+			ticker := time.NewTicker(cpuSampleInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					sample()
+				}
+			}
+		}()
+	})
+}
+
+// close stops the sampling loop, if started.
+func (a *cpuAccount) close() {
+	a.startOnce.Do(func() {})
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.stop != nil {
+		close(a.stop)
+		a.stop = nil
+	}
+}
+
+// sample accounts the CPU time used since the last sample by the given running
+// processes and by the processes that finished in the meantime, and updates
+// the share of the host CPU capacity used.
+func (a *cpuAccount) sample(pids []int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	used := a.ended
+	a.ended = 0
+	if a.seen == nil {
+		a.seen = map[int]time.Duration{}
+	}
+	for _, pid := range pids {
+		cpuTime, err := processCPUTime(pid)
+		if err != nil {
+			continue
+		}
+		if delta := cpuTime - a.seen[pid]; delta > 0 {
+			used += delta
+		}
+		a.seen[pid] = cpuTime
+	}
+
+	elapsed := now.Sub(a.lastSample)
+	a.lastSample = now
+	if elapsed <= 0 {
+		return
+	}
+	a.share = float64(used) / (float64(elapsed) * float64(runtime.NumCPU()))
+}
+
+// processEnded accounts the CPU time of the finished process not yet seen by
+// the sampling. The state is nil if the process was not waited on.
+func (a *cpuAccount) processEnded(pid int, state *os.ProcessState) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if state != nil {
+		if delta := state.UserTime() + state.SystemTime() - a.seen[pid]; delta > 0 {
+			a.ended += delta
+		}
+	}
+	delete(a.seen, pid)
+}
+
+// usage returns the share of the host CPU capacity used by the processes in
+// the last sampling interval.
+func (a *cpuAccount) usage() float64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.share
+}
+
+// waitCPU blocks until the processes of the agent together use no more than
+// MaxCPUShare of the host CPU capacity, so a new process can be started.
+// Returns false if the ctx is done before that. Returns true once the agent is
+// shutting down, as the sampling stops and the usage is no longer updated; the
+// caller rejects the request then.
+func (p *LocalProcessAgent) waitCPU(ctx context.Context) bool {
+	if p.MaxCPUShare <= 0 {
+		return true
+	}
+	p.cpu.start(p.sampleCPU)
+	for p.cpu.usage() > p.MaxCPUShare && !p.isClosing() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(cpuSampleInterval):
+		}
+	}
+	return true
+}
+
+// sampleCPU samples the CPU usage of the currently running processes.
+func (p *LocalProcessAgent) sampleCPU() {
+	pids := []int{}
+	for pid := range p.runningProcesses() {
+		pids = append(pids, pid)
+	}
+	p.cpu.sample(pids)
+}
@@ -0,0 +1,43 @@
+package processagent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the number of clock ticks per second in which the CPU time is
+// reported in /proc (USER_HZ), which is 100 on all common architectures.
+const clockTicks = 100
+
+// processCPUTime returns the CPU time (user and system) used so far by the
+// running process, read from /proc/<pid>/stat.
+func processCPUTime(pid int) (time.Duration, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the command name in parentheses may contain spaces, so the fields are
+	// counted after it: the state is the 3rd field, utime and stime are the
+	// 14th and the 15th
+	stat := string(data)
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(utime+stime) * time.Second / clockTicks, nil
+}
@@ -0,0 +1,108 @@
+package processagent
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProcessCPUTime(t *testing.T) {
+	if _, err := processCPUTime(os.Getpid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := processCPUTime(-1); err == nil {
+		t.Fatal("Expected an error for a non-existing process.")
+	}
+}
+
+func TestProcessAgentMaxCPUShare(t *testing.T) {
+	pa := NewProcessAgentArgs([]string{"/bin/sh", "-c", "while :; do :; done"}, 0)
+	pa.MaxCPUShare = 0.001
+
+	burning := make(chan bool)
+	go func() {
+		pa.ProcessCommand(&Request{}, &Response{})
+		burning <- false
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pa.cpu.usage() <= pa.MaxCPUShare {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the CPU usage of the running process to be sampled.")
+		}
+		time.Sleep(cpuSampleInterval)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	resp := &Response{}
+	start := time.Now()
+	pa.ProcessCommandContext(ctx, &Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+		t.Fatal("Expected the new process to be throttled with 503, but got: ", resp.Payload)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatal("Expected the request to wait for the CPU usage to drop.")
+	}
+
+	pa.Stop()
+	<-burning
+}
+
+func TestProcessAgentMaxCPUShareShutdown(t *testing.T) {
+	pa := NewProcessAgent("echo hello", 0)
+	pa.MaxCPUShare = 0.001
+	pa.cpu.start(func() {})
+	pa.cpu.share = 1
+	pa.Stop()
+
+	done := make(chan bool)
+	go func() {
+		done <- pa.waitCPU(context.Background())
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the wait for the CPU to end after shutdown.")
+	}
+}
+
+func TestProcessAgentMaxCPUShareNotExceeded(t *testing.T) {
+	pa := NewProcessAgent("echo hello", 0)
+	pa.MaxCPUShare = 0.9
+	defer pa.Stop()
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil || resp.Payload != "hello\n" {
+		t.Fatal("Expected the process to run under the CPU cap, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentMaxCPUShareFramedOutput(t *testing.T) {
+	pa := NewProcessAgent(`/bin/sh -c "sleep 0.3; printf \\\\000\\\\000\\\\000\\\\002ok; exec sleep 10"`, 0)
+	pa.FramedOutput = true
+	pa.MaxCPUShare = 0.9
+	defer pa.Stop()
+
+	for i := 0; i < 2; i++ {
+		resp := &Response{}
+		pa.ProcessCommand(&Request{}, resp)
+		if resp.Payload != "ok" {
+			t.Fatal("Expected to get the framed response, but got: ", resp.Payload)
+		}
+	}
+
+	// the processes are killed after the frame and no longer accounted
+	pa.sampleCPU()
+	pa.cpu.lock.Lock()
+	seen := len(pa.cpu.seen)
+	pa.cpu.lock.Unlock()
+	if seen != 0 {
+		t.Fatal("Expected no processes accounted after the frames were read, but got: ", seen)
+	}
+	if usage := pa.cpu.usage(); usage > pa.MaxCPUShare {
+		t.Fatal("Expected the CPU usage to drop after the frames were read, but got: ", usage)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package processagent
+
+import (
+	"fmt"
+	"time"
+)
+
+// processCPUTime is not supported on this platform.
+func processCPUTime(pid int) (time.Duration, error) {
+	return 0, fmt.Errorf("process CPU time not supported on this platform")
+}
@@ -0,0 +1,55 @@
+package processagent
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// runAs holds the IDs of the user and group the processes run as.
+type runAs struct {
+	uid uint32
+	gid uint32
+}
+
+// lookupRunAs resolves the user and group (names or numeric IDs) to their IDs.
+// If the group is empty, the primary group of the user is used. If the user is
+// empty, the processes run as the current user, but with the given group.
+func lookupRunAs(username, group string) (*runAs, error) {
+	ids := &runAs{
+		uid: uint32(os.Getuid()),
+		gid: uint32(os.Getgid()),
+	}
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			if u, err = user.LookupId(username); err != nil {
+				return nil, fmt.Errorf("unknown user: %s", username)
+			}
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported user ID: %s", u.Uid)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported group ID: %s", u.Gid)
+		}
+		ids.uid, ids.gid = uint32(uid), uint32(gid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, fmt.Errorf("unknown group: %s", group)
+			}
+		}
+		gid, err := strconv.ParseUint(g.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported group ID: %s", g.Gid)
+		}
+		ids.gid = uint32(gid)
+	}
+	return ids, nil
+}
@@ -0,0 +1,19 @@
+package processagent
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setCredential makes the command run as the user and group with the given
+// IDs.
+func setCredential(cmd *exec.Cmd, uid, gid uint32) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid: uid,
+		Gid: gid,
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package processagent
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestProcessAgentRunAs(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Running processes as another user requires root.")
+	}
+
+	pa := NewProcessAgent("/bin/sh -c \"id -u && id -g\"", 0)
+	if err := pa.RunAs("65534", "65534"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected no error, but got: ", resp.Payload)
+	}
+	if strings.Fields(resp.Payload)[0] != "65534" || strings.Fields(resp.Payload)[1] != "65534" {
+		t.Fatal("Expected the process to run as UID and GID 65534, but got: ", resp.Payload)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package processagent
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// setCredential is not supported on this platform.
+func setCredential(cmd *exec.Cmd, uid, gid uint32) error {
+	return fmt.Errorf("running the process as another user is not supported on this platform")
+}
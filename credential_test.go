@@ -0,0 +1,40 @@
+package processagent
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+)
+
+func TestLookupRunAs(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip("Cannot look up the current user: ", err.Error())
+	}
+
+	for _, username := range []string{current.Username, current.Uid} {
+		ids, err := lookupRunAs(username, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strconv.Itoa(int(ids.uid)) != current.Uid || strconv.Itoa(int(ids.gid)) != current.Gid {
+			t.Fatal("Expected the IDs of the current user, but got: ", ids.uid, ids.gid)
+		}
+	}
+
+	ids, err := lookupRunAs("", current.Gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(ids.uid) != os.Getuid() {
+		t.Fatal("Expected the current user without a user, but got: ", ids.uid)
+	}
+
+	if _, err := lookupRunAs("no-such-user-here", ""); err == nil {
+		t.Fatal("Expected an error for unknown user.")
+	}
+	if _, err := lookupRunAs("", "no-such-group-here"); err == nil {
+		t.Fatal("Expected an error for unknown group.")
+	}
+}
@@ -0,0 +1,55 @@
+package processagent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Debounce is a Handler that coalesces rapid requests with the same key (as
+// returned by keyFn). Each request is delayed for the debounce window and is
+// processed only if no newer request with the same key arrived in the meantime.
+// The superseded requests are not processed and return with error code 409
+// (Conflict) and a "superseded" message.
+// Requests with an empty key are not debounced.
+func Debounce(window time.Duration, keyFn func(*Request) string) Handler {
+	latest := map[string]uint64{}
+	var counter uint64
+	lock := sync.Mutex{}
+
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			key := keyFn(req)
+			if key == "" {
+				return middleware(ctx, req, resp)
+			}
+
+			lock.Lock()
+			counter++
+			generation := counter
+			latest[key] = generation
+			lock.Unlock()
+
+			timer := time.NewTimer(window)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+			}
+
+			lock.Lock()
+			superseded := latest[key] != generation
+			if !superseded {
+				delete(latest, key)
+			}
+			lock.Unlock()
+
+			if superseded {
+				setErrorResponse(resp, 409, "superseded")
+				return nil
+			}
+			return middleware(ctx, req, resp)
+		}
+	}
+}
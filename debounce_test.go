@@ -0,0 +1,74 @@
+package processagent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDebounce(t *testing.T) {
+	var executions int32
+	var processed string
+	middleware := Debounce(time.Duration(100)*time.Millisecond, func(req *Request) string {
+		return req.Metadata["key"]
+	})(func(ctx context.Context, req *Request, resp *Response) error {
+		atomic.AddInt32(&executions, 1)
+		processed = req.Payload
+		return nil
+	})
+
+	var superseded int32
+	wg := sync.WaitGroup{}
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		wg.Add(1)
+		go func(payload string) {
+			defer wg.Done()
+			resp := &Response{}
+			middleware(context.Background(), &Request{
+				Payload:  payload,
+				Metadata: map[string]string{"key": "a"},
+			}, resp)
+			if resp.ErrorCode != nil && *resp.ErrorCode == 409 && resp.Payload == "superseded" {
+				atomic.AddInt32(&superseded, 1)
+			}
+		}(payload)
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	wg.Wait()
+
+	if executions != 1 {
+		t.Fatal("Expected exactly one execution, but got: ", executions)
+	}
+	if processed != "4" {
+		t.Fatal("Expected the latest request to be processed, but got: ", processed)
+	}
+	if superseded != 3 {
+		t.Fatal("Expected 3 superseded requests, but got: ", superseded)
+	}
+}
+
+func TestDebounceDifferentKeys(t *testing.T) {
+	var executions int32
+	middleware := Debounce(time.Duration(50)*time.Millisecond, func(req *Request) string {
+		return req.Payload
+	})(func(ctx context.Context, req *Request, resp *Response) error {
+		atomic.AddInt32(&executions, 1)
+		return nil
+	})
+
+	wg := sync.WaitGroup{}
+	for _, payload := range []string{"a", "b", ""} {
+		wg.Add(1)
+		go func(payload string) {
+			defer wg.Done()
+			middleware(context.Background(), &Request{Payload: payload}, &Response{})
+		}(payload)
+	}
+	wg.Wait()
+
+	if executions != 3 {
+		t.Fatal("Expected requests with different keys to be processed, but got executions: ", executions)
+	}
+}
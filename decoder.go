@@ -0,0 +1,76 @@
+package processagent
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// RequestDecoder decodes the raw data received on an input port into the
+// Request, before the middleware chain is executed.
+// The Request passed to the decoder has the port specific fields (like Port and
+// Metadata) already populated.
+type RequestDecoder func(data []byte, req *Request) error
+
+// RawDecoder is the default RequestDecoder. It sets the received data as the
+// Request Payload, as it is.
+func RawDecoder(data []byte, req *Request) error {
+	req.Payload = string(data)
+	return nil
+}
+
+// jsonEnvelope is the structure of a request wrapped in a JSON envelope.
+type jsonEnvelope struct {
+	ID       string            `json:"id"`
+	Metadata map[string]string `json:"metadata"`
+	Payload  json.RawMessage   `json:"payload"`
+}
+
+// JSONEnvelopeDecoder is a RequestDecoder for requests wrapped in a JSON
+// envelope, like:
+//
+//	{"id": "request-id", "metadata": {"key": "value"}, "payload": "data"}
+//
+// The ID and the Metadata are set on the Request, which lets the clients supply
+// their own request IDs and metadata. The Metadata does not override the
+// values already populated by the port.
+// If the payload is a JSON string, its value is used as the Request Payload,
+// otherwise the payload JSON is used as is.
+func JSONEnvelopeDecoder(data []byte, req *Request) error {
+	envelope := &jsonEnvelope{}
+	if err := json.Unmarshal(data, envelope); err != nil {
+		return fmt.Errorf("invalid JSON envelope: %s", err.Error())
+	}
+
+	req.ID = envelope.ID
+	if req.Metadata == nil {
+		req.Metadata = map[string]string{}
+	}
+	for key, value := range envelope.Metadata {
+		if _, ok := req.Metadata[key]; !ok {
+			req.Metadata[key] = value
+		}
+	}
+
+	req.Payload = ""
+	if len(envelope.Payload) > 0 {
+		var payload string
+		if err := json.Unmarshal(envelope.Payload, &payload); err == nil {
+			req.Payload = payload
+		} else {
+			req.Payload = string(envelope.Payload)
+		}
+	}
+	return nil
+}
+
+// ParseRequestDecoder returns the RequestDecoder for the given request format:
+// "raw" or "json-envelope".
+func ParseRequestDecoder(format string) (RequestDecoder, error) {
+	switch format {
+	case "raw":
+		return RawDecoder, nil
+	case "json-envelope":
+		return JSONEnvelopeDecoder, nil
+	}
+	return nil, fmt.Errorf("unknown request format: %s", format)
+}
@@ -0,0 +1,52 @@
+package processagent
+
+import (
+	"testing"
+)
+
+func TestRawDecoder(t *testing.T) {
+	req := &Request{}
+	if err := RawDecoder([]byte(`{"id": "a"}`), req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Payload != `{"id": "a"}` || req.ID != "" {
+		t.Fatal("Expected the data to be used as payload as is.")
+	}
+}
+
+func TestJSONEnvelopeDecoder(t *testing.T) {
+	req := &Request{
+		Metadata: map[string]string{
+			MetadataMethod: "POST",
+		},
+	}
+	if err := JSONEnvelopeDecoder([]byte(`{"id": "client-id", "metadata": {"tenant": "t1", "method": "GET"}, "payload": "data"}`), req); err != nil {
+		t.Fatal(err)
+	}
+	if req.ID != "client-id" {
+		t.Fatal("Expected the request ID from the envelope, but got: ", req.ID)
+	}
+	if req.Metadata["tenant"] != "t1" {
+		t.Fatal("Expected the metadata from the envelope, but got: ", req.Metadata)
+	}
+	if req.Metadata[MetadataMethod] != "POST" {
+		t.Fatal("Expected the envelope metadata not to override the port metadata.")
+	}
+	if req.Payload != "data" {
+		t.Fatal("Expected the payload from the envelope, but got: ", req.Payload)
+	}
+}
+
+func TestJSONEnvelopeDecoderObjectPayload(t *testing.T) {
+	req := &Request{}
+	if err := JSONEnvelopeDecoder([]byte(`{"payload": {"name": "test"}}`), req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Payload != `{"name": "test"}` {
+		t.Fatal("Expected the JSON payload as is, but got: ", req.Payload)
+	}
+
+	if err := JSONEnvelopeDecoder([]byte(`not json`), req); err == nil {
+		t.Fatal("Expected an error for invalid envelope.")
+	}
+}
@@ -0,0 +1,178 @@
+package processagent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DuplicateHeader is the name of the Response Metadata key (and HTTP header)
+// set on the responses to duplicate deliveries.
+const DuplicateHeader = "X-Duplicate-Delivery"
+
+// DeliveryStore records the Responses of the processed messages by message ID,
+// so duplicate deliveries can be detected. Implement it to keep the record in a
+// persistent store shared by multiple agents.
+type DeliveryStore interface {
+	// Get returns the recorded Response of the message with the given ID, if
+	// the message was processed and the record has not expired.
+	Get(id string) (*Response, bool)
+	// Put records the Response of the message with the given ID, for the given
+	// ttl.
+	Put(id string, resp *Response, ttl time.Duration)
+}
+
+// deliveryEntry is a Response recorded in the MemoryDeliveryStore.
+type deliveryEntry struct {
+	resp    *Response
+	expires time.Time
+}
+
+// MemoryDeliveryStore is a DeliveryStore that keeps the records in memory.
+// Expired records are evicted.
+type MemoryDeliveryStore struct {
+	entries   map[string]*deliveryEntry
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+// Get returns the recorded Response for the message ID, if not expired.
+func (m *MemoryDeliveryStore) Get(id string) (*Response, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry, ok := m.entries[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(m.entries, id)
+		return nil, false
+	}
+	return entry.resp, true
+}
+
+// Put records the Response for the message ID. The expired records are evicted
+// at most once per ttl.
+func (m *MemoryDeliveryStore) Put(id string, resp *Response, ttl time.Duration) {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if now.Sub(m.lastSweep) >= ttl {
+		for key, entry := range m.entries {
+			if now.After(entry.expires) {
+				delete(m.entries, key)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.entries[id] = &deliveryEntry{
+		resp:    resp,
+		expires: now.Add(ttl),
+	}
+}
+
+// NewMemoryDeliveryStore creates new empty MemoryDeliveryStore.
+func NewMemoryDeliveryStore() *MemoryDeliveryStore {
+	return &MemoryDeliveryStore{
+		entries: map[string]*deliveryEntry{},
+	}
+}
+
+// delivery is a message being processed, that its duplicate deliveries wait
+// for. The recorded Response is set (unless the message failed) before done is
+// closed.
+type delivery struct {
+	done     chan struct{}
+	recorded *Response
+}
+
+// Deduplicate is a Handler that detects duplicate deliveries of the same
+// message, for ports with at-least-once delivery (like message brokers that
+// redeliver messages). The messages are identified by the Request ID (within
+// the port the request was received on), so the handler must run after the ID
+// is set (see RequestIDFrom).
+// A message with an ID that was processed within the window is not processed
+// again; the recorded Response of the first delivery is returned instead, with
+// DuplicateHeader set in the Response Metadata. A duplicate delivered while the
+// first delivery is still being processed waits for its Response.
+// Failed messages are not recorded, so their redeliveries are processed.
+// Requests without an ID are always processed.
+// The recorded Response is returned to anyone sending the same ID, so use it
+// only where the IDs come from a trusted source (like the message broker). On
+// ports where the clients set the ID (like HTTP), a client knowing the ID of
+// another client's message would get its Response.
+func Deduplicate(store DeliveryStore, window time.Duration) Handler {
+	inFlight := map[string]*delivery{}
+	lock := sync.Mutex{}
+
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			if req.ID == "" {
+				return middleware(ctx, req, resp)
+			}
+			key := req.Port + ":" + req.ID
+
+			for {
+				lock.Lock()
+				if pending, ok := inFlight[key]; ok {
+					lock.Unlock()
+					select {
+					case <-pending.done:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					if pending.recorded != nil {
+						setDuplicateResponse(resp, pending.recorded)
+						return nil
+					}
+					// the first delivery failed, process this one
+					continue
+				}
+				if recorded, ok := store.Get(key); ok {
+					lock.Unlock()
+					setDuplicateResponse(resp, recorded)
+					return nil
+				}
+				break
+			}
+			current := &delivery{done: make(chan struct{})}
+			inFlight[key] = current
+			lock.Unlock()
+
+			defer func() {
+				lock.Lock()
+				delete(inFlight, key)
+				lock.Unlock()
+				close(current.done)
+			}()
+
+			if err := middleware(ctx, req, resp); err != nil {
+				return err
+			}
+			if resp.Error == nil || !*resp.Error {
+				recorded := &Response{
+					Payload:  resp.Payload,
+					Metadata: map[string]string{},
+				}
+				for key, value := range resp.Metadata {
+					recorded.Metadata[key] = value
+				}
+				store.Put(key, recorded, window)
+				current.recorded = recorded
+			}
+			return nil
+		}
+	}
+}
+
+// setDuplicateResponse sets the recorded Response of the first delivery on the
+// Response to a duplicate delivery.
+func setDuplicateResponse(resp *Response, recorded *Response) {
+	resp.Payload = recorded.Payload
+	resp.Error = recorded.Error
+	resp.ErrorCode = recorded.ErrorCode
+	for key, value := range recorded.Metadata {
+		resp.SetMetadata(key, value)
+	}
+	resp.SetMetadata(DuplicateHeader, "true")
+}
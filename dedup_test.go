@@ -0,0 +1,139 @@
+package processagent
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeduplicate(t *testing.T) {
+	executions := 0
+	middleware := Deduplicate(NewMemoryDeliveryStore(), time.Duration(100)*time.Millisecond)(func(ctx context.Context, req *Request, resp *Response) error {
+		executions++
+		resp.Payload = "processed " + req.Payload
+		resp.SetMetadata("X-Custom", "value")
+		return nil
+	})
+
+	first := &Response{}
+	middleware(context.Background(), &Request{ID: "msg-1", Payload: "first"}, first)
+	second := &Response{}
+	middleware(context.Background(), &Request{ID: "msg-1", Payload: "redelivered"}, second)
+
+	if executions != 1 {
+		t.Fatal("Expected a single execution for the same message ID, but got: ", executions)
+	}
+	if second.Payload != "processed first" || second.Metadata["X-Custom"] != "value" {
+		t.Fatal("Expected the prior result for the duplicate, but got: ", second.Payload)
+	}
+	if second.Metadata[DuplicateHeader] != "true" || first.Metadata[DuplicateHeader] != "" {
+		t.Fatal("Expected only the duplicate to be marked.")
+	}
+
+	middleware(context.Background(), &Request{ID: "msg-2"}, &Response{})
+	middleware(context.Background(), &Request{}, &Response{})
+	middleware(context.Background(), &Request{}, &Response{})
+	if executions != 4 {
+		t.Fatal("Expected other messages to be processed, but got executions: ", executions)
+	}
+
+	time.Sleep(time.Duration(120) * time.Millisecond)
+	middleware(context.Background(), &Request{ID: "msg-1"}, &Response{})
+	if executions != 5 {
+		t.Fatal("Expected the message to be processed after the window, but got executions: ", executions)
+	}
+}
+
+func TestDeduplicateFailedMessage(t *testing.T) {
+	executions := 0
+	middleware := Deduplicate(NewMemoryDeliveryStore(), time.Minute)(func(ctx context.Context, req *Request, resp *Response) error {
+		executions++
+		if executions == 1 {
+			setErrorResponse(resp, 500, "failed")
+		}
+		return nil
+	})
+
+	middleware(context.Background(), &Request{ID: "msg"}, &Response{})
+	resp := &Response{}
+	middleware(context.Background(), &Request{ID: "msg"}, resp)
+	if executions != 2 || resp.Error != nil {
+		t.Fatal("Expected the redelivery of a failed message to be processed.")
+	}
+}
+
+func TestDeduplicateConcurrentDeliveries(t *testing.T) {
+	var executions int32
+	started := make(chan bool)
+	release := make(chan bool)
+	middleware := Deduplicate(NewMemoryDeliveryStore(), time.Minute)(func(ctx context.Context, req *Request, resp *Response) error {
+		atomic.AddInt32(&executions, 1)
+		started <- true
+		<-release
+		resp.Payload = "processed"
+		return nil
+	})
+
+	responses := make([]*Response, 3)
+	var wg sync.WaitGroup
+	for i := range responses {
+		responses[i] = &Response{}
+		wg.Add(1)
+		go func(resp *Response) {
+			defer wg.Done()
+			middleware(context.Background(), &Request{ID: "msg", Port: "amqp"}, resp)
+		}(responses[i])
+	}
+	<-started
+	// the duplicates get to wait for the first delivery
+	time.Sleep(time.Duration(50) * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if executions != 1 {
+		t.Fatal("Expected the concurrent duplicates not to be processed, but got executions: ", executions)
+	}
+	duplicates := 0
+	for _, resp := range responses {
+		if resp.Payload != "processed" {
+			t.Fatal("Expected each delivery to get the response, but got: ", resp.Payload)
+		}
+		if resp.Metadata[DuplicateHeader] == "true" {
+			duplicates++
+		}
+	}
+	if duplicates != 2 {
+		t.Fatal("Expected the duplicates to be marked, but got: ", duplicates)
+	}
+}
+
+func TestDeduplicatePerPort(t *testing.T) {
+	executions := 0
+	middleware := Deduplicate(NewMemoryDeliveryStore(), time.Minute)(func(ctx context.Context, req *Request, resp *Response) error {
+		executions++
+		return nil
+	})
+
+	middleware(context.Background(), &Request{ID: "msg", Port: "amqp"}, &Response{})
+	resp := &Response{}
+	middleware(context.Background(), &Request{ID: "msg", Port: "http"}, resp)
+	if executions != 2 || resp.Metadata[DuplicateHeader] != "" {
+		t.Fatal("Expected the same ID on another port not to be a duplicate.")
+	}
+}
+
+func TestMemoryDeliveryStoreEviction(t *testing.T) {
+	store := NewMemoryDeliveryStore()
+	store.Put("old", &Response{}, time.Millisecond)
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	store.Put("new", &Response{}, time.Millisecond)
+
+	if _, ok := store.entries["old"]; ok {
+		t.Fatal("Expected the expired record to be evicted.")
+	}
+	if _, ok := store.Get("new"); !ok {
+		t.Fatal("Expected the new record to be found.")
+	}
+}
@@ -0,0 +1,59 @@
+package processagent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// ETagHeader is the name of the Response Metadata key (and HTTP header) holding
+// the entity tag of the response.
+const ETagHeader = "Etag"
+
+// computeETag computes a strong entity tag from the payload.
+func computeETag(payload string) string {
+	hash := sha256.Sum256([]byte(payload))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// etagMatches checks whether the entity tag matches any of the entity tags in
+// the If-None-Match header value. Weak entity tags (W/"...") are compared by
+// their value, and "*" matches any entity tag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ETag is a Handler that computes the entity tag of the response payload (a
+// hash of it) and sets it in the Response Metadata (see ETagHeader). If the
+// client already has the same response (its If-None-Match header matches the
+// entity tag), the payload is dropped and the status is set to 304 (Not
+// Modified). Meant for deterministic commands.
+// The entity tag must be computed on the output of the process, so ETag must
+// wrap the process directly, before the Response is serialized (for example,
+// with JSONResponse). Pair it with the ResponseCache (wrapping the cache) to
+// avoid running the process again.
+// Failed responses are left as they are.
+func ETag(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		if err := middleware(ctx, req, resp); err != nil {
+			return err
+		}
+		if resp.Error != nil && *resp.Error {
+			return nil
+		}
+		etag := computeETag(resp.Payload)
+		resp.SetMetadata(ETagHeader, etag)
+		if ifNoneMatch := req.Metadata["If-None-Match"]; ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+			resp.SetMetadata(MetadataStatus, "304")
+			resp.Payload = ""
+		}
+		return nil
+	}
+}
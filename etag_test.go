@@ -0,0 +1,58 @@
+package processagent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestETag(t *testing.T) {
+	executions := 0
+	cache := NewResponseCache(time.Minute)
+	middleware := ETag(cache.Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		executions++
+		resp.Payload = "deterministic output"
+		return nil
+	}))
+	request := func(ifNoneMatch string) *Response {
+		resp := &Response{}
+		middleware(context.Background(), &Request{Metadata: map[string]string{
+			MetadataMethod:  "GET",
+			"If-None-Match": ifNoneMatch,
+		}}, resp)
+		return resp
+	}
+
+	resp := request("")
+	etag := resp.Metadata[ETagHeader]
+	if etag == "" || resp.Payload != "deterministic output" || resp.Metadata[MetadataStatus] != "" {
+		t.Fatal("Expected the full response with an ETag, but got: ", resp.Payload, resp.Metadata)
+	}
+
+	resp = request(`"other"`)
+	if resp.Payload != "deterministic output" || resp.Metadata[ETagHeader] != etag {
+		t.Fatal("Expected the full response when the ETag does not match, but got: ", resp.Payload)
+	}
+
+	for _, ifNoneMatch := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		resp = request(ifNoneMatch)
+		if resp.Metadata[MetadataStatus] != "304" || resp.Payload != "" {
+			t.Fatalf("Expected 304 for If-None-Match %s, but got: %s", ifNoneMatch, resp.Payload)
+		}
+	}
+	if executions != 1 {
+		t.Fatal("Expected the cached response to be used, but got executions: ", executions)
+	}
+}
+
+func TestETagFailedResponse(t *testing.T) {
+	middleware := ETag(func(ctx context.Context, req *Request, resp *Response) error {
+		setErrorResponse(resp, 500, "failed")
+		return nil
+	})
+	resp := &Response{}
+	middleware(context.Background(), &Request{Metadata: map[string]string{"If-None-Match": "*"}}, resp)
+	if resp.Metadata[ETagHeader] != "" || resp.Payload != "failed" {
+		t.Fatal("Expected the failed response to be left as it is.")
+	}
+}
@@ -0,0 +1,41 @@
+package processagent
+
+import (
+	"context"
+	"log"
+)
+
+// ServedByHeader is the name of the Response Metadata key (and HTTP header)
+// telling which command served the request with Fallback: "primary" or
+// "fallback".
+const ServedByHeader = "X-Served-By"
+
+// Fallback creates a Middleware that processes the requests with the primary
+// ProcessAgent and, if it fails (returns an error or responds with an error,
+// like when the process exits with non-zero status), processes the request
+// again with the secondary ProcessAgent and returns its result instead. Useful
+// with a slower, but more reliable secondary implementation.
+// Which of the commands served the request is set in the Response Metadata, see
+// ServedByHeader.
+func Fallback(primary, secondary ProcessAgent) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		primaryResp := &Response{}
+		err := primary.ProcessCommand(req, primaryResp)
+		if err == nil && (primaryResp.Error == nil || !*primaryResp.Error) {
+			resp.Payload = primaryResp.Payload
+			resp.SetMetadata(ServedByHeader, "primary")
+			return nil
+		}
+		message := primaryResp.Payload
+		if err != nil {
+			message = err.Error()
+		}
+		log.Println("Fallback: Primary command failed, falling back. Error: ", message)
+
+		if err := secondary.ProcessCommand(req, resp); err != nil {
+			return err
+		}
+		resp.SetMetadata(ServedByHeader, "fallback")
+		return nil
+	}
+}
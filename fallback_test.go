@@ -0,0 +1,50 @@
+package processagent
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	middleware := Fallback(
+		NewProcessAgent("/bin/sh -c \"exit 1\"", 0),
+		NewProcessAgent("tr a-z A-Z", 0),
+	)
+
+	resp := &Response{}
+	if err := middleware(context.Background(), &Request{Payload: "hello"}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		t.Fatal("Expected the fallback to succeed, but got: ", resp.Payload)
+	}
+	if resp.Payload != "HELLO" || resp.Metadata[ServedByHeader] != "fallback" {
+		t.Fatal("Expected the request to be served by the fallback, but got: ", resp.Payload, resp.Metadata)
+	}
+}
+
+func TestFallbackPrimarySucceeds(t *testing.T) {
+	middleware := Fallback(
+		NewProcessAgent("cat", 0),
+		NewProcessAgent("tr a-z A-Z", 0),
+	)
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Payload: "hello"}, resp)
+	if resp.Payload != "hello" || resp.Metadata[ServedByHeader] != "primary" {
+		t.Fatal("Expected the request to be served by the primary, but got: ", resp.Payload, resp.Metadata)
+	}
+}
+
+func TestFallbackBothFail(t *testing.T) {
+	middleware := Fallback(
+		NewProcessAgent("/bin/sh -c \"exit 1\"", 0),
+		NewProcessAgent("/bin/sh -c \"exit 2\"", 0),
+	)
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if resp.Error == nil || !*resp.Error || resp.Payload != "exit status 2" {
+		t.Fatal("Expected the error of the fallback, but got: ", resp.Payload)
+	}
+}
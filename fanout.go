@@ -0,0 +1,145 @@
+package processagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// FanOutPolicy defines how the FanOutAgent handles the failures of some of the
+// commands.
+type FanOutPolicy int
+
+const (
+	// FanOutFailAny fails the whole request if any of the commands fails. The
+	// Response carries the error of the failed command.
+	FanOutFailAny FanOutPolicy = iota
+	// FanOutPartial responds with the results of all commands, including the
+	// errors of the failed ones. The request fails only if all commands fail.
+	FanOutPartial
+)
+
+// fanOutResult is the result of a single command in the aggregated response of
+// the FanOutAgent.
+type fanOutResult struct {
+	Payload   string `json:"payload"`
+	Error     bool   `json:"error,omitempty"`
+	ErrorCode int    `json:"errorCode,omitempty"`
+}
+
+// FanOutAgent is a ProcessAgent that runs the same Request with several process
+// agents (commands) in parallel and aggregates their outputs into a single
+// Response.
+// The Response payload is a JSON object keyed by the name of the command,
+// holding the payload of each command, for example:
+//
+//	{"resize": {"payload": "..."}, "thumbnail": {"payload": "...", "error": true, "errorCode": 500}}
+//
+// Failures of the commands are handled according to the FanOutPolicy.
+type FanOutAgent struct {
+	agents map[string]ProcessAgent
+	policy FanOutPolicy
+}
+
+// GetMiddleware returns a middleware that can be attached to a given InputPort
+// to handle Request by fanning it out to all of the commands.
+func (f *FanOutAgent) GetMiddleware() Middleware {
+	return f.ProcessCommandContext
+}
+
+// Stop stops all of the process agents.
+func (f *FanOutAgent) Stop() error {
+	var stopErr error
+	for name, agent := range f.agents {
+		if err := agent.Stop(); err != nil && stopErr == nil {
+			stopErr = fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	return stopErr
+}
+
+// ProcessCommand runs the Request with all of the process agents concurrently,
+// waits for all of them to finish, then populates the Response with the
+// aggregated results.
+func (f *FanOutAgent) ProcessCommand(req *Request, resp *Response) error {
+	return f.ProcessCommandContext(context.Background(), req, resp)
+}
+
+// ProcessCommandContext is like ProcessCommand, but passes the context on to
+// the process agents that support it (like LocalProcessAgent), so all of the
+// commands are canceled with the request. A request past its deadline fails
+// with error code 504, see contextErrorResponse.
+func (f *FanOutAgent) ProcessCommandContext(ctx context.Context, req *Request, resp *Response) error {
+	results := map[string]*fanOutResult{}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for name, agent := range f.agents {
+		wg.Add(1)
+		go func(name string, agent ProcessAgent) {
+			defer wg.Done()
+			result := runFanOut(ctx, agent, req)
+			lock.Lock()
+			results[name] = result
+			lock.Unlock()
+		}(name, agent)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return contextErrorResponse(ctx, resp)
+	}
+
+	names := make([]string, 0, len(results))
+	failed := 0
+	for name, result := range results {
+		names = append(names, name)
+		if result.Error {
+			failed++
+		}
+	}
+	sort.Strings(names)
+
+	if failed > 0 && (f.policy == FanOutFailAny || failed == len(results)) {
+		for _, name := range names {
+			if result := results[name]; result.Error {
+				setErrorResponse(resp, result.ErrorCode, fmt.Sprintf("command %s failed: %s", name, result.Payload))
+				return nil
+			}
+		}
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	resp.Payload = string(data)
+	return nil
+}
+
+// runFanOut runs the Request with a single process agent and returns its result.
+func runFanOut(ctx context.Context, agent ProcessAgent, req *Request) *fanOutResult {
+	resp := &Response{}
+	if err := processCommandContext(ctx, agent, req, resp); err != nil {
+		return &fanOutResult{Payload: err.Error(), Error: true, ErrorCode: 500}
+	}
+	result := &fanOutResult{Payload: resp.Payload}
+	if resp.Error != nil && *resp.Error {
+		result.Error = true
+		result.ErrorCode = 500
+		if resp.ErrorCode != nil {
+			result.ErrorCode = *resp.ErrorCode
+		}
+	}
+	return result
+}
+
+// NewFanOutAgent creates new FanOutAgent that fans out the requests to the given
+// process agents, keyed by the name of the command, and handles the failures
+// according to the policy.
+func NewFanOutAgent(agents map[string]ProcessAgent, policy FanOutPolicy) *FanOutAgent {
+	return &FanOutAgent{
+		agents: agents,
+		policy: policy,
+	}
+}
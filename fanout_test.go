@@ -0,0 +1,105 @@
+package processagent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFanOutAgent(t *testing.T) {
+	agent := NewFanOutAgent(map[string]ProcessAgent{
+		"upper": NewProcessAgent("tr a-z A-Z", 0),
+		"count": NewProcessAgent("wc -c", 0),
+	}, FanOutFailAny)
+	defer agent.Stop()
+
+	resp := &Response{}
+	if err := agent.ProcessCommand(&Request{Payload: "hello"}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		t.Fatal("Expected no error, but got: ", resp.Payload)
+	}
+
+	results := map[string]fanOutResult{}
+	if err := json.Unmarshal([]byte(resp.Payload), &results); err != nil {
+		t.Fatal("Expected aggregated JSON result, but got: ", resp.Payload)
+	}
+	if results["upper"].Payload != "HELLO" {
+		t.Fatal("Expected the output of the first command, but got: ", results["upper"])
+	}
+	if strings.TrimSpace(results["count"].Payload) != "5" {
+		t.Fatal("Expected the output of the second command, but got: ", results["count"])
+	}
+}
+
+func TestFanOutAgentPartialFailure(t *testing.T) {
+	agents := map[string]ProcessAgent{
+		"ok":   NewProcessAgent("echo ok", 0),
+		"fail": NewProcessAgent("/bin/sh -c \"exit 1\"", 0),
+	}
+
+	resp := &Response{}
+	NewFanOutAgent(agents, FanOutFailAny).ProcessCommand(&Request{}, resp)
+	if resp.Error == nil || !*resp.Error || *resp.ErrorCode != 500 {
+		t.Fatal("Expected the request to fail, but got: ", resp.Payload)
+	}
+	if !strings.HasPrefix(resp.Payload, "command fail failed:") {
+		t.Fatal("Expected the error of the failed command, but got: ", resp.Payload)
+	}
+
+	resp = &Response{}
+	NewFanOutAgent(agents, FanOutPartial).ProcessCommand(&Request{}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected partial results, but got error: ", resp.Payload)
+	}
+	results := map[string]fanOutResult{}
+	if err := json.Unmarshal([]byte(resp.Payload), &results); err != nil {
+		t.Fatal("Expected aggregated JSON result, but got: ", resp.Payload)
+	}
+	if results["ok"].Payload != "ok\n" || results["ok"].Error {
+		t.Fatal("Expected the output of the successful command, but got: ", results["ok"])
+	}
+	if !results["fail"].Error || results["fail"].ErrorCode != 500 {
+		t.Fatal("Expected the error of the failed command, but got: ", results["fail"])
+	}
+}
+
+func TestFanOutAgentAllFail(t *testing.T) {
+	agent := NewFanOutAgent(map[string]ProcessAgent{
+		"a": NewProcessAgent("/bin/sh -c \"exit 1\"", 0),
+		"b": NewProcessAgent("/bin/sh -c \"exit 2\"", 0),
+	}, FanOutPartial)
+
+	resp := &Response{}
+	agent.ProcessCommand(&Request{}, resp)
+	if resp.Error == nil || !*resp.Error {
+		t.Fatal("Expected the request to fail when all commands fail.")
+	}
+	if !strings.HasPrefix(resp.Payload, "command a failed:") {
+		t.Fatal("Expected the error of the first failed command, but got: ", resp.Payload)
+	}
+}
+
+func TestFanOutAgentContext(t *testing.T) {
+	agent := NewFanOutAgent(map[string]ProcessAgent{
+		"first":  NewProcessAgent("sleep 30", 0),
+		"second": NewProcessAgent("sleep 30", 0),
+	}, FanOutPartial)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Duration(200) * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err := agent.GetMiddleware()(ctx, &Request{}, &Response{})
+	if elapsed := time.Since(start); elapsed > time.Duration(1200)*time.Millisecond {
+		t.Fatal("Expected the commands to be killed when the request is canceled, but they ran for: ", elapsed)
+	}
+	if err != context.Canceled {
+		t.Fatal("Expected a cancellation error, but got: ", err)
+	}
+}
@@ -0,0 +1,95 @@
+package processagent
+
+import (
+	"context"
+	"log"
+	mathrand "math/rand"
+	"os"
+	"time"
+)
+
+// FaultInjectionEnv is the name of the environment variable that enables the
+// fault injection, see FaultInjection. Faults are injected only if it is set
+// to "true", so a fault injection left in the configuration cannot break a
+// production deployment.
+const FaultInjectionEnv = "PA_FAULT_INJECTION"
+
+// FaultHeader is the Response Metadata key set to the kind of the injected
+// fault: "delay", "error" or "timeout".
+const FaultHeader = "X-Injected-Fault"
+
+// FaultConfig configures the faults injected by FaultInjection. The rates are
+// the probabilities (from 0 to 1) of injecting each fault into a request. A
+// request gets at most one fault, so the rates should add up to at most 1.
+type FaultConfig struct {
+	// DelayRate is the rate of the requests delayed by Delay before they are
+	// processed.
+	DelayRate float64
+	Delay     time.Duration
+	// ErrorRate is the rate of the requests failed with ErrorCode (500 if not
+	// set) without running the process.
+	ErrorRate float64
+	ErrorCode int
+	// TimeoutRate is the rate of the requests that hang for Timeout (or until
+	// the request context is done, if not set) and then fail with error code
+	// 504 (Gateway Timeout), without running the process.
+	TimeoutRate float64
+	Timeout     time.Duration
+}
+
+// faultRandom returns a pseudo-random number in [0, 1) to decide which fault
+// to inject.
+var faultRandom = mathrand.Float64
+
+// FaultInjection is a Handler that injects synthetic faults into the requests,
+// with the rates given in the FaultConfig: delays, errors and timeouts. It is
+// meant for resilience testing, to verify how the clients handle retries,
+// circuit breaking and timeouts without a misbehaving process.
+// The faults are injected only if the FaultInjectionEnv environment variable is
+// set to "true" when the Handler is created, otherwise the requests pass
+// through unchanged. The kind of the injected fault is set in the FaultHeader
+// Response Metadata.
+func FaultInjection(config FaultConfig) Handler {
+	enabled := os.Getenv(FaultInjectionEnv) == "true"
+	if enabled {
+		log.Println("ProcessAgent: Fault injection enabled. Do not use in production.")
+	}
+	errorCode := config.ErrorCode
+	if errorCode == 0 {
+		errorCode = 500
+	}
+	return func(middleware Middleware) Middleware {
+		if !enabled {
+			return middleware
+		}
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			chance := faultRandom()
+			switch {
+			case chance < config.TimeoutRate:
+				resp.SetMetadata(FaultHeader, "timeout")
+				var timeout <-chan time.Time
+				if config.Timeout > 0 {
+					timeout = time.After(config.Timeout)
+				}
+				select {
+				case <-ctx.Done():
+				case <-timeout:
+				}
+				setErrorResponse(resp, 504, "injected fault: timeout")
+				return nil
+			case chance < config.TimeoutRate+config.ErrorRate:
+				resp.SetMetadata(FaultHeader, "error")
+				setErrorResponse(resp, errorCode, "injected fault: error")
+				return nil
+			case chance < config.TimeoutRate+config.ErrorRate+config.DelayRate:
+				resp.SetMetadata(FaultHeader, "delay")
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(config.Delay):
+				}
+			}
+			return middleware(ctx, req, resp)
+		}
+	}
+}
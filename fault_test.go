@@ -0,0 +1,104 @@
+package processagent
+
+import (
+	"context"
+	mathrand "math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFaultInjection(t *testing.T) {
+	os.Setenv(FaultInjectionEnv, "true")
+	defer os.Unsetenv(FaultInjectionEnv)
+	// evenly distributed "random" numbers, so the fault rates are exact
+	var sample int
+	faultRandom = func() float64 {
+		sample++
+		return float64(sample%100) / 100
+	}
+	defer func() {
+		faultRandom = mathrand.Float64
+	}()
+
+	processed := 0
+	middleware := FaultInjection(FaultConfig{
+		TimeoutRate: 0.25,
+		Timeout:     time.Millisecond,
+		ErrorRate:   0.25,
+		ErrorCode:   503,
+		DelayRate:   0.25,
+		Delay:       time.Millisecond,
+	})(func(ctx context.Context, req *Request, resp *Response) error {
+		processed++
+		return nil
+	})
+
+	faults := map[string]int{}
+	var delayed time.Duration
+	for i := 0; i < 100; i++ {
+		resp := &Response{}
+		start := time.Now()
+		middleware(context.Background(), &Request{}, resp)
+		fault := resp.Metadata[FaultHeader]
+		faults[fault]++
+		switch fault {
+		case "timeout":
+			if resp.ErrorCode == nil || *resp.ErrorCode != 504 {
+				t.Fatal("Expected a timeout fault to fail with 504.")
+			}
+		case "error":
+			if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+				t.Fatal("Expected an error fault to fail with the configured code.")
+			}
+		case "delay":
+			delayed += time.Since(start)
+			if resp.Error != nil {
+				t.Fatal("Expected a delayed request to succeed.")
+			}
+		}
+	}
+	if faults["timeout"] != 25 || faults["error"] != 25 || faults["delay"] != 25 || faults[""] != 25 {
+		t.Fatal("Expected the faults to be injected at the configured rates, but got: ", faults)
+	}
+	if processed != 50 {
+		t.Fatal("Expected only the delayed and the unaffected requests to be processed, but got: ", processed)
+	}
+	if delayed < 25*time.Millisecond {
+		t.Fatal("Expected the delayed requests to be delayed, but they took: ", delayed)
+	}
+}
+
+func TestFaultInjectionTimeoutUntilDone(t *testing.T) {
+	os.Setenv(FaultInjectionEnv, "true")
+	defer os.Unsetenv(FaultInjectionEnv)
+
+	middleware := FaultInjection(FaultConfig{TimeoutRate: 1})(func(ctx context.Context, req *Request, resp *Response) error {
+		t.Fatal("Expected the request not to be processed.")
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resp := &Response{}
+	middleware(ctx, &Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 504 || ctx.Err() == nil {
+		t.Fatal("Expected the request to hang until the context is done and fail with 504.")
+	}
+}
+
+func TestFaultInjectionDisabled(t *testing.T) {
+	os.Unsetenv(FaultInjectionEnv)
+
+	processed := false
+	middleware := FaultInjection(FaultConfig{ErrorRate: 1})(func(ctx context.Context, req *Request, resp *Response) error {
+		processed = true
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if !processed || resp.Error != nil {
+		t.Fatal("Expected no faults to be injected without the environment variable set.")
+	}
+}
@@ -0,0 +1,115 @@
+package processagent
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// fdPipes holds the pipes used to exchange data with the external process over
+// additional file descriptors, instead of the process STDIN and STDOUT.
+//
+// The convention for the external process is: the request payload is available
+// for reading on the input file descriptor and it is closed once the whole
+// payload has been written; the response must be written to the output file
+// descriptor. STDOUT is then free to be used for logging - whatever the process
+// writes there is passed through to the STDOUT of the agent.
+type fdPipes struct {
+	input      string
+	inputPipe  *os.File
+	outputPipe *os.File
+	childFiles []*os.File
+	output     io.Writer
+	done       chan error
+}
+
+// configureFDs sets up the pipes on the configured input and output file
+// descriptors for the process command. If no file descriptors are configured,
+// STDIN and STDOUT are used as usual.
+func (w *processWrapper) configureFDs(input string) (*fdPipes, error) {
+	pipes := &fdPipes{
+		input:  input,
+		output: w.stdout,
+		done:   make(chan error, 1),
+	}
+	if w.inputFD == 0 && w.outputFD == 0 {
+		return pipes, nil
+	}
+	if (w.inputFD != 0 && w.inputFD < 3) || (w.outputFD != 0 && w.outputFD < 3) {
+		return nil, fmt.Errorf("file descriptors must be 3 or greater")
+	}
+	if w.inputFD == w.outputFD {
+		return nil, fmt.Errorf("input and output file descriptors must be different")
+	}
+
+	size := w.inputFD
+	if w.outputFD > size {
+		size = w.outputFD
+	}
+	w.cmd.ExtraFiles = make([]*os.File, size-2)
+
+	if w.inputFD != 0 {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		w.cmd.ExtraFiles[w.inputFD-3] = reader
+		w.cmd.Stdin = nil
+		pipes.inputPipe = writer
+		pipes.childFiles = append(pipes.childFiles, reader)
+	}
+
+	if w.outputFD != 0 {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			pipes.close()
+			return nil, err
+		}
+		w.cmd.ExtraFiles[w.outputFD-3] = writer
+		w.cmd.Stdout = os.Stdout
+		pipes.outputPipe = reader
+		pipes.childFiles = append(pipes.childFiles, writer)
+	}
+
+	return pipes, nil
+}
+
+// start closes the ends of the pipes that are passed to the external process,
+// then starts writing the input and reading the output.
+// Must be called after the process has been started.
+func (p *fdPipes) start() {
+	for _, file := range p.childFiles {
+		file.Close()
+	}
+	p.childFiles = nil
+	if p.inputPipe != nil {
+		go func() {
+			io.WriteString(p.inputPipe, p.input)
+			p.inputPipe.Close()
+		}()
+	}
+	if p.outputPipe != nil {
+		go func() {
+			_, err := io.Copy(p.output, p.outputPipe)
+			p.outputPipe.Close()
+			p.done <- err
+		}()
+	}
+}
+
+// wait waits for the whole output to be read from the output pipe.
+func (p *fdPipes) wait() error {
+	if p.outputPipe == nil {
+		return nil
+	}
+	return <-p.done
+}
+
+// close closes all of the pipes. Used when the process failed to start.
+func (p *fdPipes) close() {
+	for _, file := range append(p.childFiles, p.inputPipe, p.outputPipe) {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
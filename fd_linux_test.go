@@ -0,0 +1,50 @@
+package processagent
+
+import (
+	"testing"
+)
+
+func TestProcessAgentCustomFDs(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"echo log-line; cat <&3 >&4\"", 0)
+	pa.InputFD = 3
+	pa.OutputFD = 4
+
+	resp := &Response{}
+	if err := pa.ProcessCommand(&Request{
+		Payload: "test-payload",
+	}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		t.Fatal("Expected the process to run without error, but got: ", resp.Payload)
+	}
+	if resp.Payload != "test-payload" {
+		t.Fatal("Expected the output to be read from fd 4, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentOutputFDOnly(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"cat >&5\"", 0)
+	pa.OutputFD = 5
+
+	resp := &Response{}
+	if err := pa.ProcessCommand(&Request{
+		Payload: "from-stdin",
+	}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Payload != "from-stdin" {
+		t.Fatal("Expected the output to be read from fd 5, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentInvalidFD(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"cat\"", 0)
+	pa.InputFD = 1
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error == nil || !*resp.Error {
+		t.Fatal("Expected an error for an invalid file descriptor.")
+	}
+}
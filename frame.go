@@ -0,0 +1,64 @@
+package processagent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// MaxFrameSize is the maximal size (in bytes) of a single frame of framed
+// process output.
+const MaxFrameSize = 64 * 1024 * 1024
+
+// readFrame reads a single frame of framed process output.
+//
+// A frame consists of a 4 byte header holding the length of the frame data as
+// unsigned big-endian integer, followed by exactly that many bytes of data.
+func readFrame(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read frame header: %s", err.Error())
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("failed to read frame: %s", err.Error())
+	}
+	return data, nil
+}
+
+// readFramedOutput reads a single frame from the process output. Once the frame
+// has been read, the process is killed and waited on, as nothing reuses it
+// afterwards. Only the process itself is killed, so its children that keep the
+// output open delay the response until they exit.
+// If the process does not produce a frame, the process is waited on to exit
+// and an error is returned: the exit status if the process failed, otherwise
+// the error reading the frame.
+// The exited channel is closed once the process has exited.
+func (w *processWrapper) readFramedOutput(output io.Reader, exited chan struct{}) (outStr, errStr string) {
+	frame, err := readFrame(output)
+	if err == nil {
+		// the process may keep running after the frame, or even exit on its own
+		// in the meantime
+		w.cmd.Process.Kill()
+	}
+	io.Copy(ioutil.Discard, output)
+	waitErr := w.cmd.Wait()
+	w.state = w.cmd.ProcessState
+	close(exited)
+	w.errOutput = w.stderr.String()
+	if err == nil {
+		return string(frame), ""
+	}
+	if w.stderrAsError && w.errOutput != "" {
+		return "", w.errOutput
+	}
+	if waitErr != nil {
+		return "", waitErr.Error()
+	}
+	return "", err.Error()
+}
@@ -0,0 +1,130 @@
+package processagent
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReadFrame(t *testing.T) {
+	frame, err := readFrame(bytes.NewReader([]byte("\x00\x00\x00\x05helloremaining")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(frame) != "hello" {
+		t.Fatal("Expected to read the frame data, but got: ", string(frame))
+	}
+
+	if _, err = readFrame(bytes.NewReader([]byte("\x00\x00\x00\x05hel"))); err == nil {
+		t.Fatal("Expected an error on incomplete frame.")
+	}
+	if _, err = readFrame(bytes.NewReader([]byte("\xff\xff\xff\xff"))); err == nil {
+		t.Fatal("Expected an error on frame that is too large.")
+	}
+}
+
+func TestProcessAgentFramedOutput(t *testing.T) {
+	pa := NewProcessAgent(`/bin/sh -c "printf \\\\000\\\\000\\\\000\\\\005hello; exec sleep 2"`, 0)
+	pa.FramedOutput = true
+
+	start := time.Now()
+	resp := &Response{}
+	if err := pa.ProcessCommand(&Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		t.Fatal("Expected no error, but got: ", resp.Payload)
+	}
+	if resp.Payload != "hello" {
+		t.Fatal("Expected to get the framed response, but got: ", resp.Payload)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Expected the response to be returned without waiting for the process to exit.")
+	}
+	pa.Stop()
+}
+
+func TestProcessAgentFramedOutputMissing(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"echo unframed\"", 0)
+	pa.FramedOutput = true
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error == nil || !*resp.Error {
+		t.Fatal("Expected an error when the process does not emit a frame.")
+	}
+}
+
+func TestProcessAgentFramedOutputStderr(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"echo warning >&2; exit 3\"", 0)
+	pa.FramedOutput = true
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error == nil || resp.Payload != "exit status 3" {
+		t.Fatal("Expected the exit status as the error, but got: ", resp.Payload)
+	}
+	if resp.Stderr != "warning\n" {
+		t.Fatalf("Expected the STDERR output in the response, but got: %q", resp.Stderr)
+	}
+}
+
+func TestProcessAgentFramedOutputStdin(t *testing.T) {
+	pa := NewProcessAgent(`/bin/sh -c "printf \\\\000\\\\000\\\\000\\\\002ok"`, 0)
+	pa.FramedOutput = true
+	pa.Stdin = StdinOptions{Delivery: StdinLines, Interval: time.Hour}
+	defer pa.Stop()
+
+	base := runtime.NumGoroutine()
+	resp := &Response{}
+	pa.ProcessCommand(&Request{Payload: "a\nb\n"}, resp)
+	if resp.Payload != "ok" {
+		t.Fatal("Expected to get the framed response, but got: ", resp.Payload)
+	}
+
+	// the input is no longer written once the process has exited
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > base {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the input writer to stop after the process exited.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcessAgentFramedOutputState(t *testing.T) {
+	// the process exits right after the frame, while the response is built
+	pa := NewProcessAgent(`/bin/sh -c "printf \\\\000\\\\000\\\\000\\\\002ok"`, 0)
+	pa.FramedOutput = true
+	pa.ReportUsage = true
+	pa.MaxCPUShare = 0.9
+	defer pa.Stop()
+
+	for i := 0; i < 10; i++ {
+		resp := &Response{}
+		pa.ProcessCommand(&Request{}, resp)
+		if resp.Payload != "ok" {
+			t.Fatal("Expected to get the framed response, but got: ", resp.Payload)
+		}
+	}
+}
+
+func TestProcessAgentFramedOutputKilled(t *testing.T) {
+	pa := NewProcessAgent(`/bin/sh -c "printf \\\\000\\\\000\\\\000\\\\002ok; exec sleep 10"`, 1)
+	pa.FramedOutput = true
+	pa.Timeout = time.Minute
+	defer pa.Stop()
+
+	// the single worker is released after each frame
+	for i := 0; i < 3; i++ {
+		resp := &Response{}
+		pa.ProcessCommand(&Request{}, resp)
+		if resp.Payload != "ok" {
+			t.Fatal("Expected to get the framed response, but got: ", resp.Payload)
+		}
+	}
+	if running := len(pa.runningProcesses()); running != 0 {
+		t.Fatal("Expected the processes to be killed after the frame, but got running: ", running)
+	}
+}
@@ -0,0 +1,150 @@
+package processagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// StartupPolicy defines how the agent reacts to errors that occur while
+// starting up (for example, failing to bind a port).
+type StartupPolicy string
+
+const (
+	// FailFast policy terminates the agent on any startup error.
+	FailFast StartupPolicy = "fail-fast"
+	// Degraded policy keeps the agent running in a degraded state. The health
+	// endpoint reports the degraded state until the agent recovers (see
+	// SetHealthy). A port that failed to bind serves no requests, so serve the
+	// health endpoint on its own port (see Serve) to observe the state.
+	Degraded StartupPolicy = "degraded"
+)
+
+// ParseStartupPolicy parses the name of a StartupPolicy.
+func ParseStartupPolicy(name string) (StartupPolicy, error) {
+	switch StartupPolicy(name) {
+	case FailFast, Degraded:
+		return StartupPolicy(name), nil
+	}
+	return "", fmt.Errorf("unknown startup policy: %s", name)
+}
+
+// Health holds the health state of the agent and the StartupPolicy applied on
+// startup errors.
+// It is an http.Handler that reports the state of the agent and can be
+// registered as a health endpoint.
+type Health struct {
+	policy   StartupPolicy
+	degraded bool
+	reason   string
+	lock     sync.RWMutex
+}
+
+// healthStatus is the health state as reported by the health endpoint.
+type healthStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SetDegraded puts the agent in degraded state for the given reason.
+func (h *Health) SetDegraded(reason string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.degraded = true
+	h.reason = reason
+}
+
+// SetHealthy clears the degraded state, once the agent has recovered.
+func (h *Health) SetHealthy() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.degraded = false
+	h.reason = ""
+}
+
+// IsDegraded checks whether the agent is in degraded state and returns the
+// reason for it.
+func (h *Health) IsDegraded() (bool, string) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.degraded, h.reason
+}
+
+// HandleStartupError handles an error that occurred during startup according
+// to the configured StartupPolicy. With FailFast the error is returned back.
+// With Degraded the error is logged, the agent is put in degraded state and nil
+// is returned, so the startup may continue.
+func (h *Health) HandleStartupError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if h.policy != Degraded {
+		return err
+	}
+	log.Println("Startup error, running in degraded mode: ", err.Error())
+	h.SetDegraded(err.Error())
+	return nil
+}
+
+// Guard is a Handler that rejects all requests with 503 (Service Unavailable)
+// while the agent is in degraded state. It applies to the ports that are bound
+// while the agent is degraded for another reason.
+func (h *Health) Guard(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		if degraded, reason := h.IsDegraded(); degraded {
+			setErrorResponse(resp, 503, fmt.Sprintf("service degraded: %s", reason))
+			return nil
+		}
+		return middleware(ctx, req, resp)
+	}
+}
+
+// ServeHTTP writes the health state of the agent as JSON. Responds with 200 if
+// the agent is healthy, or with 503 if the agent is in degraded state.
+func (h *Health) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	status := healthStatus{
+		Status: "ok",
+	}
+	statusCode := 200
+	if degraded, reason := h.IsDegraded(); degraded {
+		status.Status = "degraded"
+		status.Reason = reason
+		statusCode = 503
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Println("Health: Failed to serialize health status: ", err.Error())
+		rw.WriteHeader(500)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(data)
+}
+
+// Serve serves the health endpoint on "/health" on its own listener, bound to
+// the given host and port, so the health can be checked while the ports of the
+// agent are not bound. Returns the listener; closing it stops serving.
+func (h *Health) Serve(host string, port int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/health", h)
+	go http.Serve(listener, mux)
+	return listener, nil
+}
+
+// NewHealth creates new Health in healthy state that handles startup errors
+// with the given StartupPolicy.
+func NewHealth(policy StartupPolicy) *Health {
+	return &Health{
+		policy: policy,
+	}
+}
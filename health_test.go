@@ -0,0 +1,180 @@
+package processagent
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bindInUsePort occupies a port, then tries to bind the same port again to
+// produce a genuine bind error.
+func bindInUsePort(t *testing.T) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to occupy a port: ", err.Error())
+	}
+	_, err = net.Listen("tcp", listener.Addr().String())
+	if err == nil {
+		t.Fatal("Expected binding an in-use port to fail.")
+	}
+	return listener, err
+}
+
+func TestParseStartupPolicy(t *testing.T) {
+	if policy, err := ParseStartupPolicy("degraded"); err != nil || policy != Degraded {
+		t.Fatal("Expected to parse the degraded policy, but got: ", policy, err)
+	}
+	if _, err := ParseStartupPolicy("unknown"); err == nil {
+		t.Fatal("Expected an error for an unknown policy.")
+	}
+}
+
+func TestHealthStartupErrorFailFast(t *testing.T) {
+	listener, bindErr := bindInUsePort(t)
+	defer listener.Close()
+
+	health := NewHealth(FailFast)
+	if err := health.HandleStartupError(bindErr); err != bindErr {
+		t.Fatal("Expected the bind error to be returned, but got: ", err)
+	}
+	if degraded, _ := health.IsDegraded(); degraded {
+		t.Fatal("Expected the agent not to be in degraded state under fail-fast policy.")
+	}
+}
+
+// getHealth gets the health endpoint served on the listener and returns the
+// status code and the body.
+func getHealth(t *testing.T, listener net.Listener) (int, string) {
+	httpResp, err := http.Get(fmt.Sprintf("http://%s/health", listener.Addr().String()))
+	if err != nil {
+		t.Fatal("Expected the health endpoint to be served, but got: ", err.Error())
+	}
+	defer httpResp.Body.Close()
+	body, _ := ioutil.ReadAll(httpResp.Body)
+	return httpResp.StatusCode, string(body)
+}
+
+func TestHealthStartupErrorDegraded(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to occupy a port: ", err.Error())
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	health := NewHealth(Degraded)
+	healthListener, err := health.Serve("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer healthListener.Close()
+
+	_, bindErr := NewHTTPEndpoint("127.0.0.1", port, "/degraded")
+	if bindErr == nil {
+		t.Fatal("Expected binding an in-use port to fail.")
+	}
+	if err := health.HandleStartupError(bindErr); err != nil {
+		t.Fatal("Expected the bind error to be handled, but got: ", err.Error())
+	}
+	endpoint, err := NewHTTPEndpointRetry("127.0.0.1", port, "/degraded", time.Duration(10)*time.Millisecond, health.SetHealthy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer endpoint.Close()
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "processed"
+		return nil
+	})
+
+	// the health is served on its own port while the HTTP port is not bound
+	if code, body := getHealth(t, healthListener); code != 503 || !strings.Contains(body, "degraded") {
+		t.Fatal("Expected the health endpoint to report degraded state, but got: ", code, body)
+	}
+
+	// the port is released, the agent binds it and recovers
+	listener.Close()
+	deadline := time.Now().Add(time.Duration(5) * time.Second)
+	for {
+		if code, _ := getHealth(t, healthListener); code == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the agent to recover once the port is free.")
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	httpResp, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/degraded", port), "text/plain", nil)
+	if err != nil {
+		t.Fatal("Expected the port to be bound, but got: ", err.Error())
+	}
+	defer httpResp.Body.Close()
+	body, _ := ioutil.ReadAll(httpResp.Body)
+	if httpResp.StatusCode != 200 || !strings.Contains(string(body), "processed") {
+		t.Fatal("Expected the request to be processed once recovered, but got: ", httpResp.StatusCode, string(body))
+	}
+}
+
+func TestHTTPEndpointRetryClosed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to occupy a port: ", err.Error())
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	bound := make(chan bool, 1)
+	endpoint, err := NewHTTPEndpointRetry("127.0.0.1", port, "/retry-closed", time.Duration(10)*time.Millisecond, func() {
+		bound <- true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := endpoint.Close(); err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	select {
+	case <-bound:
+		t.Fatal("Expected a closed port to stop retrying to bind.")
+	case <-time.After(time.Duration(100) * time.Millisecond):
+	}
+}
+
+func TestHealthHealthy(t *testing.T) {
+	health := NewHealth(FailFast)
+	rec := httptest.NewRecorder()
+	health.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != 200 {
+		t.Fatal("Expected the health endpoint to report 200, but got: ", rec.Code)
+	}
+	if rec.Body.String() != `{"status":"ok"}` {
+		t.Fatal("Unexpected health status: ", rec.Body.String())
+	}
+}
+
+func TestHealthGuard(t *testing.T) {
+	health := NewHealth(Degraded)
+	middleware := health.Guard(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "processed"
+		return nil
+	})
+
+	health.SetDegraded("maintenance")
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+		t.Fatal("Expected the request to be rejected with 503 in degraded state, but got: ", resp.Payload)
+	}
+
+	health.SetHealthy()
+	resp = &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if resp.Error != nil || resp.Payload != "processed" {
+		t.Fatal("Expected the request to be processed once healthy, but got: ", resp.Payload)
+	}
+}
@@ -1,18 +1,117 @@
 package processagent
 
 import (
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // HTTPEndpoint represents an InputPort that handles HTTP requests.
 // Wraps an HTTP server (see http.Server) that handles the HTTP requests.
+// The body of the HTTP request is decoded into the Request with the Decoder. If
+// no Decoder is set, the body is used as the Request Payload.
+// Request bodies compressed with gzip or deflate (see Content-Encoding header)
+// are decompressed first, up to MaxDecompressedSize bytes.
 type HTTPEndpoint struct {
 	InputPort *MiddlewareInputPort
 	Server    http.Server
+	Decoder   RequestDecoder
+	// MaxDecompressedSize is the maximal size of a decompressed request body.
+	// Larger bodies are rejected with 413 (Payload Too Large), as a guard
+	// against decompression bombs. If 0, DefaultMaxDecompressedSize is used.
+	MaxDecompressedSize int64
+	// Timeout is the maximal time to process a request. If exceeded, the
+	// request is responded with 504 (Gateway Timeout) and its context is
+	// canceled. If 0, there is no timeout.
+	Timeout time.Duration
+	// Pool runs the middleware chain of the requests on a bounded number of
+	// goroutines. Requests that do not fit in the pool (its workers and its
+	// queue) are rejected with 503 (Service Unavailable). The Pool may be
+	// shared with other ports and is not closed with the endpoint. If nil,
+	// each request runs on a new goroutine.
+	// The HTTP server still serves each connection on its own goroutine, which
+	// waits for the request to be processed, so limit the connections as well
+	// (see SetMaxConnections, for example to the Capacity of the Pool) to bound
+	// the total number of goroutines.
+	Pool     *WorkerPool
+	listener *limitListener
+	// bound is set once the server listens, closed once the port is closed,
+	// and closing is closed on Close. Guarded by lock.
+	bound   bool
+	closed  bool
+	closing chan struct{}
+	lock    sync.Mutex
+}
+
+// connectionsRefused is the HTTP response written to the connections over the
+// maximal number of connections.
+const connectionsRefused = "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 20\r\n\r\ntoo many connections"
+
+// SetMaxConnections limits the number of simultaneously open connections to
+// the HTTP server. Connections over the limit are refused with 503 (Service
+// Unavailable). Set 0 for no limit.
+func (h *HTTPEndpoint) SetMaxConnections(max int) {
+	h.listener.setMax(max)
+}
+
+// DefaultMaxDecompressedSize is the default maximal size of a decompressed
+// request body (64 MiB).
+const DefaultMaxDecompressedSize int64 = 64 << 20
+
+// errBodyTooLarge is returned when the decompressed request body exceeds the
+// maximal size.
+var errBodyTooLarge = fmt.Errorf("decompressed request body too large")
+
+// readBody reads the HTTP request body, decompressing it according to the
+// Content-Encoding header. On failure, returns the HTTP status code to respond
+// with.
+func (h *HTTPEndpoint) readBody(req *http.Request) ([]byte, int, error) {
+	var body io.Reader
+	switch encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		data, err := ioutil.ReadAll(req.Body)
+		return data, 400, err
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, 400, err
+		}
+		defer reader.Close()
+		body = reader
+	case "deflate":
+		reader, err := zlib.NewReader(req.Body)
+		if err != nil {
+			return nil, 400, err
+		}
+		defer reader.Close()
+		body = reader
+	default:
+		return nil, 415, fmt.Errorf("unsupported content encoding: %s", encoding)
+	}
+
+	maxSize := h.MaxDecompressedSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxDecompressedSize
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, 400, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, 413, errBodyTooLarge
+	}
+	return data, 200, nil
 }
 
 // AddMiddleware adds a Middleware to the http input port.
@@ -22,65 +121,302 @@ func (h *HTTPEndpoint) AddMiddleware(middleware Middleware) {
 
 // Close shuts down the underlying HTTP server and closes this input port.
 func (h *HTTPEndpoint) Close() error {
-	return h.Server.Shutdown(context.Background())
+	h.lock.Lock()
+	bound := h.bound
+	if !h.closed && h.closing != nil {
+		close(h.closing)
+	}
+	h.closed = true
+	h.lock.Unlock()
+	if !bound {
+		// stops retrying to listen, see NewHTTPEndpointRetry
+		return nil
+	}
+	err := h.Server.Shutdown(context.Background())
+	// the server may not have started serving on the listener yet, so make
+	// sure it is released
+	h.listener.Close()
+	return err
 }
 
 // handleHTTPRequest is an http.Handler and handles a single HTTP request.
 // This function maps the incoming HTTP requests, creates the Request and Response
 // structures for the middleware chain, then executes the registered middlewares.
+// The HTTP request headers are passed in the Request Metadata (by their
+// canonical names) and the Response Metadata is written as HTTP response
+// headers, except the timing metrics which are written in the Server-Timing
+// header and the file name which is written in the Content-Disposition header.
+// If the Timeout is exceeded, 504 is responded right away and the Response of
+// the middleware chain, produced later, is discarded.
+// If the Pool is set, the middleware chain runs on the Pool, otherwise on a new
+// goroutine.
 func (h *HTTPEndpoint) handleHTTPRequest(rw http.ResponseWriter, req *http.Request) {
-	payloadData, err := ioutil.ReadAll(req.Body)
+	payloadData, code, err := h.readBody(req)
 	if err != nil {
 		log.Println("HTTP Port: Failed to read request body: ", err.Error())
+		rw.WriteHeader(code)
+		rw.Write([]byte(err.Error()))
 		return
 	}
 
 	requestWrapper := &Request{
-		Port:    "http",
-		Payload: string(payloadData),
+		Port:     "http",
+		Metadata: map[string]string{},
+	}
+	for name := range req.Header {
+		requestWrapper.Metadata[name] = req.Header.Get(name)
 	}
+	requestWrapper.Metadata[MetadataMethod] = req.Method
+	requestWrapper.Metadata[MetadataPath] = req.URL.Path
+	requestWrapper.Metadata[MetadataQuery] = req.URL.RawQuery
 
-	ctx := context.Background()
+	decoder := h.Decoder
+	if decoder == nil {
+		decoder = RawDecoder
+	}
+	if err = decoder(payloadData, requestWrapper); err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
 
-	resp := &Response{
-		Port: "http",
+	// canceled when the client disconnects
+	ctx := req.Context()
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
 	}
 
-	if err = h.InputPort.ExecuteMiddlewares(ctx, requestWrapper, resp); err != nil {
-		log.Println("HTTP Port: Failed to process request: ", err.Error())
+	guard := &responseGuard{rw: rw}
+	done := make(chan struct{})
+	process := func() {
+		defer close(done)
+		if ctx.Err() != nil {
+			// timed out while waiting in the queue of the pool
+			guard.respond(func(rw http.ResponseWriter) {
+				rw.WriteHeader(504)
+				rw.Write([]byte("request timed out"))
+			})
+			return
+		}
+		resp := &Response{
+			Port: "http",
+		}
+		if err := h.InputPort.ExecuteMiddlewares(ctx, requestWrapper, resp); err != nil {
+			log.Println("HTTP Port: Failed to process request: ", err.Error())
+			guard.respond(func(rw http.ResponseWriter) {
+				rw.WriteHeader(500)
+				rw.Write([]byte("internal error"))
+			})
+			return
+		}
+		if !guard.respond(func(rw http.ResponseWriter) {
+			writeResponse(rw, resp)
+		}) {
+			log.Println("HTTP Port: Response discarded, the request has already timed out.")
+		}
+	}
+	if h.Pool == nil {
+		go process()
+	} else if !h.Pool.Submit(process) {
+		rw.WriteHeader(503)
+		rw.Write([]byte("server busy"))
 		return
 	}
 
-	statusCode := 200
-	if resp.Error != nil && *resp.Error {
-		statusCode = 500
-		if resp.ErrorCode != nil {
-			statusCode = *resp.ErrorCode
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// the timeout expired, or the client has gone away - then the
+		// response is not read anyway
+		guard.respond(func(rw http.ResponseWriter) {
+			rw.WriteHeader(504)
+			rw.Write([]byte("request timed out"))
+		})
+	}
+}
+
+// responseGuard makes sure exactly one response is written for an HTTP request,
+// when the response may be written either by the middleware chain or on
+// timeout, whichever comes first.
+type responseGuard struct {
+	rw      http.ResponseWriter
+	written bool
+	lock    sync.Mutex
+}
+
+// respond writes the response with the given function, unless a response has
+// already been written. Returns false if the response was not written.
+// The lock is held while writing, so the HTTP handler cannot return while the
+// response is still being written by another goroutine.
+func (g *responseGuard) respond(write func(rw http.ResponseWriter)) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.written {
+		return false
+	}
+	g.written = true
+	write(g.rw)
+	return true
+}
+
+// writeResponse writes the Response as an HTTP response.
+func writeResponse(rw http.ResponseWriter, resp *Response) {
+	statusCode := httpStatus(resp)
+
+	for name, value := range resp.Metadata {
+		if name != MetadataStatus && name != MetadataFilename && !strings.HasPrefix(name, MetadataTimingPrefix) {
+			rw.Header().Set(name, value)
 		}
 	}
+	if filename := resp.Metadata[MetadataFilename]; filename != "" {
+		rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": filename,
+		}))
+	}
+	if timing := formatServerTiming(resp.Metadata); timing != "" {
+		rw.Header().Set(ServerTimingHeader, timing)
+	}
 
 	rw.WriteHeader(statusCode)
-	rw.Write([]byte(resp.Payload))
+	if statusCode == 304 || statusCode == 204 {
+		// no body is allowed, like when the payload has been serialized
+		return
+	}
+	if _, err := rw.Write([]byte(resp.Payload)); err != nil {
+		// the client has most likely disconnected (broken pipe or connection
+		// reset), the connection is cleaned up by the server
+		log.Println("HTTP Port: Failed to write response: ", err.Error())
+	}
+}
+
+// httpStatus maps the Response to the HTTP status code: the error code for
+// failed responses, otherwise the status from the Response Metadata or 200.
+// The error codes are HTTP status codes by convention; codes that are not valid
+// HTTP error statuses (400-599) are mapped to 500, and invalid success statuses
+// are mapped to 200.
+func httpStatus(resp *Response) int {
+	if resp.Error != nil && *resp.Error {
+		if resp.ErrorCode != nil && *resp.ErrorCode >= 400 && *resp.ErrorCode <= 599 {
+			return *resp.ErrorCode
+		}
+		return 500
+	}
+	if code, err := strconv.Atoi(resp.Metadata[MetadataStatus]); err == nil && code >= 100 && code <= 599 {
+		return code
+	}
+	return 200
+}
+
+// validateHost checks that the host is a valid address to listen on: an IP
+// address or a host name that resolves. An empty host means all interfaces.
+func validateHost(host string) error {
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return fmt.Errorf("invalid host %q: %s", host, err.Error())
+	}
+	return nil
 }
 
 // NewHTTPEndpoint creates new HTTP InputPort starting an HTTP Server that
 // listens on the given host and port. The port only handles requests comming on
 // the given path pattern. To handle all requests provide "/" as a pattern.
-func NewHTTPEndpoint(host string, port int, pattern string) *HTTPEndpoint {
-	endpoint := &HTTPEndpoint{
+// If host is empty, the server listens on all interfaces.
+// If the host is not valid or the server cannot listen on the given host and
+// port (for example, the port is already in use), an error is returned.
+func NewHTTPEndpoint(host string, port int, pattern string) (*HTTPEndpoint, error) {
+	endpoint, err := newHTTPEndpoint(host, port)
+	if err != nil {
+		return nil, err
+	}
+	if err := endpoint.listen(); err != nil {
+		return nil, err
+	}
+	http.HandleFunc(pattern, endpoint.handleHTTPRequest)
+	return endpoint, nil
+}
+
+// NewHTTPEndpointRetry creates new HTTP InputPort like NewHTTPEndpoint, but if
+// the server cannot listen on the given host and port, it keeps retrying in the
+// background every interval, until it succeeds or the port is closed. Once the
+// server listens, bound is called. Use it to recover from a port that is only
+// temporarily in use.
+// If the host is not valid, an error is returned.
+func NewHTTPEndpointRetry(host string, port int, pattern string, interval time.Duration, bound func()) (*HTTPEndpoint, error) {
+	endpoint, err := newHTTPEndpoint(host, port)
+	if err != nil {
+		return nil, err
+	}
+	http.HandleFunc(pattern, endpoint.handleHTTPRequest)
+
+	go func() {
+		for {
+			err := endpoint.listen()
+			if err == nil {
+				bound()
+				return
+			}
+			if err == errEndpointClosed {
+				return
+			}
+			log.Println("Http Server: Failed to listen, retrying: ", err.Error())
+			select {
+			case <-time.After(interval):
+			case <-endpoint.closing:
+				return
+			}
+		}
+	}()
+
+	return endpoint, nil
+}
+
+// errEndpointClosed is returned when listening on a closed HTTPEndpoint.
+var errEndpointClosed = fmt.Errorf("HTTP port closed")
+
+// newHTTPEndpoint creates new HTTPEndpoint for the given host and port, that
+// does not listen yet.
+func newHTTPEndpoint(host string, port int) (*HTTPEndpoint, error) {
+	if err := validateHost(host); err != nil {
+		return nil, err
+	}
+	return &HTTPEndpoint{
 		Server: http.Server{
-			Addr: fmt.Sprintf("%s:%d", host, port),
+			Addr: net.JoinHostPort(host, strconv.Itoa(port)),
 		},
 		InputPort: NewMiddlewarePort(),
-	}
+		listener: &limitListener{
+			goodbye:     []byte(connectionsRefused),
+			clientFirst: true,
+		},
+		closing: make(chan struct{}),
+	}, nil
+}
 
-	http.HandleFunc(pattern, endpoint.handleHTTPRequest)
+// listen binds the host and port of the endpoint and starts serving the HTTP
+// requests.
+func (h *HTTPEndpoint) listen() error {
+	listener, err := net.Listen("tcp", h.Server.Addr)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		listener.Close()
+		return errEndpointClosed
+	}
+	h.listener.Listener = listener
+	h.bound = true
+	h.lock.Unlock()
 
 	go func() {
-		if err := endpoint.Server.ListenAndServe(); err != nil {
+		if err := h.Server.Serve(h.listener); err != nil && err != http.ErrServerClosed {
 			log.Println("Http Server: ", err.Error())
 		}
 	}()
-
-	return endpoint
+	return nil
 }
@@ -1,16 +1,27 @@
 package processagent
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestNewHTTPEndpoint(t *testing.T) {
-	httpEndpoint := NewHTTPEndpoint("", 10113, "/")
+	httpEndpoint, err := NewHTTPEndpoint("", 10113, "/")
+	if err != nil {
+		t.Fatal("Failed to create HTTP Port: ", err.Error())
+	}
 
 	if httpEndpoint == nil {
 		t.Fatal("Expected valid pointer to an HTTP Input Port")
@@ -24,7 +35,11 @@ func TestNewHTTPEndpoint(t *testing.T) {
 func TestHttpEndpointMiddleware(t *testing.T) {
 	middlewareCalled := false
 	done := make(chan bool)
-	httpEndpoint := NewHTTPEndpoint("", 10113, "/a")
+	httpEndpoint, err := NewHTTPEndpoint("", 10113, "/a")
+	if err != nil {
+		t.Fatal("Failed to create HTTP Port: ", err.Error())
+	}
+	defer httpEndpoint.Close()
 	httpEndpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
 		middlewareCalled = true
 		if req == nil {
@@ -62,3 +77,533 @@ func TestHttpEndpointMiddleware(t *testing.T) {
 	}
 
 }
+
+func TestNewHTTPEndpointPortInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to occupy a port: ", err.Error())
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	httpEndpoint, err := NewHTTPEndpoint("127.0.0.1", port, "/in-use")
+	if err == nil {
+		httpEndpoint.Close()
+		t.Fatal("Expected an error when binding a port that is already in use.")
+	}
+	if httpEndpoint != nil {
+		t.Fatal("Expected no HTTP Port to be created.")
+	}
+}
+
+func TestHTTPEndpointResponseMetadata(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+	}
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		if req.Metadata[MetadataMethod] != "PUT" || req.Metadata[MetadataPath] != "/path" || req.Metadata["X-Test"] != "test" {
+			t.Fatal("Expected the request metadata to be populated, but got: ", req.Metadata)
+		}
+		resp.SetMetadata(MetadataStatus, "202")
+		resp.SetMetadata("X-Custom", "value")
+		resp.Payload = "accepted"
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/path?a=b", strings.NewReader(""))
+	req.Header.Set("x-test", "test")
+	endpoint.handleHTTPRequest(rec, req)
+
+	if rec.Code != 202 {
+		t.Fatal("Expected the status from the response metadata, but got: ", rec.Code)
+	}
+	if rec.Header().Get("X-Custom") != "value" {
+		t.Fatal("Expected the response metadata to be written as headers.")
+	}
+	if rec.Header().Get(MetadataStatus) != "" {
+		t.Fatal("Expected the status not to be written as a header.")
+	}
+}
+
+func TestHTTPEndpointDecoder(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+		Decoder:   JSONEnvelopeDecoder,
+	}
+	var received *Request
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		received = req
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader(`{"id": "client-id", "metadata": {"tenant": "t1"}, "payload": "data"}`)))
+	if received == nil || received.ID != "client-id" || received.Metadata["tenant"] != "t1" || received.Payload != "data" {
+		t.Fatal("Expected the request to be decoded from the JSON envelope, but got: ", received)
+	}
+
+	rec = httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader(`not json`)))
+	if rec.Code != 400 {
+		t.Fatal("Expected 400 for a request that cannot be decoded, but got: ", rec.Code)
+	}
+}
+
+func TestNewHTTPEndpointHost(t *testing.T) {
+	httpEndpoint, err := NewHTTPEndpoint("127.0.0.1", 0, "/bind-host")
+	if err != nil {
+		t.Fatal("Failed to create HTTP Port: ", err.Error())
+	}
+	defer httpEndpoint.Close()
+
+	addr := httpEndpoint.listener.Addr().(*net.TCPAddr)
+	if !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatal("Expected to listen on 127.0.0.1 only, but listening on: ", addr.String())
+	}
+
+	if _, err := NewHTTPEndpoint("not a host", 0, "/invalid-host"); err == nil {
+		t.Fatal("Expected an error for an invalid host.")
+	}
+}
+
+func TestHTTPEndpointServerTiming(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+	}
+	endpoint.AddMiddleware(ServerTiming("total")(ServerTiming("process")(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "ok"
+		return nil
+	})))
+
+	rec := httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader("")))
+
+	header := rec.Header().Get(ServerTimingHeader)
+	if !strings.HasPrefix(header, "process;dur=") || !strings.Contains(header, ", total;dur=") {
+		t.Fatal("Expected the process and total metrics in the Server-Timing header, but got: ", header)
+	}
+	if rec.Header().Get(MetadataTimingPrefix+"process") != "" {
+		t.Fatal("Expected the timing metadata not to be written as headers.")
+	}
+}
+
+func TestHTTPEndpointClientDisconnects(t *testing.T) {
+	httpEndpoint, err := NewHTTPEndpoint("127.0.0.1", 0, "/disconnect")
+	if err != nil {
+		t.Fatal("Failed to create HTTP Port: ", err.Error())
+	}
+	defer httpEndpoint.Close()
+	httpEndpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		time.Sleep(time.Duration(100) * time.Millisecond)
+		resp.Payload = strings.Repeat("x", 1024*1024)
+		return nil
+	})
+	addr := httpEndpoint.listener.Addr().String()
+
+	// the client disconnects before reading the response
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("POST /disconnect HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\ntest"))
+	conn.Close()
+	time.Sleep(time.Duration(300) * time.Millisecond)
+
+	resp, err := http.Post("http://"+addr+"/disconnect", "text/plain", strings.NewReader("test"))
+	if err != nil {
+		t.Fatal("Expected the server to stay healthy, but got: ", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("Expected the server to stay healthy, but got status: ", resp.StatusCode)
+	}
+}
+
+func TestHTTPEndpointCompressedBody(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+	}
+	var received string
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		received = req.Payload
+		return nil
+	})
+
+	gzipped := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write([]byte("compressed payload"))
+	gzipWriter.Close()
+
+	deflated := &bytes.Buffer{}
+	zlibWriter := zlib.NewWriter(deflated)
+	zlibWriter.Write([]byte("deflated payload"))
+	zlibWriter.Close()
+
+	tests := []struct {
+		encoding string
+		body     []byte
+		payload  string
+	}{
+		{"gzip", gzipped.Bytes(), "compressed payload"},
+		{"deflate", deflated.Bytes(), "deflated payload"},
+		{"", []byte("plain payload"), "plain payload"},
+	}
+	for _, test := range tests {
+		received = ""
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(test.body))
+		req.Header.Set("Content-Encoding", test.encoding)
+		endpoint.handleHTTPRequest(rec, req)
+		if rec.Code != 200 || received != test.payload {
+			t.Fatalf("Expected the %q encoded payload to be decoded, but got %d: %q", test.encoding, rec.Code, received)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader("data"))
+	req.Header.Set("Content-Encoding", "br")
+	endpoint.handleHTTPRequest(rec, req)
+	if rec.Code != 415 {
+		t.Fatal("Expected 415 for unsupported encoding, but got: ", rec.Code)
+	}
+}
+
+func TestHTTPEndpointDecompressionLimit(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort:           NewMiddlewarePort(),
+		MaxDecompressedSize: 1024,
+	}
+	called := false
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	})
+
+	gzipped := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write(bytes.Repeat([]byte("0"), 1024*1024))
+	gzipWriter.Close()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", gzipped)
+	req.Header.Set("Content-Encoding", "gzip")
+	endpoint.handleHTTPRequest(rec, req)
+	if rec.Code != 413 || called {
+		t.Fatal("Expected the decompression bomb to be rejected with 413, but got: ", rec.Code)
+	}
+}
+
+func TestHTTPEndpointMaxConnections(t *testing.T) {
+	httpEndpoint, err := NewHTTPEndpoint("127.0.0.1", 0, "/max-connections")
+	if err != nil {
+		t.Fatal("Failed to create HTTP Port: ", err.Error())
+	}
+	defer httpEndpoint.Close()
+	httpEndpoint.SetMaxConnections(1)
+	addr := httpEndpoint.listener.Addr().String()
+
+	open, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	time.Sleep(time.Duration(100) * time.Millisecond)
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Post("http://"+addr+"/max-connections", "text/plain", strings.NewReader("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 503 {
+		t.Fatal("Expected the excess connection to be refused with 503, but got: ", resp.StatusCode)
+	}
+}
+
+func TestHTTPEndpointFileDownload(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+	}
+	pa := NewProcessAgent("/bin/sh -c \"printf \\\"Content-Type: application/pdf\\nFilename: quarterly report.pdf\\n\\n%%PDF\\001\\377\\\"\"", 0)
+	endpoint.AddMiddleware(CGIOutput(pa.GetMiddleware()))
+
+	rec := httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("GET", "/", strings.NewReader("")))
+
+	if rec.Code != 200 {
+		t.Fatal("Expected the file to be returned, but got: ", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "application/pdf" {
+		t.Fatal("Expected the content type of the file, but got: ", rec.Header().Get("Content-Type"))
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); disposition != "attachment; filename=\"quarterly report.pdf\"" {
+		t.Fatal("Expected the file name in the content disposition, but got: ", disposition)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), []byte("%PDF\x01\xff")) {
+		t.Fatalf("Expected the binary body, but got: %q", rec.Body.Bytes())
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	code := func(code int) *int {
+		return &code
+	}
+	failed := true
+	tests := []struct {
+		resp   *Response
+		status int
+	}{
+		{&Response{}, 200},
+		{&Response{Metadata: map[string]string{MetadataStatus: "202"}}, 202},
+		{&Response{Metadata: map[string]string{MetadataStatus: "1000"}}, 200},
+		{&Response{Error: &failed}, 500},
+		{&Response{Error: &failed, ErrorCode: code(429)}, 429},
+		{&Response{Error: &failed, ErrorCode: code(504)}, 504},
+		{&Response{Error: &failed, ErrorCode: code(0)}, 500},
+		{&Response{Error: &failed, ErrorCode: code(200)}, 500},
+		{&Response{Error: &failed, ErrorCode: code(1000)}, 500},
+		{&Response{Error: &failed, ErrorCode: code(404), Metadata: map[string]string{MetadataStatus: "202"}}, 404},
+	}
+	for _, test := range tests {
+		if status := httpStatus(test.resp); status != test.status {
+			t.Fatalf("Expected status %d, but got %d for %+v.", test.status, status, test.resp)
+		}
+	}
+}
+
+func TestHTTPEndpointMiddlewareError(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+	}
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		return fmt.Errorf("chain failed")
+	})
+
+	rec := httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader("")))
+
+	if rec.Code != 500 {
+		t.Fatal("Expected 500 when the middleware chain fails, but got: ", rec.Code)
+	}
+}
+
+// guardedRecorder records the writes made to the response and fails on writes
+// made after the handler has returned.
+type guardedRecorder struct {
+	*httptest.ResponseRecorder
+	t           *testing.T
+	lock        sync.Mutex
+	returned    bool
+	writeHeader int
+}
+
+func (g *guardedRecorder) WriteHeader(code int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.returned {
+		g.t.Error("Write of the status after the handler returned.")
+	}
+	g.writeHeader++
+	g.ResponseRecorder.WriteHeader(code)
+}
+
+func (g *guardedRecorder) Write(data []byte) (int, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.returned {
+		g.t.Error("Write of the body after the handler returned.")
+	}
+	return g.ResponseRecorder.Write(data)
+}
+
+func TestHTTPEndpointTimeoutWritesOnce(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+		Timeout:   time.Duration(5) * time.Millisecond,
+	}
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		// completes around the timeout, racing with it
+		time.Sleep(time.Duration(4500+len(req.Payload)*10) * time.Microsecond)
+		resp.Payload = "processed"
+		return nil
+	})
+
+	recorders := []*guardedRecorder{}
+	for i := 0; i < 100; i++ {
+		rec := &guardedRecorder{ResponseRecorder: httptest.NewRecorder(), t: t}
+		endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", i))))
+		rec.lock.Lock()
+		rec.returned = true
+		rec.lock.Unlock()
+		recorders = append(recorders, rec)
+	}
+	// give the slow chains time to attempt late writes
+	time.Sleep(time.Duration(50) * time.Millisecond)
+
+	for _, rec := range recorders {
+		rec.lock.Lock()
+		code, body, writes := rec.Code, rec.Body.String(), rec.writeHeader
+		rec.lock.Unlock()
+		if writes != 1 {
+			t.Fatal("Expected exactly one response to be written, but got: ", writes)
+		}
+		if !(code == 200 && body == "processed") && !(code == 504 && body == "request timed out") {
+			t.Fatalf("Expected a clean response, but got %d: %q", code, body)
+		}
+	}
+}
+
+func TestHTTPEndpointTimeout(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+		Timeout:   time.Duration(20) * time.Millisecond,
+	}
+	var deadlineSet bool
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		if req.Payload == "slow" {
+			<-ctx.Done()
+			time.Sleep(time.Duration(20) * time.Millisecond)
+		} else {
+			_, deadlineSet = ctx.Deadline()
+		}
+		resp.Payload = "done"
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader("slow")))
+	if rec.Code != 504 {
+		t.Fatal("Expected the slow request to time out, but got: ", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader("fast")))
+	if rec.Code != 200 || rec.Body.String() != "done" || !deadlineSet {
+		t.Fatal("Expected the fast request to complete, but got: ", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHTTPEndpointNotModified(t *testing.T) {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+	}
+	endpoint.AddMiddleware(JSONResponse(ETag(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "output"
+		return nil
+	})))
+
+	rec := httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("GET", "/", nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 200 || etag == "" {
+		t.Fatal("Expected 200 with an ETag, but got: ", rec.Code, etag)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+	endpoint.handleHTTPRequest(rec, req)
+	if rec.Code != 304 || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+		t.Fatal("Expected 304 without a body, but got: ", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHTTPEndpointPool(t *testing.T) {
+	pool := NewWorkerPool(2, 2)
+	defer pool.Close()
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+		Pool:      pool,
+	}
+	release := make(chan bool)
+	var running, maxRunning int32
+	endpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&running, -1)
+		resp.Payload = "done"
+		return nil
+	})
+
+	codes := make(chan int, 50)
+	send := func() {
+		rec := httptest.NewRecorder()
+		endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader("")))
+		codes <- rec.Code
+	}
+	// occupy the workers first, so exactly 2 more requests fit in the queue
+	go send()
+	go send()
+	for atomic.LoadInt32(&running) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 48; i++ {
+		go send()
+	}
+	// the requests over the pool capacity are rejected right away
+	rejected := 0
+	for rejected < 46 {
+		if code := <-codes; code != 503 {
+			t.Fatal("Expected the requests over the pool capacity to be rejected with 503, but got: ", code)
+		}
+		rejected++
+	}
+	close(release)
+	for i := 0; i < 4; i++ {
+		if code := <-codes; code != 200 {
+			t.Fatal("Expected the requests in the pool to be processed, but got: ", code)
+		}
+	}
+	if atomic.LoadInt32(&maxRunning) > 2 {
+		t.Fatal("Expected at most 2 requests to be processed at once, but got: ", maxRunning)
+	}
+}
+
+func TestHTTPEndpointPoolLoad(t *testing.T) {
+	pool := NewWorkerPool(2, 2)
+	defer pool.Close()
+	httpEndpoint, err := NewHTTPEndpoint("127.0.0.1", 0, "/pool-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpEndpoint.Close()
+	httpEndpoint.Pool = pool
+	httpEndpoint.SetMaxConnections(pool.Capacity())
+	release := make(chan bool)
+	defer close(release)
+	httpEndpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		<-release
+		return nil
+	})
+	addr := httpEndpoint.listener.Addr().String()
+
+	base := runtime.NumGoroutine()
+	// the clients do not read the responses, so they add no goroutines
+	conns := []net.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		conn.Write([]byte("POST /pool-load HTTP/1.1\r\nHost: test\r\nContent-Length: 0\r\n\r\n"))
+	}
+	time.Sleep(time.Duration(200) * time.Millisecond)
+
+	// a few goroutines per accepted connection, plus the refusals
+	if goroutines := runtime.NumGoroutine() - base; goroutines > 3*pool.Capacity()+maxRefusing+5 {
+		t.Fatal("Expected a bounded number of goroutines under load, but got: ", goroutines)
+	}
+}
@@ -0,0 +1,140 @@
+package processagent
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Intake controls the intake of new requests. The intake can be paused (for
+// example, for maintenance) and resumed at runtime, without affecting the
+// requests that are already being processed.
+// While paused, new requests are rejected with 503 (Service Unavailable) or, if
+// configured to queue, they wait until the intake is resumed.
+// Intake is an http.Handler that serves as an admin endpoint for pausing and
+// resuming the intake.
+type Intake struct {
+	queue   bool
+	paused  bool
+	resumed chan struct{}
+	queued  int
+	lock    sync.Mutex
+	// MaxQueueDepth is the maximal number of the requests queued while the
+	// intake is paused. Requests over the limit are rejected right away with
+	// 503 (Service Unavailable), instead of waiting. If 0, the number of the
+	// queued requests is not limited.
+	MaxQueueDepth int
+}
+
+// intakeStatus is the state of the intake as reported by the admin endpoint.
+type intakeStatus struct {
+	Paused bool `json:"paused"`
+	// Queued is the number of the requests waiting for the intake to resume.
+	Queued int `json:"queued"`
+}
+
+// Pause pauses the intake of new requests.
+func (i *Intake) Pause() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if !i.paused {
+		i.paused = true
+		i.resumed = make(chan struct{})
+	}
+}
+
+// Resume resumes the intake of new requests. The queued requests continue to
+// be processed.
+func (i *Intake) Resume() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.paused {
+		i.paused = false
+		close(i.resumed)
+	}
+}
+
+// IsPaused checks whether the intake is paused.
+func (i *Intake) IsPaused() bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.paused
+}
+
+// QueueDepth returns the number of the requests queued while the intake is
+// paused.
+func (i *Intake) QueueDepth() int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.queued
+}
+
+// Gate is a Handler that rejects or queues the new requests while the intake is
+// paused.
+func (i *Intake) Gate(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		i.lock.Lock()
+		if !i.paused {
+			i.lock.Unlock()
+			return middleware(ctx, req, resp)
+		}
+		if !i.queue {
+			i.lock.Unlock()
+			setErrorResponse(resp, 503, "intake paused")
+			return nil
+		}
+		if i.MaxQueueDepth > 0 && i.queued >= i.MaxQueueDepth {
+			i.lock.Unlock()
+			setErrorResponse(resp, 503, "intake queue full")
+			return nil
+		}
+		i.queued++
+		resumed := i.resumed
+		i.lock.Unlock()
+
+		var err error
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		i.lock.Lock()
+		i.queued--
+		i.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		return middleware(ctx, req, resp)
+	}
+}
+
+// ServeHTTP serves the admin endpoint of the intake. The intake is paused with
+// a POST request with "action=pause" query parameter and resumed with
+// "action=resume". All requests respond with the state of the intake as JSON,
+// including the number of the queued requests.
+func (i *Intake) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		switch req.URL.Query().Get("action") {
+		case "pause":
+			i.Pause()
+		case "resume":
+			i.Resume()
+		default:
+			rw.WriteHeader(400)
+			rw.Write([]byte("unknown action, expected 'pause' or 'resume'"))
+			return
+		}
+	}
+	writeJSON(rw, 200, intakeStatus{
+		Paused: i.IsPaused(),
+		Queued: i.QueueDepth(),
+	})
+}
+
+// NewIntake creates new Intake that accepts requests. If queue is set, the
+// requests are queued while the intake is paused, otherwise they are rejected.
+func NewIntake(queue bool) *Intake {
+	return &Intake{
+		queue: queue,
+	}
+}
@@ -0,0 +1,130 @@
+package processagent
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntakePauseResume(t *testing.T) {
+	intake := NewIntake(false)
+	called := false
+	middleware := intake.Gate(func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	})
+
+	intake.Pause()
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if called {
+		t.Fatal("Expected the request not to be processed while paused.")
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+		t.Fatal("Expected the request to be rejected with 503 while paused.")
+	}
+
+	intake.Resume()
+	resp = &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if !called || resp.Error != nil {
+		t.Fatal("Expected the request to be processed after resuming.")
+	}
+}
+
+func TestIntakeQueue(t *testing.T) {
+	intake := NewIntake(true)
+	processed := make(chan bool, 1)
+	middleware := intake.Gate(func(ctx context.Context, req *Request, resp *Response) error {
+		processed <- true
+		return nil
+	})
+
+	intake.Pause()
+	go middleware(context.Background(), &Request{}, &Response{})
+
+	select {
+	case <-processed:
+		t.Fatal("Expected the request to be queued while paused.")
+	case <-time.After(time.Duration(100) * time.Millisecond):
+	}
+
+	intake.Resume()
+	select {
+	case <-processed:
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("Expected the queued request to be processed after resuming.")
+	}
+}
+
+func TestIntakeServeHTTP(t *testing.T) {
+	intake := NewIntake(false)
+
+	rec := httptest.NewRecorder()
+	intake.ServeHTTP(rec, httptest.NewRequest("POST", "/intake?action=pause", nil))
+	if !intake.IsPaused() || !strings.Contains(rec.Body.String(), `"paused":true`) {
+		t.Fatal("Expected the intake to be paused, but got: ", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	intake.ServeHTTP(rec, httptest.NewRequest("POST", "/intake?action=resume", nil))
+	if intake.IsPaused() || !strings.Contains(rec.Body.String(), `"paused":false`) {
+		t.Fatal("Expected the intake to be resumed, but got: ", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	intake.ServeHTTP(rec, httptest.NewRequest("POST", "/intake?action=stop", nil))
+	if rec.Code != 400 {
+		t.Fatal("Expected 400 for unknown action, but got: ", rec.Code)
+	}
+}
+
+func TestIntakeMaxQueueDepth(t *testing.T) {
+	intake := NewIntake(true)
+	intake.MaxQueueDepth = 2
+	processed := make(chan bool, 2)
+	middleware := intake.Gate(func(ctx context.Context, req *Request, resp *Response) error {
+		processed <- true
+		return nil
+	})
+
+	intake.Pause()
+	go middleware(context.Background(), &Request{}, &Response{})
+	go middleware(context.Background(), &Request{}, &Response{})
+	deadline := time.Now().Add(time.Duration(5) * time.Second)
+	for intake.QueueDepth() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the requests to be queued.")
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 || resp.Payload != "intake queue full" {
+		t.Fatal("Expected the request over the queue depth to be rejected with 503, but got: ", resp.Payload)
+	}
+
+	rec := httptest.NewRecorder()
+	intake.ServeHTTP(rec, httptest.NewRequest("GET", "/intake", nil))
+	if !strings.Contains(rec.Body.String(), `"queued":2`) {
+		t.Fatal("Expected the queue depth to be reported, but got: ", rec.Body.String())
+	}
+
+	intake.Resume()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-processed:
+		case <-time.After(time.Duration(5) * time.Second):
+			t.Fatal("Expected the queued requests to be processed after resuming.")
+		}
+	}
+	for intake.QueueDepth() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the queue to be empty.")
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+}
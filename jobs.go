@@ -0,0 +1,151 @@
+package processagent
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// job holds the state of a single asynchronous job.
+type job struct {
+	done     bool
+	response *Response
+	finished time.Time
+}
+
+// jobStatus is the state of a job as reported by the jobs endpoint.
+type jobStatus struct {
+	ID       string    `json:"id"`
+	Status   string    `json:"status"`
+	Response *Response `json:"response,omitempty"`
+}
+
+// JobStore runs requests asynchronously as jobs and keeps the results of the
+// jobs, so they can be polled later.
+// Results of finished jobs are kept for the configured TTL.
+// JobStore is an http.Handler serving the state of the jobs on <path>/{id}.
+// The job IDs are random and cannot be guessed, so only the client that
+// submitted a job can read its result.
+type JobStore struct {
+	// MaxJobs is the maximal number of jobs kept (pending, or finished and not
+	// expired yet). New jobs over the limit are rejected with 503 (Service
+	// Unavailable). If 0, DefaultMaxJobs is used.
+	MaxJobs int
+	path    string
+	ttl     time.Duration
+	jobs    map[string]*job
+	lock    sync.Mutex
+}
+
+// DefaultMaxJobs is the default maximal number of jobs kept by a JobStore.
+const DefaultMaxJobs = 10000
+
+// jobIDSize is the number of random bytes of a job ID.
+const jobIDSize = 18
+
+// newJobID generates a random job ID, safe to use in a URL path.
+func newJobID() (string, error) {
+	buff := make([]byte, jobIDSize)
+	if _, err := randomRead(buff); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buff), nil
+}
+
+// Async is a Handler that runs the request in the background as a job,
+// instead of waiting for the result. Each job gets a new random ID, which is
+// not related to the Request ID. The Response is marked with status 202
+// (Accepted) and a "Location" of the job state, which can be polled for the
+// result.
+func (s *JobStore) Async(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		id, err := newJobID()
+		if err != nil {
+			setErrorResponse(resp, 500, "failed to create job")
+			return nil
+		}
+		maxJobs := s.MaxJobs
+		if maxJobs <= 0 {
+			maxJobs = DefaultMaxJobs
+		}
+
+		s.lock.Lock()
+		s.evict()
+		if _, exists := s.jobs[id]; exists {
+			s.lock.Unlock()
+			setErrorResponse(resp, 500, "failed to create job")
+			return nil
+		}
+		if len(s.jobs) >= maxJobs {
+			s.lock.Unlock()
+			setErrorResponse(resp, 503, "too many jobs")
+			return nil
+		}
+		s.jobs[id] = &job{}
+		s.lock.Unlock()
+
+		jobReq := *req
+		jobResp := copyResponse(resp)
+		go func() {
+			if err := middleware(context.Background(), &jobReq, jobResp); err != nil {
+				setErrorResponse(jobResp, 500, err.Error())
+			}
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.jobs[id] = &job{
+				done:     true,
+				response: jobResp,
+				finished: time.Now(),
+			}
+		}()
+
+		resp.SetMetadata(MetadataStatus, "202")
+		resp.SetMetadata("Location", s.path+id)
+		return nil
+	}
+}
+
+// evict removes the expired jobs. Must be called with the lock held.
+func (s *JobStore) evict() {
+	now := time.Now()
+	for id, j := range s.jobs {
+		if j.done && now.Sub(j.finished) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// ServeHTTP serves the state of the job with the ID given in the path.
+// Responds with 202 (Accepted) while the job is pending, 200 with the job
+// Response once the job is done and 404 for unknown jobs.
+func (s *JobStore) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, s.path)
+
+	s.lock.Lock()
+	s.evict()
+	j, ok := s.jobs[id]
+	s.lock.Unlock()
+
+	if !ok {
+		writeJSON(rw, 404, jobStatus{ID: id, Status: "not found"})
+		return
+	}
+	if !j.done {
+		writeJSON(rw, 202, jobStatus{ID: id, Status: "pending"})
+		return
+	}
+	writeJSON(rw, 200, jobStatus{ID: id, Status: "done", Response: j.response})
+}
+
+// NewJobStore creates new JobStore serving the jobs on the given path (for
+// example "/jobs/") and keeping the results of the finished jobs for ttl.
+func NewJobStore(path string, ttl time.Duration) *JobStore {
+	return &JobStore{
+		path: path,
+		ttl:  ttl,
+		jobs: map[string]*job{},
+	}
+}
@@ -0,0 +1,101 @@
+package processagent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pollJob(t *testing.T, store *JobStore, location string) (int, *jobStatus) {
+	rec := httptest.NewRecorder()
+	store.ServeHTTP(rec, httptest.NewRequest("GET", location, nil))
+	status := &jobStatus{}
+	if err := json.Unmarshal(rec.Body.Bytes(), status); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, status
+}
+
+func TestJobStoreAsync(t *testing.T) {
+	store := NewJobStore("/jobs/", time.Minute)
+	release := make(chan bool)
+	middleware := store.Async(func(ctx context.Context, req *Request, resp *Response) error {
+		<-release
+		resp.Payload = "result of " + req.Payload
+		return nil
+	})
+
+	resp := &Response{}
+	if err := middleware(context.Background(), &Request{
+		ID:      "job-1",
+		Payload: "test",
+	}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Metadata[MetadataStatus] != "202" {
+		t.Fatal("Expected the job to be accepted with 202.")
+	}
+	location := resp.Metadata["Location"]
+	if !strings.HasPrefix(location, "/jobs/") || len(location) != len("/jobs/")+24 {
+		t.Fatal("Expected the location of the job with a random ID, but got: ", location)
+	}
+
+	code, status := pollJob(t, store, location)
+	if code != 202 || status.Status != "pending" {
+		t.Fatal("Expected the job to be pending, but got: ", code, status.Status)
+	}
+
+	release <- true
+	deadline := time.Now().Add(time.Second)
+	for status.Status == "pending" && time.Now().Before(deadline) {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+		code, status = pollJob(t, store, location)
+	}
+	if code != 200 || status.Status != "done" {
+		t.Fatal("Expected the job to be done, but got: ", code, status.Status)
+	}
+	if status.Response == nil || status.Response.Payload != "result of test" {
+		t.Fatal("Expected the result of the job, but got: ", status.Response)
+	}
+}
+
+func TestJobStoreUnknownJob(t *testing.T) {
+	store := NewJobStore("/jobs/", time.Minute)
+	code, _ := pollJob(t, store, "/jobs/unknown")
+	if code != 404 {
+		t.Fatal("Expected 404 for unknown job, but got: ", code)
+	}
+}
+
+func TestJobStoreMaxJobs(t *testing.T) {
+	store := NewJobStore("/jobs/", time.Minute)
+	store.MaxJobs = 2
+	release := make(chan bool)
+	defer close(release)
+	middleware := store.Async(func(ctx context.Context, req *Request, resp *Response) error {
+		<-release
+		return nil
+	})
+
+	locations := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		resp := &Response{}
+		middleware(context.Background(), &Request{ID: "same-id"}, resp)
+		if resp.Error != nil {
+			t.Fatal("Expected the job to be accepted, but got: ", resp.Payload)
+		}
+		locations[resp.Metadata["Location"]] = true
+	}
+	if len(locations) != 2 {
+		t.Fatal("Expected the jobs with the same request ID not to replace each other, but got: ", locations)
+	}
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+		t.Fatal("Expected the job over the limit to be rejected with 503.")
+	}
+}
@@ -0,0 +1,386 @@
+package processagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// jsonDepth calculates the maximal nesting depth of the JSON document without
+// fully parsing it. Scalar values have depth 0, and every nested object or
+// array adds 1 to the depth.
+// The calculation stops as soon as the depth exceeds the limit.
+func jsonDepth(payload string, limit int) (int, error) {
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	depth := 0
+	maxDepth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return maxDepth, nil
+		}
+		if err != nil {
+			return maxDepth, err
+		}
+		if delim, ok := token.(json.Delim); ok {
+			if delim == '{' || delim == '[' {
+				depth++
+				if depth > maxDepth {
+					maxDepth = depth
+				}
+				if maxDepth > limit {
+					return maxDepth, nil
+				}
+			} else {
+				depth--
+			}
+		}
+	}
+}
+
+// MaxJSONDepth is a Handler that rejects requests with JSON payloads nested
+// deeper than maxDepth levels with error code 400 (Bad Request), before the
+// request is processed.
+func MaxJSONDepth(maxDepth int) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			depth, _ := jsonDepth(req.Payload, maxDepth)
+			if depth > maxDepth {
+				setErrorResponse(resp, 400, fmt.Sprintf("JSON payload nested too deep: maximal depth is %d", maxDepth))
+				return nil
+			}
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// parseJSONObject parses the payload as a JSON object. The numbers are kept as
+// json.Number, so the values not changed by the handlers are encoded back
+// exactly as they were, even integers too large for a float64.
+func parseJSONObject(payload string) (map[string]interface{}, error) {
+	object := map[string]interface{}{}
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after JSON object")
+	}
+	if object == nil {
+		return nil, fmt.Errorf("expected JSON object")
+	}
+	return object, nil
+}
+
+// AllowFields is a Handler that removes all top-level fields of the JSON
+// payload that are not in the allowed list, before the request is processed.
+// Payloads that are not JSON objects are rejected with error code 400.
+func AllowFields(allowed []string) Handler {
+	allowedSet := map[string]bool{}
+	for _, field := range allowed {
+		allowedSet[field] = true
+	}
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			object, err := parseJSONObject(req.Payload)
+			if err != nil {
+				setErrorResponse(resp, 400, "invalid JSON payload: expected JSON object")
+				return nil
+			}
+			for field := range object {
+				if !allowedSet[field] {
+					delete(object, field)
+				}
+			}
+			data, err := json.Marshal(object)
+			if err != nil {
+				return err
+			}
+			req.Payload = string(data)
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// DenyFields is a Handler that rejects requests with JSON payloads containing
+// any of the denied top-level fields with error code 400, before the request
+// is processed.
+// Payloads that are not JSON objects are rejected with error code 400 as well.
+func DenyFields(denied []string) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			object, err := parseJSONObject(req.Payload)
+			if err != nil {
+				setErrorResponse(resp, 400, "invalid JSON payload: expected JSON object")
+				return nil
+			}
+			for _, field := range denied {
+				if _, ok := object[field]; ok {
+					setErrorResponse(resp, 400, fmt.Sprintf("field not allowed: %s", field))
+					return nil
+				}
+			}
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// applyDefaults sets the default values from the JSON schema (the "default" of
+// each of the "properties") for the fields missing in the object. Nested
+// objects present in the object are filled recursively.
+func applyDefaults(object map[string]interface{}, schema map[string]interface{}) {
+	properties, _ := schema["properties"].(map[string]interface{})
+	for field, property := range properties {
+		propertySchema, ok := property.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		value, present := object[field]
+		if !present {
+			if defaultValue, ok := propertySchema["default"]; ok {
+				object[field] = defaultValue
+			}
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			applyDefaults(nested, propertySchema)
+		}
+	}
+}
+
+// ApplyDefaults is a Handler that fills the missing fields of the JSON payload
+// with the default values from the JSON schema, before the request is
+// processed, so the process always gets a complete document. The defaults are
+// taken from the "default" keyword of the "properties" of the schema, including
+// the properties of nested objects. Fields present in the payload are kept as
+// they are.
+// Payloads that are not JSON objects are passed through unchanged.
+func ApplyDefaults(schema map[string]interface{}) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			object, err := parseJSONObject(req.Payload)
+			if err != nil {
+				return middleware(ctx, req, resp)
+			}
+			applyDefaults(object, schema)
+			data, err := json.Marshal(object)
+			if err != nil {
+				return err
+			}
+			req.Payload = string(data)
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// coerceValue coerces the JSON value to the type declared in its schema (the
+// "type" keyword): strings to numbers, integers and booleans, and numbers and
+// booleans to strings. Objects and arrays are coerced recursively, by their
+// "properties" and "items". Null values and values without a declared type are
+// left as they are. The path is used in the error messages.
+func coerceValue(value interface{}, schema map[string]interface{}, path string) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch schema["type"] {
+	case "number", "integer":
+		number, ok := value.(json.Number)
+		if text, isString := value.(string); isString {
+			text = strings.TrimSpace(text)
+			parsed, err := strconv.ParseFloat(text, 64)
+			if err != nil || math.IsInf(parsed, 0) || math.IsNaN(parsed) {
+				return nil, fmt.Errorf("field %s: cannot convert %q to %s", path, text, schema["type"])
+			}
+			number, ok = json.Number(strconv.FormatFloat(parsed, 'f', -1, 64)), true
+			// integers are kept exact, even if too large for a float64
+			if integer, err := strconv.ParseInt(text, 10, 64); err == nil {
+				number = json.Number(strconv.FormatInt(integer, 10))
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("field %s: expected %s", path, schema["type"])
+		}
+		if _, err := number.Int64(); err != nil && schema["type"] == "integer" {
+			if parsed, _ := number.Float64(); parsed != math.Trunc(parsed) {
+				return nil, fmt.Errorf("field %s: expected integer, got %s", path, number)
+			}
+		}
+		return number, nil
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true":
+				return true, nil
+			case "false":
+				return false, nil
+			}
+			return nil, fmt.Errorf("field %s: cannot convert %q to boolean", path, v)
+		}
+		return nil, fmt.Errorf("field %s: expected boolean", path)
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case json.Number:
+			return v.String(), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+		return nil, fmt.Errorf("field %s: expected string", path)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		for field, property := range properties {
+			propertySchema, ok := property.(map[string]interface{})
+			fieldValue, present := v[field]
+			if !ok || !present {
+				continue
+			}
+			coerced, err := coerceValue(fieldValue, propertySchema, path+"."+field)
+			if err != nil {
+				return nil, err
+			}
+			v[field] = coerced
+		}
+	case []interface{}:
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			break
+		}
+		for i, item := range v {
+			coerced, err := coerceValue(item, items, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = coerced
+		}
+	}
+	return value, nil
+}
+
+// CoerceTypes is a Handler that coerces the fields of the JSON payload to the
+// types declared in the JSON schema, before the request is processed, so the
+// process gets well-typed input even when the clients send numbers as strings
+// or the other way around. Numeric strings are converted to numbers, "true" and
+// "false" to booleans, and numbers and booleans to strings, including the
+// fields of nested objects and the items of arrays. Values that cannot be
+// coerced are rejected with error code 400 (Bad Request).
+// Payloads that are not JSON objects are passed through unchanged.
+func CoerceTypes(schema map[string]interface{}) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			object, err := parseJSONObject(req.Payload)
+			if err != nil {
+				return middleware(ctx, req, resp)
+			}
+			if _, err := coerceValue(object, schema, "$"); err != nil {
+				setErrorResponse(resp, 400, err.Error())
+				return nil
+			}
+			data, err := json.Marshal(object)
+			if err != nil {
+				return err
+			}
+			req.Payload = string(data)
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// repairJSON repairs slightly broken JSON: removes the comments (// line and
+// /* block */ comments) and the trailing commas before closing brackets and
+// braces. Strings are left intact. Returns an error if the result is still not
+// valid JSON.
+func repairJSON(payload string) (string, error) {
+	out := make([]byte, 0, len(payload))
+	inString, escaped := false, false
+	// comma is the position of the last comma following a value, prev is the
+	// last character outside of strings and comments
+	comma := -1
+	var prev byte
+	for i := 0; i < len(payload); i++ {
+		c := payload[i]
+		if inString {
+			out = append(out, c)
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch {
+		case c == '/' && i+1 < len(payload) && payload[i+1] == '/':
+			for i < len(payload) && payload[i] != '\n' {
+				i++
+			}
+			i--
+			continue
+		case c == '/' && i+1 < len(payload) && payload[i+1] == '*':
+			end := strings.Index(payload[i+2:], "*/")
+			if end < 0 {
+				return "", fmt.Errorf("unterminated comment")
+			}
+			i += end + 3
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			out = append(out, c)
+			continue
+		case (c == '}' || c == ']') && comma >= 0:
+			out = append(out[:comma], out[comma+1:]...)
+		}
+		comma = -1
+		if c == ',' && prev != 0 && prev != ',' && prev != '[' && prev != '{' {
+			comma = len(out)
+		}
+		inString = c == '"'
+		prev = c
+		out = append(out, c)
+	}
+	if !json.Valid(out) {
+		return "", fmt.Errorf("invalid JSON")
+	}
+	return string(out), nil
+}
+
+// RepairJSONOutput is a Handler that makes sure the output of the process is
+// strict JSON. Slightly broken JSON (with comments or trailing commas) is
+// repaired, see repairJSON. If strict is set, the output is not repaired and
+// the output is validated with RequireJSONOutput instead. Output that is not
+// valid JSON (after the repair) fails the request with error code 502 (Bad
+// Gateway).
+// Failed responses are not checked.
+func RepairJSONOutput(strict bool) Handler {
+	if strict {
+		return RequireJSONOutput
+	}
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			if err := middleware(ctx, req, resp); err != nil {
+				return err
+			}
+			if resp.Error != nil && *resp.Error {
+				return nil
+			}
+			repaired, err := repairJSON(resp.Payload)
+			if err != nil {
+				setErrorResponse(resp, 502, fmt.Sprintf("invalid JSON output: %s", err.Error()))
+				return nil
+			}
+			resp.Payload = repaired
+			return nil
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package processagent
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONDepth(t *testing.T) {
+	tests := map[string]int{
+		`"scalar"`:                0,
+		`{}`:                      1,
+		`{"a": [1, 2, {"b": 3}]}`: 3,
+		`[[], [[]], []]`:          3,
+	}
+	for payload, expected := range tests {
+		depth, err := jsonDepth(payload, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if depth != expected {
+			t.Fatalf("Expected depth %d for %s, but got %d", expected, payload, depth)
+		}
+	}
+}
+
+func TestMaxJSONDepth(t *testing.T) {
+	called := false
+	middleware := MaxJSONDepth(3)(func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Payload: `{"a": {"b": [1]}}`}, resp)
+	if !called || resp.Error != nil {
+		t.Fatal("Expected a shallow payload to be processed.")
+	}
+
+	called = false
+	resp = &Response{}
+	deep := strings.Repeat("[", 10000) + strings.Repeat("]", 10000)
+	middleware(context.Background(), &Request{Payload: deep}, resp)
+	if called {
+		t.Fatal("Expected a deeply-nested payload not to be processed.")
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 400 {
+		t.Fatal("Expected a deeply-nested payload to be rejected with 400.")
+	}
+}
+
+func TestAllowFields(t *testing.T) {
+	var received string
+	middleware := AllowFields([]string{"name", "age"})(func(ctx context.Context, req *Request, resp *Response) error {
+		received = req.Payload
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Payload: `{"name": "test", "admin": true, "age": 5}`}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected the request to be processed, but got: ", resp.Payload)
+	}
+	if received != `{"age":5,"name":"test"}` {
+		t.Fatal("Expected the disallowed fields to be stripped, but got: ", received)
+	}
+
+	middleware(context.Background(), &Request{Payload: `{"age": 9007199254740993}`}, &Response{})
+	if received != `{"age":9007199254740993}` {
+		t.Fatal("Expected a large integer to be preserved exactly, but got: ", received)
+	}
+
+	resp = &Response{}
+	middleware(context.Background(), &Request{Payload: `[1, 2]`}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 400 {
+		t.Fatal("Expected a non-object payload to be rejected with 400.")
+	}
+}
+
+func TestDenyFields(t *testing.T) {
+	called := false
+	middleware := DenyFields([]string{"admin"})(func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Payload: `{"name": "test"}`}, resp)
+	if !called || resp.Error != nil {
+		t.Fatal("Expected a payload without denied fields to be processed.")
+	}
+
+	called = false
+	resp = &Response{}
+	middleware(context.Background(), &Request{Payload: `{"name": "test", "admin": true}`}, resp)
+	if called {
+		t.Fatal("Expected a payload with denied fields not to be processed.")
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 400 {
+		t.Fatal("Expected a payload with denied fields to be rejected with 400.")
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "default": "anonymous"},
+			"limit": {"type": "integer", "default": 10},
+			"options": {
+				"type": "object",
+				"properties": {
+					"verbose": {"type": "boolean", "default": false}
+				}
+			}
+		}
+	}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	var received string
+	middleware := ApplyDefaults(schema)(func(ctx context.Context, req *Request, resp *Response) error {
+		received = req.Payload
+		return nil
+	})
+
+	middleware(context.Background(), &Request{Payload: `{"name": "test", "options": {}}`}, &Response{})
+	if received != `{"limit":10,"name":"test","options":{"verbose":false}}` {
+		t.Fatal("Expected the defaults to be applied to the missing fields, but got: ", received)
+	}
+
+	middleware(context.Background(), &Request{Payload: `{"limit": 5}`}, &Response{})
+	if received != `{"limit":5,"name":"anonymous"}` {
+		t.Fatal("Expected the present fields to be preserved, but got: ", received)
+	}
+
+	middleware(context.Background(), &Request{Payload: `{"id": 9007199254740993, "limit": 1.50}`}, &Response{})
+	if received != `{"id":9007199254740993,"limit":1.50,"name":"anonymous"}` {
+		t.Fatal("Expected the numbers to be preserved exactly, but got: ", received)
+	}
+
+	middleware(context.Background(), &Request{Payload: `not json`}, &Response{})
+	if received != `not json` {
+		t.Fatal("Expected a non-JSON payload to pass through, but got: ", received)
+	}
+}
+
+func TestCoerceTypes(t *testing.T) {
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(`{
+		"type": "object",
+		"properties": {
+			"count": {"type": "integer"},
+			"ratio": {"type": "number"},
+			"enabled": {"type": "boolean"},
+			"code": {"type": "string"},
+			"tags": {"type": "array", "items": {"type": "number"}},
+			"options": {
+				"type": "object",
+				"properties": {
+					"verbose": {"type": "boolean"}
+				}
+			}
+		}
+	}`), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	var received string
+	middleware := CoerceTypes(schema)(func(ctx context.Context, req *Request, resp *Response) error {
+		received = req.Payload
+		return nil
+	})
+
+	middleware(context.Background(), &Request{Payload: `{"count": "42", "ratio": " 0.5", "enabled": "true", "code": 7, "tags": ["1", 2], "options": {"verbose": "FALSE"}, "other": "1"}`}, &Response{})
+	if received != `{"code":"7","count":42,"enabled":true,"options":{"verbose":false},"other":"1","ratio":0.5,"tags":[1,2]}` {
+		t.Fatal("Expected the fields to be coerced, but got: ", received)
+	}
+
+	invalid := map[string]string{
+		`{"count": "forty-two"}`:  "field $.count: cannot convert \"forty-two\" to integer",
+		`{"count": "4.2"}`:        "field $.count: expected integer, got 4.2",
+		`{"ratio": true}`:         "field $.ratio: expected number",
+		`{"enabled": "yes"}`:      "field $.enabled: cannot convert \"yes\" to boolean",
+		`{"tags": [1, "x"]}`:      "field $.tags[1]: cannot convert \"x\" to number",
+		`{"code": {"nested": 1}}`: "field $.code: expected string",
+	}
+	for payload, message := range invalid {
+		received = ""
+		resp := &Response{}
+		middleware(context.Background(), &Request{Payload: payload}, resp)
+		if resp.Error == nil || *resp.ErrorCode != 400 || resp.Payload != message {
+			t.Fatalf("Expected %s to be rejected with %q, but got: %s", payload, message, resp.Payload)
+		}
+		if received != "" {
+			t.Fatal("Expected the rejected request not to be processed.")
+		}
+	}
+
+	middleware(context.Background(), &Request{Payload: `{"count": null}`}, &Response{})
+	if received != `{"count":null}` {
+		t.Fatal("Expected null to be left as is, but got: ", received)
+	}
+
+	middleware(context.Background(), &Request{Payload: `{"count": 9007199254740993, "code": 9007199254740993, "other": 9007199254740993}`}, &Response{})
+	if received != `{"code":"9007199254740993","count":9007199254740993,"other":9007199254740993}` {
+		t.Fatal("Expected large integers to be preserved exactly, but got: ", received)
+	}
+
+	middleware(context.Background(), &Request{Payload: `{"count": "9007199254740993"}`}, &Response{})
+	if received != `{"count":9007199254740993}` {
+		t.Fatal("Expected a large integer string to be converted exactly, but got: ", received)
+	}
+}
+
+func TestRepairJSON(t *testing.T) {
+	tests := map[string]string{
+		`{"a": 1, "b": [1, 2,],}`:                       `{"a": 1, "b": [1, 2]}`,
+		"{\"a\": 1, // comment\n\"b\": 2}":              "{\"a\": 1, \n\"b\": 2}",
+		`{"a": /* inline, */ 1}`:                        `{"a":  1}`,
+		`{"url": "http://example.com/*x*/", "c": ",}"}`: `{"url": "http://example.com/*x*/", "c": ",}"}`,
+		`{"escaped": "quote \" // not a comment",}`:     `{"escaped": "quote \" // not a comment"}`,
+		"[1, 2, \n]": "[1, 2 \n]",
+		`"plain"`:    `"plain"`,
+	}
+	for broken, expected := range tests {
+		repaired, err := repairJSON(broken)
+		if err != nil {
+			t.Fatalf("Expected %q to be repaired, but got error: %s", broken, err)
+		}
+		if repaired != expected {
+			t.Fatalf("Expected %q to be repaired to %q, but got %q.", broken, expected, repaired)
+		}
+	}
+
+	for _, invalid := range []string{`{"a": }`, `{"a": 1 /* unterminated`, `not json`, `[,]`} {
+		if _, err := repairJSON(invalid); err == nil {
+			t.Fatalf("Expected an error for %q.", invalid)
+		}
+	}
+}
+
+func TestRepairJSONOutput(t *testing.T) {
+	output := ""
+	process := func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = output
+		return nil
+	}
+
+	output = "{\n  // the result\n  \"items\": [1, 2, 3,],\n}"
+	resp := &Response{}
+	RepairJSONOutput(false)(process)(context.Background(), &Request{}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected the output to be repaired, but got: ", resp.Payload)
+	}
+	if !json.Valid([]byte(resp.Payload)) {
+		t.Fatal("Expected strict JSON, but got: ", resp.Payload)
+	}
+
+	resp = &Response{}
+	RepairJSONOutput(true)(process)(context.Background(), &Request{}, resp)
+	if resp.Error == nil || *resp.ErrorCode != 502 {
+		t.Fatal("Expected the broken output to fail in strict mode, but got: ", resp.Payload)
+	}
+	required := &Response{}
+	RequireJSONOutput(process)(context.Background(), &Request{}, required)
+	if resp.Payload != required.Payload {
+		t.Fatal("Expected the strict mode to fail like RequireJSONOutput, but got: ", resp.Payload)
+	}
+
+	output = `{"valid": true}`
+	resp = &Response{}
+	RepairJSONOutput(true)(process)(context.Background(), &Request{}, resp)
+	if resp.Error != nil || resp.Payload != output {
+		t.Fatal("Expected valid output to pass, but got: ", resp.Payload)
+	}
+
+	output = "not json"
+	resp = &Response{}
+	RepairJSONOutput(false)(process)(context.Background(), &Request{}, resp)
+	if resp.Error == nil || *resp.ErrorCode != 502 {
+		t.Fatal("Expected unrepairable output to fail, but got: ", resp.Payload)
+	}
+}
@@ -0,0 +1,41 @@
+package processagent
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// runLifecycleCommand runs a start or stop command of the agent (the stage) to
+// completion. The output of the command is logged. Returns an error, including
+// the output, if the command fails.
+func runLifecycleCommand(stage, command string) error {
+	args, err := validateCommand(command, nil)
+	if err != nil {
+		return fmt.Errorf("%s command failed: %s", stage, err.Error())
+	}
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if len(output) > 0 {
+		log.Printf("ProcessAgent: Output of the %s command: %s\n", stage, strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		return fmt.Errorf("%s command failed: %s", stage, err.Error())
+	}
+	return nil
+}
+
+// Start runs the OnStartCommand, if set. Call it once on startup, before the
+// agent processes any request. If the command fails, the error is returned and
+// the agent rejects all requests with error code 503 (Service Unavailable), so
+// the processes never run in an environment that is not set up.
+func (p *LocalProcessAgent) Start() error {
+	if p.OnStartCommand == "" {
+		return nil
+	}
+	err := runLifecycleCommand("start", p.OnStartCommand)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.startErr = err
+	return err
+}
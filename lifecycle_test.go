@@ -0,0 +1,55 @@
+package processagent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessAgentLifecycleCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "trace")
+
+	pa := NewProcessAgentArgs([]string{"/bin/sh", "-c", "echo run >> " + trace}, 0)
+	pa.OnStartCommand = "/bin/sh -c \"echo start >> " + trace + "\""
+	pa.OnStopCommand = "/bin/sh -c \"echo stop >> " + trace + "\""
+
+	if err := pa.Start(); err != nil {
+		t.Fatal(err)
+	}
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected the request to be processed, but got: ", resp.Payload)
+	}
+	pa.Stop()
+
+	data, err := ioutil.ReadFile(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "start\nrun\nstop\n" {
+		t.Fatalf("Expected the commands to run in order, but got: %q", data)
+	}
+}
+
+func TestProcessAgentFailingStartCommand(t *testing.T) {
+	pa := NewProcessAgent("echo hello", 0)
+	pa.OnStartCommand = "/bin/sh -c \"echo cannot mount; exit 1\""
+
+	err := pa.Start()
+	if err == nil || err.Error() != "start command failed: exit status 1" {
+		t.Fatal("Expected the start command to fail, but got: ", err)
+	}
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+		t.Fatal("Expected the requests to be rejected with 503, but got: ", resp.Payload)
+	}
+}
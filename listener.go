@@ -0,0 +1,110 @@
+package processagent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limitListener is a net.Listener that limits the number of simultaneously open
+// connections. Connections over the limit are refused: the goodbye message is
+// written to them and they are closed immediately. While maxRefusing
+// connections are being refused, further connections are closed without the
+// goodbye message.
+type limitListener struct {
+	net.Listener
+	// max is the maximal number of open connections. If 0, there is no limit.
+	max     int32
+	active  int32
+	goodbye []byte
+	// refusing is the number of connections being refused.
+	refusing int32
+	// clientFirst makes the goodbye message to be written only after the
+	// client has sent some data, for protocols in which the client speaks
+	// first (like HTTP).
+	clientFirst bool
+}
+
+// goodbyeTimeout is the maximal time spent writing the goodbye message to a
+// refused connection.
+const goodbyeTimeout = time.Second
+
+// maxRefusing is the maximal number of connections refused with the goodbye
+// message at the same time. Over it, the refused connections are closed right
+// away, so a flood of connections cannot start an unbounded number of
+// goroutines.
+const maxRefusing = 16
+
+// maxDrainSize is the maximal size of the data drained from a refused
+// connection.
+const maxDrainSize = 64 * 1024
+
+// setMax sets the maximal number of open connections.
+func (l *limitListener) setMax(max int) {
+	atomic.StoreInt32(&l.max, int32(max))
+}
+
+// Accept waits for and returns the next connection within the limit.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		active := atomic.AddInt32(&l.active, 1)
+		if max := atomic.LoadInt32(&l.max); max > 0 && active > max {
+			atomic.AddInt32(&l.active, -1)
+			if atomic.AddInt32(&l.refusing, 1) > maxRefusing {
+				atomic.AddInt32(&l.refusing, -1)
+				conn.Close()
+				continue
+			}
+			go l.refuse(conn)
+			continue
+		}
+		return &limitConn{Conn: conn, listener: l}, nil
+	}
+}
+
+// refuse writes the goodbye message to the connection and closes it.
+// Closing a connection with unread data resets it, so the client may not get
+// the goodbye message. To avoid that, the data sent by the client is drained
+// (for a limited time) before the connection is closed.
+func (l *limitListener) refuse(conn net.Conn) {
+	defer atomic.AddInt32(&l.refusing, -1)
+	defer conn.Close()
+	if len(l.goodbye) == 0 {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(goodbyeTimeout))
+	if l.clientFirst {
+		if _, err := conn.Read(make([]byte, 4096)); err != nil {
+			return
+		}
+	}
+	if _, err := conn.Write(l.goodbye); err != nil {
+		return
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(conn, maxDrainSize))
+}
+
+// limitConn is a connection accepted by limitListener. Closing it releases its
+// place within the limit.
+type limitConn struct {
+	net.Conn
+	listener  *limitListener
+	closeOnce sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt32(&c.listener.active, -1)
+	})
+	return c.Conn.Close()
+}
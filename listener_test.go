@@ -0,0 +1,122 @@
+package processagent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &limitListener{
+		Listener: inner,
+		goodbye:  []byte("goodbye"),
+	}
+	listener.setMax(2)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	servers := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		servers = append(servers, <-accepted)
+	}
+
+	// the third connection is over the limit
+	refused, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(time.Duration(5) * time.Second))
+	data, err := ioutil.ReadAll(refused)
+	if err != nil || string(data) != "goodbye" {
+		t.Fatal("Expected the excess connection to be refused with a goodbye message, but got: ", string(data), err)
+	}
+
+	// closing an accepted connection makes room for a new one
+	servers[0].Close()
+	servers[0].Close()
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("Expected the connection to be accepted after another one was closed.")
+	}
+	servers[1].Close()
+}
+
+func TestLimitListenerRefusalFlood(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &limitListener{
+		Listener:    inner,
+		goodbye:     []byte("goodbye"),
+		clientFirst: true,
+	}
+	listener.setMax(1)
+	defer listener.Close()
+
+	go func() {
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	base := runtime.NumGoroutine()
+	// the clients never speak, so each refusal waits for the goodbye timeout
+	clients := []net.Conn{}
+	for i := 0; i < 100; i++ {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	time.Sleep(time.Duration(100) * time.Millisecond)
+
+	if goroutines := runtime.NumGoroutine() - base; goroutines > maxRefusing+5 {
+		t.Fatal("Expected the refusals to run on a bounded number of goroutines, but got: ", goroutines)
+	}
+	closed := 0
+	for _, client := range clients[1:] {
+		client.SetReadDeadline(time.Now().Add(time.Duration(50) * time.Millisecond))
+		_, err := client.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); err == io.EOF || (ok && !netErr.Timeout()) {
+			closed++
+		}
+	}
+	if closed < 100-1-maxRefusing {
+		t.Fatal("Expected the connections over the refusal limit to be closed right away, but got closed: ", closed)
+	}
+}
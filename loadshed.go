@@ -0,0 +1,132 @@
+package processagent
+
+import (
+	"context"
+	mathrand "math/rand"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// LoadProbe checks whether the host is under pressure. Returns true if the load
+// is too high to accept new requests.
+// Probes are evaluated for every request, so they should be cheap.
+type LoadProbe func() bool
+
+// GoroutineProbe creates a LoadProbe that reports high load when the number of
+// goroutines exceeds maxGoroutines.
+func GoroutineProbe(maxGoroutines int) LoadProbe {
+	return func() bool {
+		return runtime.NumGoroutine() > maxGoroutines
+	}
+}
+
+// MemoryProbe creates a LoadProbe that reports high load when the allocated
+// heap memory exceeds maxBytes.
+// Reading the memory statistics is expensive, so the statistics are read at
+// most once per interval and the result is reused in between.
+func MemoryProbe(maxBytes uint64, interval time.Duration) LoadProbe {
+	var lock sync.Mutex
+	var lastRead time.Time
+	var overloaded bool
+	return func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		if time.Since(lastRead) >= interval {
+			stats := runtime.MemStats{}
+			runtime.ReadMemStats(&stats)
+			overloaded = stats.HeapAlloc > maxBytes
+			lastRead = time.Now()
+		}
+		return overloaded
+	}
+}
+
+// LoadShed is a Handler that rejects new requests with error code 503 (Service
+// Unavailable) while any of the probes reports high load.
+func LoadShed(probes ...LoadProbe) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			for _, probe := range probes {
+				if probe() {
+					setErrorResponse(resp, 503, "server overloaded")
+					return nil
+				}
+			}
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// OverloadSignal measures how overloaded the host is, as a level from 0 (not
+// overloaded) to 1 (fully overloaded). Values outside of this range are
+// clamped.
+// Signals are evaluated for every request, so they should be cheap.
+type OverloadSignal func() float64
+
+// GoroutineSignal creates an OverloadSignal based on the number of goroutines,
+// which grows with the number of requests in flight. The level rises linearly
+// from 0 at low goroutines to 1 at high goroutines.
+func GoroutineSignal(low, high int) OverloadSignal {
+	return func() float64 {
+		if high <= low {
+			if runtime.NumGoroutine() >= high {
+				return 1
+			}
+			return 0
+		}
+		return float64(runtime.NumGoroutine()-low) / float64(high-low)
+	}
+}
+
+// shedRandom returns a pseudo-random number in [0, 1) to decide whether to
+// drop a request.
+var shedRandom = mathrand.Float64
+
+// AdaptiveShed is a Handler that sheds a growing fraction of the requests as
+// the host gets overloaded, instead of rejecting all requests at a threshold.
+// Each request is dropped with probability equal to the overload level reported
+// by the signal: none are dropped when not overloaded, half of them at level
+// 0.5 and all of them when fully overloaded. Dropped requests are rejected with
+// error code 503 (Service Unavailable).
+func AdaptiveShed(signal OverloadSignal) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			if level := signal(); level > 0 && shedRandom() < level {
+				setErrorResponse(resp, 503, "server overloaded")
+				return nil
+			}
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// MemoryBudget is a Handler that limits the approximate memory used by the
+// requests in flight to budget bytes. The size of the Request payload is
+// reserved from the budget when the request is admitted and released once it
+// has been processed. Requests that would exceed the budget are rejected with
+// error code 503 (Service Unavailable).
+func MemoryBudget(budget int64) Handler {
+	var lock sync.Mutex
+	var reserved int64
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			size := int64(len(req.Payload))
+			lock.Lock()
+			if reserved+size > budget {
+				lock.Unlock()
+				setErrorResponse(resp, 503, "memory budget exceeded")
+				return nil
+			}
+			reserved += size
+			lock.Unlock()
+
+			defer func() {
+				lock.Lock()
+				reserved -= size
+				lock.Unlock()
+			}()
+			return middleware(ctx, req, resp)
+		}
+	}
+}
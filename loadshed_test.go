@@ -0,0 +1,160 @@
+package processagent
+
+import (
+	"context"
+	mathrand "math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadShed(t *testing.T) {
+	overloaded := false
+	called := false
+	middleware := LoadShed(func() bool {
+		return overloaded
+	})(func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if !called || resp.Error != nil {
+		t.Fatal("Expected the request to be processed under normal load.")
+	}
+
+	overloaded = true
+	called = false
+	resp = &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if called {
+		t.Fatal("Expected the request not to be processed under high load.")
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+		t.Fatal("Expected the request to be rejected with 503 under high load.")
+	}
+}
+
+func TestGoroutineProbe(t *testing.T) {
+	if GoroutineProbe(1000000)() {
+		t.Fatal("Expected no high load with a high goroutine limit.")
+	}
+	if !GoroutineProbe(0)() {
+		t.Fatal("Expected high load with a goroutine limit of 0.")
+	}
+}
+
+func TestMemoryProbe(t *testing.T) {
+	if MemoryProbe(1<<62, time.Second)() {
+		t.Fatal("Expected no high load with a high memory limit.")
+	}
+	probe := MemoryProbe(1, time.Minute)
+	if !probe() || !probe() {
+		t.Fatal("Expected high load with a memory limit of 1 byte.")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	release := make(chan bool)
+	admitted := make(chan bool)
+	middleware := MemoryBudget(1000)(func(ctx context.Context, req *Request, resp *Response) error {
+		admitted <- true
+		<-release
+		return nil
+	})
+
+	payload := strings.Repeat("x", 400)
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			middleware(context.Background(), &Request{Payload: payload}, &Response{})
+			done <- true
+		}()
+		<-admitted
+	}
+
+	// 800 bytes in flight, another 400 bytes would exceed the budget
+	resp := &Response{}
+	middleware(context.Background(), &Request{Payload: payload}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+		t.Fatal("Expected the request over the budget to be rejected with 503.")
+	}
+
+	// a smaller request still fits in the budget
+	go func() {
+		middleware(context.Background(), &Request{Payload: "small"}, &Response{})
+		done <- true
+	}()
+	<-admitted
+	release <- true
+	<-done
+
+	for i := 0; i < 2; i++ {
+		release <- true
+		<-done
+	}
+
+	// the budget is released once the requests complete
+	go func() {
+		<-admitted
+		release <- true
+	}()
+	resp = &Response{}
+	middleware(context.Background(), &Request{Payload: payload}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected the request to be admitted once the budget was released.")
+	}
+}
+
+func TestAdaptiveShed(t *testing.T) {
+	// evenly distributed "random" numbers, so the drop rate is exact
+	var sample int
+	shedRandom = func() float64 {
+		sample++
+		return float64(sample%100) / 100
+	}
+	defer func() {
+		shedRandom = mathrand.Float64
+	}()
+
+	level := 0.0
+	middleware := AdaptiveShed(func() float64 {
+		return level
+	})(func(ctx context.Context, req *Request, resp *Response) error {
+		return nil
+	})
+
+	dropped := func() int {
+		count := 0
+		for i := 0; i < 100; i++ {
+			resp := &Response{}
+			middleware(context.Background(), &Request{}, resp)
+			if resp.ErrorCode != nil && *resp.ErrorCode == 503 {
+				count++
+			}
+		}
+		return count
+	}
+
+	previous := -1
+	for _, level = range []float64{0, 0.25, 0.5, 0.75, 1} {
+		count := dropped()
+		if count != int(level*100) {
+			t.Fatalf("Expected %d%% of the requests to be dropped at level %.2f, but got %d%%.", int(level*100), level, count)
+		}
+		if count <= previous {
+			t.Fatal("Expected the drop rate to increase with the overload level.")
+		}
+		previous = count
+	}
+}
+
+func TestGoroutineSignal(t *testing.T) {
+	if level := GoroutineSignal(1000000, 2000000)(); level > 0 {
+		t.Fatal("Expected no overload with high goroutine limits, but got: ", level)
+	}
+	if level := GoroutineSignal(0, 1)(); level < 1 {
+		t.Fatal("Expected full overload with low goroutine limits, but got: ", level)
+	}
+}
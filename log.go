@@ -0,0 +1,74 @@
+package processagent
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DedupLogger is a logger that coalesces identical consecutive messages.
+// When the same message is logged multiple times in a row within the configured
+// window, only the first one is written out. The repeated ones are counted and
+// reported as a single line ("repeated N times") on the next logged message
+// (a different one, or the same one after the window has expired) or when the
+// logger is flushed. The count is not reported when the window expires alone,
+// so call Flush before exiting.
+type DedupLogger struct {
+	logger *log.Logger
+	window time.Duration
+	last   string
+	since  time.Time
+	count  int
+	lock   sync.Mutex
+}
+
+// Println logs the message, unless it is the same as the previous one and the
+// window has not expired yet.
+func (d *DedupLogger) Println(v ...interface{}) {
+	msg := fmt.Sprintln(v...)
+	now := time.Now()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if msg == d.last && now.Sub(d.since) < d.window {
+		d.count++
+		return
+	}
+	d.flush()
+	d.logger.Print(msg)
+	d.last = msg
+	d.since = now
+}
+
+// Flush writes out the count of the repeated messages, if any.
+func (d *DedupLogger) Flush() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.flush()
+}
+
+func (d *DedupLogger) flush() {
+	if d.count > 0 {
+		d.logger.Printf("Last message repeated %d times.\n", d.count)
+	}
+	d.count = 0
+	d.last = ""
+}
+
+// NewDedupLogger creates new DedupLogger that writes to the given log.Logger and
+// coalesces identical consecutive messages within the given window.
+func NewDedupLogger(logger *log.Logger, window time.Duration) *DedupLogger {
+	return &DedupLogger{
+		logger: logger,
+		window: window,
+	}
+}
+
+// defaultLogger creates the default logger used by the process agent. It writes
+// to STDERR and coalesces repeated messages within 10 seconds.
+func defaultLogger() *DedupLogger {
+	return NewDedupLogger(log.New(os.Stderr, "", log.LstdFlags), 10*time.Second)
+}
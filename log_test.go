@@ -0,0 +1,61 @@
+package processagent
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupLoggerCoalesce(t *testing.T) {
+	buff := &bytes.Buffer{}
+	logger := NewDedupLogger(log.New(buff, "", 0), time.Minute)
+
+	for i := 0; i < 5; i++ {
+		logger.Println("Failed:", "same error")
+	}
+	logger.Println("Failed:", "other error")
+	logger.Flush()
+
+	expected := "Failed: same error\nLast message repeated 4 times.\nFailed: other error\n"
+	if buff.String() != expected {
+		t.Fatalf("Expected coalesced log output %q, but got %q", expected, buff.String())
+	}
+}
+
+func TestDedupLoggerWindowExpires(t *testing.T) {
+	buff := &bytes.Buffer{}
+	logger := NewDedupLogger(log.New(buff, "", 0), time.Duration(50)*time.Millisecond)
+
+	logger.Println("same error")
+	logger.Println("same error")
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	logger.Println("same error")
+
+	expected := "same error\nLast message repeated 1 times.\nsame error\n"
+	if buff.String() != expected {
+		t.Fatalf("Expected log output %q, but got %q", expected, buff.String())
+	}
+}
+
+func TestProcessAgentCoalescesErrorLogs(t *testing.T) {
+	buff := &bytes.Buffer{}
+	pa := NewProcessAgent("/bin/sh -c \"echo failure >&2\"", 0)
+	pa.StderrAsError = true
+	pa.logger = NewDedupLogger(log.New(buff, "", 0), time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if err := pa.ProcessCommand(&Request{}, &Response{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pa.Stop()
+
+	if strings.Count(buff.String(), "Failed to process command") != 1 {
+		t.Fatal("Expected the error to be logged only once, but got: ", buff.String())
+	}
+	if !strings.Contains(buff.String(), "Last message repeated 2 times.") {
+		t.Fatal("Expected the repeated messages to be counted, but got: ", buff.String())
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"strings"
 	"syscall"
+	"time"
 
 	pa "github.com/natemago/processagent"
 )
@@ -29,32 +35,238 @@ func (p *configuredPorts) Close() {
 	}
 }
 
+// namedHandler is a pa.Handler with a name, used for debugging.
+type namedHandler struct {
+	name    string
+	handler pa.Handler
+}
+
 func main() {
 	if err := pa.RunCLI(func(cfg *pa.Config) error {
-		ports := &configuredPorts{}
+		policy, err := pa.ParseStartupPolicy(*cfg.StartupPolicy)
+		if err != nil {
+			return err
+		}
+		drainMode, err := pa.ParseDrainMode(*cfg.DrainMode)
+		if err != nil {
+			return err
+		}
+		decoder, err := pa.ParseRequestDecoder(*cfg.RequestFormat)
+		if err != nil {
+			return err
+		}
+		var commandArgs []string
+		if *cfg.CommandArgs != "" {
+			if commandArgs, err = pa.ParseCommandArgs(*cfg.CommandArgs); err != nil {
+				return err
+			}
+		}
+		idPattern, err := regexp.Compile(*cfg.RequestIDPattern)
+		if err != nil {
+			return err
+		}
+		invalidIDPolicy, err := pa.ParseInvalidIDPolicy(*cfg.InvalidRequestID)
+		if err != nil {
+			return err
+		}
+		if *cfg.JSONOutput != "" && *cfg.JSONOutput != "repair" && *cfg.JSONOutput != "strict" {
+			return fmt.Errorf("unknown JSON output validation: %s", *cfg.JSONOutput)
+		}
+		stdinDelivery, err := pa.ParseStdinDelivery(*cfg.StdinDelivery)
+		if err != nil {
+			return err
+		}
+		newline := ""
+		if *cfg.NormalizeNewlines != "" {
+			if newline, err = pa.ParseNewlineStyle(*cfg.NormalizeNewlines); err != nil {
+				return err
+			}
+		}
+		health := pa.NewHealth(policy)
+		http.Handle("/health", health)
+		if *cfg.HealthPort > 0 {
+			// bound first, as it reports the startup errors of the other ports
+			if _, err = health.Serve(*cfg.Host, *cfg.HealthPort); err != nil {
+				return err
+			}
+		}
+		http.Handle("/config", pa.AdminAuth(*cfg.AdminToken, pa.ConfigHandler(cfg)))
+		intake := pa.NewIntake(*cfg.IntakeQueue)
+		intake.MaxQueueDepth = *cfg.IntakeQueueDepth
+		http.Handle("/intake", pa.AdminAuth(*cfg.AdminToken, intake))
 
-		// configure ports
-		ports.AddPort(pa.NewHTTPEndpoint("", *cfg.Port, "/"))
+		ports := &configuredPorts{}
+		var pool *pa.WorkerPool
+		if *cfg.PoolSize > 0 {
+			pool = pa.NewWorkerPool(*cfg.PoolSize, *cfg.PoolQueue)
+		}
 
 		// run process agent
 		processAgent := pa.NewProcessAgent(*cfg.Command, *cfg.MaxWorkers)
+		if commandArgs != nil {
+			processAgent = pa.NewProcessAgentArgs(commandArgs, *cfg.MaxWorkers)
+		}
+		if err = processAgent.Validate(); err != nil {
+			return err
+		}
+		if *cfg.RunAsUser != "" || *cfg.RunAsGroup != "" {
+			if err = processAgent.RunAs(*cfg.RunAsUser, *cfg.RunAsGroup); err != nil {
+				return err
+			}
+		}
+		http.Handle("/command", pa.AdminAuth(*cfg.AdminToken, pa.CommandHandler(processAgent)))
+		processAgent.InputFD = *cfg.InputFD
+		processAgent.OutputFD = *cfg.OutputFD
+		processAgent.FramedOutput = *cfg.FramedOutput
+		processAgent.MaxErrorLength = *cfg.MaxErrorLength
+		processAgent.Stdin = pa.StdinOptions{
+			TrimSpace:     *cfg.StdinTrimSpace,
+			EnsureNewline: *cfg.StdinNewline,
+			Delivery:      stdinDelivery,
+			ChunkSize:     *cfg.StdinChunkSize,
+			Interval:      *cfg.StdinInterval,
+		}
+		processAgent.Nice = *cfg.Nice
+		processAgent.MaxSpawnsPerSecond = *cfg.MaxSpawnsPerSecond
+		processAgent.PTY = *cfg.PTY
+		processAgent.MaxOutputSize = *cfg.MaxOutputSize
+		processAgent.Timeout = *cfg.ProcessTimeout
+		processAgent.OnStartCommand = *cfg.OnStartCommand
+		processAgent.OnStopCommand = *cfg.OnStopCommand
+		processAgent.StderrAsError = *cfg.StderrAsError
+		processAgent.ReportUsage = *cfg.ReportUsage
+		processAgent.MaxCPUShare = *cfg.MaxCPUShare
+		if *cfg.ExecutableAllowlist != "" {
+			processAgent.ExecutableAllowlist = strings.Split(*cfg.ExecutableAllowlist, ",")
+		}
+		if err = processAgent.Start(); err != nil {
+			return err
+		}
 
 		// configure middlewares
 		worker := processAgent.GetMiddleware()
 
-		for _, handler := range []pa.Handler{pa.ResponseTimestamp, pa.JSONResponse, pa.RequestID(9), pa.RequestTimestamp} {
-			worker = handler(worker)
+		var idLookup pa.IDLookup
+		if *cfg.RequestIDHeader != "" {
+			idLookup = pa.MetadataIDLookup(http.CanonicalHeaderKey(*cfg.RequestIDHeader))
+		}
+
+		serializer := pa.Handler(pa.JSONResponse)
+		if *cfg.JSONIndent != "" || *cfg.JSONNoHTMLEscape {
+			serializer = pa.JSONResponseWithOptions(pa.JSONOptions{
+				Indent:            *cfg.JSONIndent,
+				DisableHTMLEscape: *cfg.JSONNoHTMLEscape,
+			})
+		}
+		if *cfg.Negotiate {
+			serializer = pa.Negotiate
+		}
+
+		handlers := []namedHandler{}
+		if *cfg.CGIOutput {
+			handlers = append(handlers, namedHandler{"cgi-output", pa.CGIOutput})
+		}
+		if *cfg.JSONOutput != "" {
+			handlers = append(handlers, namedHandler{"json-output", pa.RepairJSONOutput(*cfg.JSONOutput == "strict")})
+		}
+		if *cfg.ETag {
+			handlers = append(handlers, namedHandler{"etag", pa.ETag})
+		}
+		handlers = append(handlers, []namedHandler{
+			{"response-timestamp", pa.ResponseTimestamp},
+			{"json-response", serializer},
+			{"request-id", pa.ValidatedRequestID(9, idLookup, pa.RequestIDPattern(idPattern, *cfg.RequestIDMaxLength), invalidIDPolicy)},
+			{"request-timestamp", pa.RequestTimestamp},
+		}...)
+		if *cfg.NormalizeNewlines != "" {
+			handlers = append([]namedHandler{{"normalize-newlines", pa.NormalizeNewlines(newline)}}, handlers...)
+		}
+		if *cfg.RequestDeadline > 0 {
+			handlers = append(handlers, namedHandler{"deadline", pa.Deadline(*cfg.RequestDeadline)})
+		}
+		if *cfg.MemoryBudget > 0 {
+			handlers = append(handlers, namedHandler{"memory-budget", pa.MemoryBudget(*cfg.MemoryBudget)})
+		}
+		if *cfg.Async {
+			jobs := pa.NewJobStore("/jobs/", *cfg.JobTTL)
+			jobs.MaxJobs = *cfg.MaxJobs
+			http.Handle("/jobs/", jobs)
+			handlers = append([]namedHandler{{"async", jobs.Async}}, handlers...)
+		}
+
+		handlers = append(handlers, namedHandler{"intake", intake.Gate})
+		if *cfg.TailSize > 0 {
+			tail := pa.NewRequestTail(*cfg.TailSize)
+			http.Handle("/tail", pa.AdminAuth(*cfg.AdminToken, tail))
+			handlers = append(handlers, namedHandler{"tail", tail.Handler})
+		}
+		if *cfg.ServerTiming {
+			worker = pa.ServerTiming("process")(worker)
+			handlers = append(handlers, namedHandler{"server-timing", pa.ServerTiming("total")})
+		}
+		if *cfg.Debug {
+			worker = pa.TraceMiddleware("process", worker)
+		}
+		for _, handler := range handlers {
+			if *cfg.Debug {
+				handler.handler = pa.Traced(handler.name, handler.handler)
+			}
+			worker = handler.handler(worker)
+		}
+		if *cfg.Debug {
+			worker = pa.BreadcrumbTrail(worker)
 		}
 
+		// configure ports, once the agent has started and the middleware chain
+		// is complete, so no request is served before that
+		httpEndpoint, err := pa.NewHTTPEndpoint(*cfg.Host, *cfg.Port, "/")
+		if err != nil {
+			if err = health.HandleStartupError(err); err != nil {
+				return err
+			}
+			// degraded until the port can be bound, which is retried in the
+			// background
+			httpEndpoint, err = pa.NewHTTPEndpointRetry(*cfg.Host, *cfg.Port, "/", time.Second, health.SetHealthy)
+			if err != nil {
+				return err
+			}
+		}
+		httpEndpoint.Decoder = decoder
+		maxConnections := *cfg.MaxConnections
+		if pool != nil && maxConnections == 0 {
+			// each connection is served on its own goroutine, so the
+			// connections are bounded by the pool as well
+			maxConnections = pool.Capacity()
+		}
+		httpEndpoint.SetMaxConnections(maxConnections)
+		httpEndpoint.Timeout = *cfg.HTTPTimeout
+		httpEndpoint.Pool = pool
+		ports.AddPort(httpEndpoint)
 		ports.AddMiddleware(worker)
 
 		done := make(chan bool)
 		c := make(chan os.Signal)
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		uptimeLimit := pa.UptimeLimit(*cfg.MaxUptime)
 		go func() {
-			<-c
-			processAgent.Stop()
-			ports.Close()
+			select {
+			case <-c:
+			case <-uptimeLimit:
+			}
+			// the ports stop accepting requests first, and wait for the
+			// requests in flight while the agent drains the processes
+			portsClosed := make(chan bool)
+			go func() {
+				ports.Close()
+				close(portsClosed)
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), *cfg.DrainTimeout)
+			processAgent.Shutdown(ctx, drainMode)
+			cancel()
+			<-portsClosed
+			if pool != nil {
+				pool.Close()
+			}
 			done <- true
 		}()
 		<-done
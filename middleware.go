@@ -1,11 +1,19 @@
 package processagent
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"log"
+	mathrand "math/rand"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +28,27 @@ type Request struct {
 	// Timestamp is the Unix timestamp (in milliseconds) when the request was
 	// received.
 	Timestamp int64 `json:"timestamp"`
+	// Metadata holds additional port specific information about the request,
+	// like the HTTP method or path.
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
+// Metadata keys of Request and Response.
+const (
+	// MetadataMethod is the request method (for example the HTTP method).
+	MetadataMethod = "method"
+	// MetadataPath is the request path (for example the HTTP URL path).
+	MetadataPath = "path"
+	// MetadataQuery is the raw (encoded) query of the request.
+	MetadataQuery = "query"
+	// MetadataStatus is the status code of a successful response, if other
+	// than the default (for example 202 instead of 200 for HTTP).
+	MetadataStatus = "status"
+	// MetadataFilename is the file name of a response that is a downloadable
+	// file. The HTTP endpoint sends it in the Content-Disposition header.
+	MetadataFilename = "filename"
+)
+
 // Response represents a response to a particular Request.
 type Response struct {
 	// ID is the response ID. It matches the Request ID.
@@ -39,6 +66,21 @@ type Response struct {
 	// ErrorCode is the code of the error. Used in hinting the actual error code
 	// for the specific port. Present only if Error is set to true.
 	ErrorCode *int `json:"errorCode,omitempty"`
+	// ExitCode is the exit code of the process, if the process has exited.
+	ExitCode *int `json:"exitCode,omitempty"`
+	// Stderr is the output of the process on STDERR, if any.
+	Stderr string `json:"stderr,omitempty"`
+	// Metadata holds additional information about the response, that the port
+	// may pass on to the client, for example as HTTP headers.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// SetMetadata sets a Metadata value on the Response.
+func (r *Response) SetMetadata(key, value string) {
+	if r.Metadata == nil {
+		r.Metadata = map[string]string{}
+	}
+	r.Metadata[key] = value
 }
 
 // Middleware is a function called for every Request received on a particular
@@ -64,27 +106,144 @@ type Handler func(Middleware) Middleware
 
 // GenerateRandomString generates random string in base64 encoding by generating
 // a random bytes of the given byteSize and then encoding the bytes.
+// If the random generator fails, it falls back to a unique timestamp based
+// string (see generateFallbackID).
 func GenerateRandomString(byteSize int) string {
 	buff := make([]byte, byteSize)
-	if _, err := rand.Read(buff); err != nil {
-		log.Fatal("Failed to generate random string: ", err.Error())
+	if _, err := randomRead(buff); err != nil {
+		log.Println("Failed to generate random string, using fallback: ", err.Error())
+		return generateFallbackID()
 	}
 
 	return base64.StdEncoding.EncodeToString(buff)
 }
 
+var randomRead = rand.Read
+
+// fallbackCounter is incremented for every fallback ID generated.
+var fallbackCounter uint64
+
+// generateFallbackID generates a unique ID without relying on the crypto random
+// generator. The ID combines the current timestamp in milliseconds, an atomic
+// counter, which guarantees uniqueness of IDs generated in the same
+// millisecond, and a small pseudo-random suffix.
+func generateFallbackID() string {
+	counter := atomic.AddUint64(&fallbackCounter, 1)
+	return fmt.Sprintf("%x-%x-%04x", CurrentTimeMillis(), counter, mathrand.Intn(0x10000))
+}
+
 // CurrentTimeMillis returns a UNIX timestamp in milliseconds.
 func CurrentTimeMillis() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
 
-// RequestID is a Handler that generates a random ID for the Request.
+// IDLookup looks up an incoming request ID in the Request (for example, from
+// the Request Metadata). Returns an empty string if the Request has no ID.
+type IDLookup func(req *Request) string
+
+// MetadataIDLookup creates an IDLookup that reads the request ID from the
+// Request Metadata under the given key (for example, the name of an HTTP
+// header like "X-Request-Id").
+func MetadataIDLookup(key string) IDLookup {
+	return func(req *Request) string {
+		return req.Metadata[key]
+	}
+}
+
+// RequestID is a Handler that generates a random ID for the Request, unless
+// the Request already has an ID (for example, supplied by the client).
+// The Response gets the same ID. Incoming IDs that do not match the
+// DefaultRequestIDPattern, or are longer than DefaultRequestIDMaxLength, are
+// replaced with a generated ID.
 func RequestID(size int) Handler {
+	return RequestIDFrom(size, nil)
+}
+
+// RequestIDFrom is like RequestID, but honors the incoming request ID found by
+// the lookup, so the IDs are kept consistent across service boundaries. A new
+// ID is generated only if the lookup finds no ID, or the ID is invalid (see
+// RequestID). If lookup is nil, it behaves the same as RequestID.
+func RequestIDFrom(size int, lookup IDLookup) Handler {
+	return ValidatedRequestID(size, lookup, RequestIDPattern(DefaultRequestIDPattern, DefaultRequestIDMaxLength), RegenerateInvalidID)
+}
+
+// IDValidator checks whether an incoming request ID is acceptable. Returns an
+// error describing the problem if it is not.
+type IDValidator func(id string) error
+
+// DefaultRequestIDPattern matches the request IDs that are safe to log: letters,
+// digits and a few punctuation characters (including the characters of the
+// generated IDs).
+var DefaultRequestIDPattern = regexp.MustCompile(`^[A-Za-z0-9+/=._:-]+$`)
+
+// DefaultRequestIDMaxLength is the default maximal length of the incoming
+// request IDs.
+const DefaultRequestIDMaxLength = 128
+
+// UUIDPattern matches UUIDs, like "123e4567-e89b-12d3-a456-426614174000".
+var UUIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// RequestIDPattern creates an IDValidator that accepts the request IDs that
+// match the pattern and are at most maxLength characters long. If maxLength is
+// 0, the length is not limited.
+func RequestIDPattern(pattern *regexp.Regexp, maxLength int) IDValidator {
+	return func(id string) error {
+		if maxLength > 0 && len(id) > maxLength {
+			return fmt.Errorf("request ID too long: maximal length is %d", maxLength)
+		}
+		if !pattern.MatchString(id) {
+			return fmt.Errorf("malformed request ID")
+		}
+		return nil
+	}
+}
+
+// InvalidIDPolicy defines what happens to requests with an invalid incoming
+// request ID.
+type InvalidIDPolicy int
+
+const (
+	// RegenerateInvalidID replaces the invalid ID with a newly generated one.
+	RegenerateInvalidID InvalidIDPolicy = iota
+	// RejectInvalidID rejects the request with error code 400 (Bad Request).
+	RejectInvalidID
+)
+
+// ParseInvalidIDPolicy parses the name of an InvalidIDPolicy: "regenerate" or
+// "reject".
+func ParseInvalidIDPolicy(name string) (InvalidIDPolicy, error) {
+	switch name {
+	case "regenerate":
+		return RegenerateInvalidID, nil
+	case "reject":
+		return RejectInvalidID, nil
+	}
+	return RegenerateInvalidID, fmt.Errorf("unknown invalid request ID policy: %s", name)
+}
+
+// ValidatedRequestID is like RequestIDFrom, but validates the incoming request
+// ID (already set on the Request or found by the lookup) with the validator,
+// to prevent spoofed IDs (for example, log injection). Invalid IDs are handled
+// according to the policy. If validator is nil, all IDs are accepted.
+func ValidatedRequestID(size int, lookup IDLookup, validator IDValidator, policy InvalidIDPolicy) Handler {
 	return func(middleware Middleware) Middleware {
 		return func(ctx context.Context, req *Request, resp *Response) error {
-			id := GenerateRandomString(size)
-			req.ID = id
-			resp.ID = id
+			if req.ID == "" && lookup != nil {
+				req.ID = lookup(req)
+			}
+			if req.ID != "" && validator != nil {
+				if err := validator(req.ID); err != nil {
+					if policy == RejectInvalidID {
+						setErrorResponse(resp, 400, err.Error())
+						return nil
+					}
+					req.ID = ""
+				}
+			}
+			if req.ID == "" {
+				req.ID = GenerateRandomString(size)
+			}
+			resp.ID = req.ID
 			return middleware(ctx, req, resp)
 		}
 	}
@@ -129,6 +288,324 @@ func JSONResponse(middleware Middleware) Middleware {
 	}
 }
 
+// JSONOptions configures the JSON serialization of the Response, see
+// JSONResponseWithOptions.
+type JSONOptions struct {
+	// Indent pretty-prints the JSON with the given indentation (like "  "),
+	// for human-readable responses. If empty, the JSON is compact.
+	Indent string
+	// DisableHTMLEscape keeps the characters <, > and & as they are, instead
+	// of escaping them (as \u003c, \u003e and \u0026), which is safe when the
+	// response is not embedded in HTML. Keeps URLs in the payload readable.
+	DisableHTMLEscape bool
+}
+
+// JSONResponseWithOptions creates a Handler that serializes the whole Response
+// as JSON, like JSONResponse, but with the given serialization options.
+func JSONResponseWithOptions(opts JSONOptions) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			if err := middleware(ctx, req, resp); err != nil {
+				return err
+			}
+			buffer := &bytes.Buffer{}
+			encoder := json.NewEncoder(buffer)
+			encoder.SetEscapeHTML(!opts.DisableHTMLEscape)
+			encoder.SetIndent("", opts.Indent)
+			if err := encoder.Encode(resp); err != nil {
+				return err
+			}
+			resp.Payload = strings.TrimSuffix(buffer.String(), "\n")
+			return nil
+		}
+	}
+}
+
+// RequireJSONOutput is a Handler that validates that the output of the process
+// (the Payload of the Response) is a valid JSON. If the output cannot be parsed,
+// the Response is marked as an error with error code 502 (Bad Gateway), as the
+// wrapped process did not produce a valid response.
+// Responses that are already marked as errors are left as they are.
+func RequireJSONOutput(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		if err := middleware(ctx, req, resp); err != nil {
+			return err
+		}
+		if resp.Error != nil && *resp.Error {
+			return nil
+		}
+		if !json.Valid([]byte(resp.Payload)) {
+			setErrorResponse(resp, 502, "malformed process output: expected valid JSON")
+		}
+		return nil
+	}
+}
+
+// Deadline is a Handler that sets a deadline on the context of the request,
+// timeout from the moment the request is handled. The process agent passes the
+// time remaining until the deadline to the process (see DeadlineEnv).
+func Deadline(timeout time.Duration) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// CGIOutput is a Handler that splits the output of the process into headers
+// and body, similarly to CGI. The output must start with the header lines
+// ("Key: Value"), followed by an empty line and then the body. The headers are
+// set in the Response Metadata (by their canonical names) and the body becomes
+// the Response Payload. The "Status" header (like "Status: 201 Created") sets
+// the status code of the Response and the "Filename" header sets the file name
+// of the Response (see MetadataFilename).
+// If the output does not start with valid header lines, the Response is marked
+// as an error with error code 502 (Bad Gateway).
+// Responses that are already marked as errors are left as they are.
+func CGIOutput(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		if err := middleware(ctx, req, resp); err != nil {
+			return err
+		}
+		if resp.Error != nil && *resp.Error {
+			return nil
+		}
+		headers, body, err := parseCGIOutput(resp.Payload)
+		if err != nil {
+			setErrorResponse(resp, 502, "malformed process output: "+err.Error())
+			return nil
+		}
+		for name, value := range headers {
+			resp.SetMetadata(name, value)
+		}
+		resp.Payload = body
+		return nil
+	}
+}
+
+// parseCGIOutput splits the CGI style output into the headers and the body.
+// The status code from the "Status" header is returned under MetadataStatus
+// and the file name from the "Filename" header under MetadataFilename.
+func parseCGIOutput(output string) (map[string]string, string, error) {
+	headers := map[string]string{}
+	for {
+		end := strings.Index(output, "\n")
+		if end < 0 {
+			return nil, "", fmt.Errorf("expected an empty line after the headers")
+		}
+		line := strings.TrimSuffix(output[:end], "\r")
+		output = output[end+1:]
+		if line == "" {
+			return headers, output, nil
+		}
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, "", fmt.Errorf("invalid header line: %q", line)
+		}
+		name := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+		if name == "Status" {
+			// only the status code, without the reason phrase
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				return nil, "", fmt.Errorf("invalid status: %q", value)
+			}
+			if _, err := strconv.Atoi(fields[0]); err != nil {
+				return nil, "", fmt.Errorf("invalid status: %q", value)
+			}
+			name, value = MetadataStatus, fields[0]
+		}
+		if name == "Filename" {
+			name = MetadataFilename
+		}
+		headers[name] = value
+	}
+}
+
+// WrapOutput is a Handler that prepends the prefix and appends the suffix to
+// the Response Payload, after the original middleware has executed.
+// The output is wrapped only for successful responses, unless onError is set
+// to true, in which case error responses are wrapped as well.
+func WrapOutput(prefix, suffix string, onError bool) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			if err := middleware(ctx, req, resp); err != nil {
+				return err
+			}
+			if resp.Error != nil && *resp.Error && !onError {
+				return nil
+			}
+			resp.Payload = prefix + resp.Payload + suffix
+			return nil
+		}
+	}
+}
+
+// RequireNonEmptyPayload is a Handler that rejects requests with an empty
+// Payload with error code 400 (Bad Request), before the request is processed.
+// If whitespaceIsEmpty is set, payloads containing only whitespace are rejected
+// as well.
+func RequireNonEmptyPayload(whitespaceIsEmpty bool) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			payload := req.Payload
+			if whitespaceIsEmpty {
+				payload = strings.TrimSpace(payload)
+			}
+			if payload == "" {
+				setErrorResponse(resp, 400, "empty request payload")
+				return nil
+			}
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// SchemaVersionHeader is the name of the header (Request Metadata key) holding
+// the schema version of the request.
+const SchemaVersionHeader = "X-Schema-Version"
+
+// RequireSchemaVersion is a Handler that rejects requests with a schema version
+// (see SchemaVersionHeader) that is missing or not in the supported versions,
+// with error code 400 (Bad Request). The error message lists the supported
+// versions.
+func RequireSchemaVersion(supported []string) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			version := req.Metadata[SchemaVersionHeader]
+			for _, supportedVersion := range supported {
+				if version == supportedVersion {
+					return middleware(ctx, req, resp)
+				}
+			}
+			message := fmt.Sprintf("unsupported schema version %q, supported versions: %s", version, strings.Join(supported, ", "))
+			if version == "" {
+				message = fmt.Sprintf("missing %s, supported versions: %s", SchemaVersionHeader, strings.Join(supported, ", "))
+			}
+			setErrorResponse(resp, 400, message)
+			return nil
+		}
+	}
+}
+
+// Newline styles for NormalizeNewlines.
+const (
+	// NewlineLF is the Unix style newline.
+	NewlineLF = "\n"
+	// NewlineCRLF is the Windows style newline.
+	NewlineCRLF = "\r\n"
+)
+
+// ParseNewlineStyle parses the name of a newline style: "lf" or "crlf".
+func ParseNewlineStyle(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "lf":
+		return NewlineLF, nil
+	case "crlf":
+		return NewlineCRLF, nil
+	}
+	return "", fmt.Errorf("unknown newline style: %s", name)
+}
+
+// NormalizeNewlines is a Handler that converts all line endings (CRLF, CR or LF)
+// in the Request Payload to the given newline style, before the request is
+// processed. If newline is empty, NewlineLF is used.
+func NormalizeNewlines(newline string) Handler {
+	if newline == "" {
+		newline = NewlineLF
+	}
+	replacer := strings.NewReplacer("\r\n", newline, "\r", newline, "\n", newline)
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			req.Payload = replacer.Replace(req.Payload)
+			return middleware(ctx, req, resp)
+		}
+	}
+}
+
+// ResponseSink receives a copy of a Response.
+type ResponseSink func(*Response)
+
+// TeeResponse is a Handler that fans out a copy of the Response to each of the
+// sinks after the original middleware has executed. The sinks are called
+// asynchronously, so they do not block the primary return path.
+func TeeResponse(sinks ...ResponseSink) Handler {
+	return teeResponse(true, sinks)
+}
+
+// TeeResponseSync is like TeeResponse, but calls the sinks synchronously, one
+// after the other, before returning.
+func TeeResponseSync(sinks ...ResponseSink) Handler {
+	return teeResponse(false, sinks)
+}
+
+func teeResponse(async bool, sinks []ResponseSink) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			if err := middleware(ctx, req, resp); err != nil {
+				return err
+			}
+			for _, sink := range sinks {
+				respCopy := copyResponse(resp)
+				if async {
+					go sink(respCopy)
+				} else {
+					sink(respCopy)
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// copyResponse creates a deep copy of the Response, so the copy can be used
+// (for example in another goroutine) while the Response is being changed.
+func copyResponse(resp *Response) *Response {
+	respCopy := *resp
+	if resp.Error != nil {
+		errv := *resp.Error
+		respCopy.Error = &errv
+	}
+	if resp.ErrorCode != nil {
+		errorCode := *resp.ErrorCode
+		respCopy.ErrorCode = &errorCode
+	}
+	if resp.ExitCode != nil {
+		exitCode := *resp.ExitCode
+		respCopy.ExitCode = &exitCode
+	}
+	if resp.Metadata != nil {
+		respCopy.Metadata = make(map[string]string, len(resp.Metadata))
+		for key, value := range resp.Metadata {
+			respCopy.Metadata[key] = value
+		}
+	}
+	return &respCopy
+}
+
+// contextErrorResponse handles a request whose context is done before it has
+// been processed. A request past its deadline is responded with error code 504
+// (Gateway Timeout), like a process running out of time. A canceled request has
+// no one to respond to, so the cancellation error is returned.
+func contextErrorResponse(ctx context.Context, resp *Response) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		setErrorResponse(resp, 504, "request deadline exceeded")
+		return nil
+	}
+	return ctx.Err()
+}
+
+// setErrorResponse marks the Response as an error with the given error code and
+// sets the message as the Response Payload.
+func setErrorResponse(resp *Response, errorCode int, message string) {
+	errv := true
+	resp.Error = &errv
+	resp.ErrorCode = &errorCode
+	resp.Payload = message
+}
+
 var marshalResponse = func(r *Response ) ([]byte, error){
 	return json.Marshal(r)
 }
\ No newline at end of file
@@ -2,11 +2,15 @@ package processagent
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGenerateRandomString(t *testing.T) {
@@ -16,6 +20,42 @@ func TestGenerateRandomString(t *testing.T) {
 	}
 }
 
+func TestGenerateRandomStringFallback(t *testing.T) {
+	randomRead = func(b []byte) (int, error) {
+		return 0, errors.New("no entropy")
+	}
+	defer func() {
+		randomRead = rand.Read
+	}()
+
+	const workers = 8
+	const perWorker = 1000
+	ids := make(chan string, workers*perWorker)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				ids <- GenerateRandomString(9)
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[string]bool{}
+	for id := range ids {
+		if id == "" {
+			t.Fatal("Expected a fallback ID to be generated.")
+		}
+		if seen[id] {
+			t.Fatal("Duplicate fallback ID generated: ", id)
+		}
+		seen[id] = true
+	}
+}
+
 func TestCurrentTimeMillis(t *testing.T) {
 	now := CurrentTimeMillis()
 	if now <= 0 {
@@ -116,6 +156,10 @@ func TestJSONResponseMarshalFails(t *testing.T) {
 	middleware := func(ctx context.Context, req *Request, resp *Response) error {
 		return nil
 	}
+	originalMarshal := marshalResponse
+	defer func() {
+		marshalResponse = originalMarshal
+	}()
 	marshalResponse = func(r *Response) ([]byte, error) {
 		return nil, expectedErr
 	}
@@ -133,3 +177,434 @@ func TestJSONResponseMarshalFails(t *testing.T) {
 		t.Fatalf("Should return err: %v", expectedErr)
 	}
 }
+
+func TestRequireJSONOutputValid(t *testing.T) {
+	middleware := func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = `{"name": "test"}`
+		return nil
+	}
+	middleware = RequireJSONOutput(middleware)
+
+	resp := &Response{}
+	if err := middleware(context.Background(), &Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		t.Fatal("Expected valid JSON output not to be marked as an error.")
+	}
+	if resp.Payload != `{"name": "test"}` {
+		t.Fatal("Expected the Payload to pass through unchanged, but got: ", resp.Payload)
+	}
+}
+
+func TestRequireJSONOutputInvalid(t *testing.T) {
+	middleware := func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "not a JSON {"
+		return nil
+	}
+	middleware = RequireJSONOutput(middleware)
+
+	resp := &Response{}
+	if err := middleware(context.Background(), &Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error == nil || !*resp.Error {
+		t.Fatal("Expected invalid JSON output to be marked as an error.")
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 502 {
+		t.Fatal("Expected error code 502, but got: ", resp.ErrorCode)
+	}
+	if !strings.Contains(resp.Payload, "malformed process output") {
+		t.Fatal("Expected a message about malformed output, but got: ", resp.Payload)
+	}
+}
+
+func TestWrapOutput(t *testing.T) {
+	middleware := func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "output"
+		return nil
+	}
+	middleware = WrapOutput("[", "]\n", false)(middleware)
+
+	resp := &Response{}
+	if err := middleware(context.Background(), &Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Payload != "[output]\n" {
+		t.Fatalf("Expected the prefix and suffix to be applied, but got %q", resp.Payload)
+	}
+}
+
+func TestWrapOutputOnError(t *testing.T) {
+	middleware := func(ctx context.Context, req *Request, resp *Response) error {
+		setErrorResponse(resp, 500, "failure")
+		return nil
+	}
+
+	resp := &Response{}
+	WrapOutput("[", "]", false)(middleware)(context.Background(), &Request{}, resp)
+	if resp.Payload != "failure" {
+		t.Fatal("Expected error response not to be wrapped, but got: ", resp.Payload)
+	}
+
+	resp = &Response{}
+	WrapOutput("[", "]", true)(middleware)(context.Background(), &Request{}, resp)
+	if resp.Payload != "[failure]" {
+		t.Fatal("Expected error response to be wrapped, but got: ", resp.Payload)
+	}
+}
+
+func TestRequireNonEmptyPayload(t *testing.T) {
+	called := false
+	middleware := func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	}
+
+	tests := []struct {
+		payload           string
+		whitespaceIsEmpty bool
+		rejected          bool
+	}{
+		{"", false, true},
+		{"", true, true},
+		{" \n\t", true, true},
+		{" \n\t", false, false},
+		{"data", true, false},
+	}
+
+	for _, test := range tests {
+		called = false
+		resp := &Response{}
+		if err := RequireNonEmptyPayload(test.whitespaceIsEmpty)(middleware)(context.Background(), &Request{
+			Payload: test.payload,
+		}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if test.rejected {
+			if called {
+				t.Fatalf("Expected payload %q to be rejected.", test.payload)
+			}
+			if resp.ErrorCode == nil || *resp.ErrorCode != 400 {
+				t.Fatalf("Expected payload %q to be rejected with 400.", test.payload)
+			}
+		} else if !called {
+			t.Fatalf("Expected payload %q to be processed.", test.payload)
+		}
+	}
+}
+
+func TestTeeResponse(t *testing.T) {
+	middleware := func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "output"
+		return nil
+	}
+
+	received := make(chan *Response, 2)
+	sink := func(resp *Response) {
+		received <- resp
+	}
+
+	resp := &Response{}
+	if err := TeeResponse(sink, sink)(middleware)(context.Background(), &Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-received:
+			if r.Payload != "output" {
+				t.Fatal("Expected the sink to receive the response, but got: ", r.Payload)
+			}
+			if r == resp {
+				t.Fatal("Expected the sink to receive a copy of the response.")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected each sink to receive the response.")
+		}
+	}
+}
+
+func TestTeeResponseSync(t *testing.T) {
+	middleware := func(ctx context.Context, req *Request, resp *Response) error {
+		setErrorResponse(resp, 500, "failure")
+		return nil
+	}
+
+	payloads := []string{}
+	sink := func(resp *Response) {
+		payloads = append(payloads, resp.Payload)
+	}
+
+	TeeResponseSync(sink, sink)(middleware)(context.Background(), &Request{}, &Response{})
+	if len(payloads) != 2 || payloads[0] != "failure" || payloads[1] != "failure" {
+		t.Fatal("Expected each sink to receive the response, but got: ", payloads)
+	}
+}
+
+func TestCopyResponse(t *testing.T) {
+	exitCode := 2
+	resp := &Response{Payload: "output", ExitCode: &exitCode}
+	resp.SetMetadata("status", "200")
+	setErrorResponse(resp, 500, "failure")
+
+	respCopy := copyResponse(resp)
+	resp.SetMetadata("status", "500")
+	*resp.ExitCode = 1
+	*resp.ErrorCode = 502
+	if respCopy.Metadata["status"] != "200" || *respCopy.ExitCode != 2 || *respCopy.ErrorCode != 500 {
+		t.Fatal("Expected the copy not to change with the original response, but got: ", respCopy)
+	}
+}
+
+func TestRequestIDKeepsExisting(t *testing.T) {
+	middleware := RequestID(12)(func(ctx context.Context, req *Request, resp *Response) error {
+		return nil
+	})
+
+	req := &Request{ID: "client-id"}
+	resp := &Response{}
+	middleware(context.Background(), req, resp)
+	if req.ID != "client-id" || resp.ID != "client-id" {
+		t.Fatal("Expected the existing request ID to be kept, but got: ", req.ID, resp.ID)
+	}
+}
+
+func TestRequireSchemaVersion(t *testing.T) {
+	called := false
+	middleware := RequireSchemaVersion([]string{"1", "2"})(func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Metadata: map[string]string{SchemaVersionHeader: "2"}}, resp)
+	if !called || resp.Error != nil {
+		t.Fatal("Expected compatible schema version to be processed.")
+	}
+
+	for _, version := range []string{"3", ""} {
+		called = false
+		resp = &Response{}
+		middleware(context.Background(), &Request{Metadata: map[string]string{SchemaVersionHeader: version}}, resp)
+		if called {
+			t.Fatalf("Expected schema version %q to be rejected.", version)
+		}
+		if resp.ErrorCode == nil || *resp.ErrorCode != 400 {
+			t.Fatalf("Expected schema version %q to be rejected with 400.", version)
+		}
+		if !strings.Contains(resp.Payload, "supported versions: 1, 2") {
+			t.Fatal("Expected the supported versions to be listed, but got: ", resp.Payload)
+		}
+	}
+}
+
+func TestCGIOutput(t *testing.T) {
+	output := ""
+	middleware := CGIOutput(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = output
+		return nil
+	})
+
+	output = "Content-Type: application/json\r\nx-custom:  value\nStatus: 201 Created\n\n{\"a\": 1}\n\nmore"
+	resp := &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected valid CGI output, but got: ", resp.Payload)
+	}
+	if resp.Payload != "{\"a\": 1}\n\nmore" {
+		t.Fatalf("Unexpected body: %q", resp.Payload)
+	}
+	if resp.Metadata["Content-Type"] != "application/json" || resp.Metadata["X-Custom"] != "value" {
+		t.Fatal("Expected the headers in the response metadata, but got: ", resp.Metadata)
+	}
+	if resp.Metadata[MetadataStatus] != "201" {
+		t.Fatal("Expected the status in the response metadata, but got: ", resp.Metadata)
+	}
+
+	output = "\nbody only"
+	resp = &Response{}
+	middleware(context.Background(), &Request{}, resp)
+	if resp.Error != nil || resp.Payload != "body only" || len(resp.Metadata) != 0 {
+		t.Fatal("Expected body without headers, but got: ", resp.Payload, resp.Metadata)
+	}
+
+	for _, output = range []string{"no headers at all", "Status: abc\n\nbody", "Status:\n\nbody", "Key: value\nbody"} {
+		resp = &Response{}
+		middleware(context.Background(), &Request{}, resp)
+		if resp.ErrorCode == nil || *resp.ErrorCode != 502 {
+			t.Fatalf("Expected malformed output %q to be rejected with 502.", output)
+		}
+	}
+}
+
+func TestRequestIDFrom(t *testing.T) {
+	middleware := RequestIDFrom(12, MetadataIDLookup("X-Request-Id"))(func(ctx context.Context, req *Request, resp *Response) error {
+		return nil
+	})
+
+	req := &Request{Metadata: map[string]string{"X-Request-Id": "upstream-id"}}
+	resp := &Response{}
+	middleware(context.Background(), req, resp)
+	if req.ID != "upstream-id" || resp.ID != "upstream-id" {
+		t.Fatal("Expected the incoming request ID to be honored, but got: ", req.ID, resp.ID)
+	}
+
+	req = &Request{Metadata: map[string]string{}}
+	resp = &Response{}
+	middleware(context.Background(), req, resp)
+	if req.ID == "" || resp.ID != req.ID {
+		t.Fatal("Expected a new request ID to be generated, but got: ", req.ID, resp.ID)
+	}
+
+	// the IDs are validated by default
+	for _, id := range []string{"id\nforged log line", strings.Repeat("x", DefaultRequestIDMaxLength+1)} {
+		req = &Request{Metadata: map[string]string{"X-Request-Id": id}}
+		middleware(context.Background(), req, &Response{})
+		if req.ID == id || req.ID == "" {
+			t.Fatalf("Expected an invalid incoming ID to be replaced, but got: %q", req.ID)
+		}
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	var received string
+	middleware := func(ctx context.Context, req *Request, resp *Response) error {
+		received = req.Payload
+		return nil
+	}
+
+	NormalizeNewlines("")(middleware)(context.Background(), &Request{Payload: "a\r\nb\rc\nd\r\n"}, &Response{})
+	if received != "a\nb\nc\nd\n" {
+		t.Fatalf("Expected the newlines to be converted to LF, but got %q", received)
+	}
+
+	NormalizeNewlines(NewlineCRLF)(middleware)(context.Background(), &Request{Payload: "a\r\nb\nc"}, &Response{})
+	if received != "a\r\nb\r\nc" {
+		t.Fatalf("Expected the newlines to be converted to CRLF, but got %q", received)
+	}
+}
+
+func TestParseNewlineStyle(t *testing.T) {
+	if newline, err := ParseNewlineStyle("CRLF"); err != nil || newline != NewlineCRLF {
+		t.Fatal("Expected CRLF newline style.")
+	}
+	if newline, err := ParseNewlineStyle("lf"); err != nil || newline != NewlineLF {
+		t.Fatal("Expected LF newline style.")
+	}
+	if _, err := ParseNewlineStyle("cr"); err == nil {
+		t.Fatal("Expected an error for unknown newline style.")
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	middleware := Deadline(time.Duration(5) * time.Second)(func(ctx context.Context, req *Request, resp *Response) error {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return fmt.Errorf("no deadline set")
+		}
+		if remaining := time.Until(deadline); remaining <= 0 || remaining > time.Duration(5)*time.Second {
+			return fmt.Errorf("unexpected deadline: %s", remaining)
+		}
+		return nil
+	})
+	if err := middleware(context.Background(), &Request{}, &Response{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidatedRequestID(t *testing.T) {
+	validator := RequestIDPattern(DefaultRequestIDPattern, 64)
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"upstream-id.1:a", true},
+		{GenerateRandomString(9), true},
+		{strings.Repeat("a", 65), false},
+		{"id\nFAKE LOG LINE", false},
+		{"id\x1b[31m", false},
+	}
+
+	for _, test := range tests {
+		for _, policy := range []InvalidIDPolicy{RegenerateInvalidID, RejectInvalidID} {
+			called := false
+			middleware := ValidatedRequestID(12, MetadataIDLookup("X-Request-Id"), validator, policy)(func(ctx context.Context, req *Request, resp *Response) error {
+				called = true
+				return nil
+			})
+			req := &Request{Metadata: map[string]string{"X-Request-Id": test.id}}
+			resp := &Response{}
+			middleware(context.Background(), req, resp)
+
+			switch {
+			case test.valid:
+				if !called || req.ID != test.id {
+					t.Fatalf("Expected the valid ID %q to be honored, but got %q.", test.id, req.ID)
+				}
+			case policy == RegenerateInvalidID:
+				if !called || req.ID == test.id || req.ID == "" || resp.ID != req.ID {
+					t.Fatalf("Expected the invalid ID %q to be regenerated, but got %q.", test.id, req.ID)
+				}
+			default:
+				if called || resp.ErrorCode == nil || *resp.ErrorCode != 400 {
+					t.Fatalf("Expected the request with invalid ID %q to be rejected with 400.", test.id)
+				}
+			}
+		}
+	}
+}
+
+func TestRequestIDPatternUUID(t *testing.T) {
+	validator := RequestIDPattern(UUIDPattern, 0)
+	if err := validator("123e4567-e89b-12d3-a456-426614174000"); err != nil {
+		t.Fatal("Expected a valid UUID, but got: ", err)
+	}
+	if err := validator("123e4567-e89b-12d3-a456"); err == nil {
+		t.Fatal("Expected an error for a malformed UUID.")
+	}
+}
+
+func TestParseInvalidIDPolicy(t *testing.T) {
+	if policy, err := ParseInvalidIDPolicy("reject"); err != nil || policy != RejectInvalidID {
+		t.Fatal("Expected reject policy.")
+	}
+	if policy, err := ParseInvalidIDPolicy("regenerate"); err != nil || policy != RegenerateInvalidID {
+		t.Fatal("Expected regenerate policy.")
+	}
+	if _, err := ParseInvalidIDPolicy("ignore"); err == nil {
+		t.Fatal("Expected an error for unknown policy.")
+	}
+}
+
+func TestJSONResponseWithOptions(t *testing.T) {
+	process := func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "<a href=\"http://example.com/?a=1&b=2\">"
+		return nil
+	}
+
+	resp := &Response{ID: "id"}
+	JSONResponseWithOptions(JSONOptions{})(process)(context.Background(), &Request{}, resp)
+	if !strings.Contains(resp.Payload, `\u003ca href`) || !strings.Contains(resp.Payload, `a=1\u0026b=2`) {
+		t.Fatal("Expected HTML to be escaped by default, but got: ", resp.Payload)
+	}
+	if strings.Contains(resp.Payload, "\n") {
+		t.Fatal("Expected compact JSON by default, but got: ", resp.Payload)
+	}
+
+	resp = &Response{ID: "id"}
+	JSONResponseWithOptions(JSONOptions{DisableHTMLEscape: true})(process)(context.Background(), &Request{}, resp)
+	if !strings.Contains(resp.Payload, `"payload":"<a href=\"http://example.com/?a=1&b=2\">"`) {
+		t.Fatal("Expected HTML not to be escaped, but got: ", resp.Payload)
+	}
+
+	resp = &Response{ID: "id"}
+	JSONResponseWithOptions(JSONOptions{Indent: "  "})(process)(context.Background(), &Request{}, resp)
+	if !strings.HasPrefix(resp.Payload, "{\n  \"id\": \"id\",\n") || !strings.HasSuffix(resp.Payload, "\n}") {
+		t.Fatal("Expected indented JSON, but got: ", resp.Payload)
+	}
+	result := &Response{}
+	if err := json.Unmarshal([]byte(resp.Payload), result); err != nil || result.ID != "id" {
+		t.Fatal("Expected valid JSON, but got: ", resp.Payload)
+	}
+}
@@ -0,0 +1,121 @@
+package processagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// msgpackWriter encodes values in the MessagePack format. Only the types needed
+// to encode a Response are supported.
+type msgpackWriter struct {
+	buffer bytes.Buffer
+}
+
+func (w *msgpackWriter) writeHeader(fix byte, fixMax int, codes [3]byte, length int) {
+	switch {
+	case length <= fixMax:
+		w.buffer.WriteByte(fix | byte(length))
+	case length <= 0xff && codes[0] != 0:
+		w.buffer.WriteByte(codes[0])
+		w.buffer.WriteByte(byte(length))
+	case length <= 0xffff:
+		w.buffer.WriteByte(codes[1])
+		binary.Write(&w.buffer, binary.BigEndian, uint16(length))
+	default:
+		w.buffer.WriteByte(codes[2])
+		binary.Write(&w.buffer, binary.BigEndian, uint32(length))
+	}
+}
+
+func (w *msgpackWriter) writeString(value string) {
+	w.writeHeader(0xa0, 31, [3]byte{0xd9, 0xda, 0xdb}, len(value))
+	w.buffer.WriteString(value)
+}
+
+func (w *msgpackWriter) writeMapHeader(size int) {
+	w.writeHeader(0x80, 15, [3]byte{0, 0xde, 0xdf}, size)
+}
+
+func (w *msgpackWriter) writeInt(value int64) {
+	if value >= 0 && value <= 0x7f {
+		w.buffer.WriteByte(byte(value))
+		return
+	}
+	w.buffer.WriteByte(0xd3)
+	binary.Write(&w.buffer, binary.BigEndian, value)
+}
+
+func (w *msgpackWriter) writeBool(value bool) {
+	if value {
+		w.buffer.WriteByte(0xc3)
+	} else {
+		w.buffer.WriteByte(0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeStringMap(values map[string]string) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w.writeMapHeader(len(keys))
+	for _, key := range keys {
+		w.writeString(key)
+		w.writeString(values[key])
+	}
+}
+
+// marshalMsgpack encodes the Response in the MessagePack format, as a map with
+// the same keys as the JSON encoding of the Response.
+func marshalMsgpack(resp *Response) []byte {
+	size := 4
+	if resp.Error != nil {
+		size++
+	}
+	if resp.ErrorCode != nil {
+		size++
+	}
+	if resp.ExitCode != nil {
+		size++
+	}
+	if resp.Stderr != "" {
+		size++
+	}
+	if len(resp.Metadata) > 0 {
+		size++
+	}
+
+	w := &msgpackWriter{}
+	w.writeMapHeader(size)
+	w.writeString("id")
+	w.writeString(resp.ID)
+	w.writeString("port")
+	w.writeString(resp.Port)
+	w.writeString("payload")
+	w.writeString(resp.Payload)
+	w.writeString("timestamp")
+	w.writeInt(resp.Timestamp)
+	if resp.Error != nil {
+		w.writeString("error")
+		w.writeBool(*resp.Error)
+	}
+	if resp.ErrorCode != nil {
+		w.writeString("errorCode")
+		w.writeInt(int64(*resp.ErrorCode))
+	}
+	if resp.ExitCode != nil {
+		w.writeString("exitCode")
+		w.writeInt(int64(*resp.ExitCode))
+	}
+	if resp.Stderr != "" {
+		w.writeString("stderr")
+		w.writeString(resp.Stderr)
+	}
+	if len(resp.Metadata) > 0 {
+		w.writeString("metadata")
+		w.writeStringMap(resp.Metadata)
+	}
+	return w.buffer.Bytes()
+}
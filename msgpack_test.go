@@ -0,0 +1,49 @@
+package processagent
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMarshalMsgpack(t *testing.T) {
+	data := marshalMsgpack(&Response{
+		ID:        "a",
+		Port:      "p",
+		Payload:   "x",
+		Timestamp: 1,
+	})
+	expected := []byte("\x84\xa2id\xa1a\xa4port\xa1p\xa7payload\xa1x\xa9timestamp\x01")
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("Unexpected MessagePack encoding: %q", data)
+	}
+
+	errv := true
+	errorCode := 500
+	exitCode := 2
+	data = marshalMsgpack(&Response{
+		Payload:   strings.Repeat("x", 40),
+		Timestamp: 1000,
+		Error:     &errv,
+		ErrorCode: &errorCode,
+		ExitCode:  &exitCode,
+		Stderr:    "warning",
+		Metadata:  map[string]string{"k": "v"},
+	})
+	if data[0] != 0x89 {
+		t.Fatalf("Expected a map with 9 entries, but got: %x", data[0])
+	}
+	for _, part := range [][]byte{
+		[]byte("\xa7payload\xd9\x28" + strings.Repeat("x", 40)),
+		[]byte("\xa9timestamp\xd3\x00\x00\x00\x00\x00\x00\x03\xe8"),
+		[]byte("\xa5error\xc3"),
+		[]byte("\xa9errorCode\xd3\x00\x00\x00\x00\x00\x00\x01\xf4"),
+		[]byte("\xa8exitCode\x02"),
+		[]byte("\xa6stderr\xa7warning"),
+		[]byte("\xa8metadata\x81\xa1k\xa1v"),
+	} {
+		if !bytes.Contains(data, part) {
+			t.Fatalf("Expected %q in the MessagePack encoding: %q", part, data)
+		}
+	}
+}
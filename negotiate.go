@@ -0,0 +1,146 @@
+package processagent
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Media types supported by Negotiate.
+const (
+	MediaTypeJSON    = "application/json"
+	MediaTypeMsgpack = "application/x-msgpack"
+	MediaTypeYAML    = "application/yaml"
+	MediaTypeText    = "text/plain"
+)
+
+// serializer serializes the Response into the Response Payload.
+type serializer func(resp *Response) error
+
+// serializers are the serializers of the media types supported by Negotiate.
+var serializers = map[string]serializer{
+	MediaTypeJSON: func(resp *Response) error {
+		data, err := marshalResponse(resp)
+		if err != nil {
+			return err
+		}
+		resp.Payload = string(data)
+		return nil
+	},
+	MediaTypeMsgpack: func(resp *Response) error {
+		resp.Payload = string(marshalMsgpack(resp))
+		return nil
+	},
+	MediaTypeYAML: func(resp *Response) error {
+		resp.Payload = string(marshalYAML(resp))
+		return nil
+	},
+	MediaTypeText: func(resp *Response) error {
+		return nil
+	},
+}
+
+// formats are the media types selected by the "format" query parameter, see
+// Negotiate.
+var formats = map[string]string{
+	"json":    MediaTypeJSON,
+	"msgpack": MediaTypeMsgpack,
+	"yaml":    MediaTypeYAML,
+	"raw":     MediaTypeText,
+}
+
+// acceptedType is a media range from the Accept header with its quality.
+type acceptedType struct {
+	mediaRange string
+	quality    float64
+}
+
+// parseAccept parses the Accept header value into the accepted media ranges,
+// ordered by quality (highest first). Media ranges with quality 0 are not
+// acceptable and are left out.
+func parseAccept(accept string) []acceptedType {
+	accepted := []acceptedType{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaRange == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			accepted = append(accepted, acceptedType{mediaRange, quality})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].quality > accepted[j].quality
+	})
+	return accepted
+}
+
+// negotiateMediaType selects the supported media type for the Accept header
+// value. If the Accept header is empty, JSON is selected. Returns an empty
+// string if none of the supported media types is acceptable.
+func negotiateMediaType(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return MediaTypeJSON
+	}
+	for _, accepted := range parseAccept(accept) {
+		switch accepted.mediaRange {
+		case "*/*", "application/*":
+			return MediaTypeJSON
+		case "text/*":
+			return MediaTypeText
+		}
+		if _, ok := serializers[accepted.mediaRange]; ok {
+			return accepted.mediaRange
+		}
+	}
+	return ""
+}
+
+// Negotiate is a Handler that serializes the Response according to the media
+// type accepted by the client (the "Accept" header in the Request Metadata):
+// the whole Response as JSON (application/json), MessagePack
+// (application/x-msgpack) or YAML (application/yaml), or just the raw Payload
+// (text/plain). The selected media type is set as "Content-Type" in the
+// Response Metadata.
+// The client may select the format with the "format" query parameter instead:
+// "json", "msgpack", "yaml" or "raw". The query parameter takes precedence over
+// the Accept header, and an unknown format is rejected with error code 400 (Bad
+// Request) before the request is processed.
+// If none of the media types is acceptable, the request is rejected with error
+// code 406 (Not Acceptable) before it is processed.
+func Negotiate(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		var mediaType string
+		query, _ := url.ParseQuery(req.Metadata[MetadataQuery])
+		if format := query.Get("format"); format != "" {
+			if mediaType = formats[format]; mediaType == "" {
+				setErrorResponse(resp, 400, "unknown format: "+format+", supported formats: json, msgpack, yaml, raw")
+				return nil
+			}
+		} else if mediaType = negotiateMediaType(req.Metadata["Accept"]); mediaType == "" {
+			setErrorResponse(resp, 406, "not acceptable, supported media types: "+
+				strings.Join([]string{MediaTypeJSON, MediaTypeMsgpack, MediaTypeYAML, MediaTypeText}, ", "))
+			return nil
+		}
+		if err := middleware(ctx, req, resp); err != nil {
+			return err
+		}
+		if err := serializers[mediaType](resp); err != nil {
+			return err
+		}
+		resp.SetMetadata("Content-Type", mediaType)
+		return nil
+	}
+}
@@ -0,0 +1,100 @@
+package processagent
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	middleware := Negotiate(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.ID = "a"
+		resp.Port = "p"
+		resp.Payload = "x"
+		resp.Timestamp = 1
+		return nil
+	})
+
+	tests := []struct {
+		accept      string
+		contentType string
+		payload     string
+	}{
+		{"application/json", MediaTypeJSON, `{"id":"a","port":"p","payload":"x","timestamp":1}`},
+		{"", MediaTypeJSON, `{"id":"a","port":"p","payload":"x","timestamp":1}`},
+		{"application/x-msgpack", MediaTypeMsgpack, "\x84\xa2id\xa1a\xa4port\xa1p\xa7payload\xa1x\xa9timestamp\x01"},
+		{"text/plain", MediaTypeText, "x"},
+		{"text/html, text/plain;q=0.5, application/json;q=0.8", MediaTypeJSON, `{"id":"a","port":"p","payload":"x","timestamp":1}`},
+		{"application/json;q=0, */*", MediaTypeJSON, `{"id":"a","port":"p","payload":"x","timestamp":1}`},
+		{"text/*", MediaTypeText, "x"},
+	}
+	for _, test := range tests {
+		resp := &Response{}
+		if err := middleware(context.Background(), &Request{Metadata: map[string]string{"Accept": test.accept}}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Metadata["Content-Type"] != test.contentType {
+			t.Fatalf("Expected content type %s for %q, but got: %s", test.contentType, test.accept, resp.Metadata["Content-Type"])
+		}
+		if resp.Payload != test.payload {
+			t.Fatalf("Unexpected payload for %q: %q", test.accept, resp.Payload)
+		}
+	}
+}
+
+func TestNegotiateNotAcceptable(t *testing.T) {
+	called := false
+	middleware := Negotiate(func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Metadata: map[string]string{"Accept": "image/png"}}, resp)
+	if called {
+		t.Fatal("Expected the request not to be processed.")
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 406 {
+		t.Fatal("Expected the request to be rejected with 406.")
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	middleware := Negotiate(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.ID = "a"
+		resp.Port = "p"
+		resp.Payload = "x"
+		resp.Timestamp = 1
+		return nil
+	})
+
+	tests := []struct {
+		query       string
+		contentType string
+		payload     string
+	}{
+		{"format=json", MediaTypeJSON, `{"id":"a","port":"p","payload":"x","timestamp":1}`},
+		{"format=msgpack", MediaTypeMsgpack, "\x84\xa2id\xa1a\xa4port\xa1p\xa7payload\xa1x\xa9timestamp\x01"},
+		{"format=yaml", MediaTypeYAML, "id: \"a\"\nport: \"p\"\npayload: \"x\"\ntimestamp: 1\n"},
+		{"format=raw&other=1", MediaTypeText, "x"},
+	}
+	for _, test := range tests {
+		resp := &Response{}
+		// the query parameter takes precedence over the Accept header
+		req := &Request{Metadata: map[string]string{"Accept": "image/png", MetadataQuery: test.query}}
+		if err := middleware(context.Background(), req, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Metadata["Content-Type"] != test.contentType {
+			t.Fatalf("Expected content type %s for %q, but got: %s", test.contentType, test.query, resp.Metadata["Content-Type"])
+		}
+		if resp.Payload != test.payload {
+			t.Fatalf("Unexpected payload for %q: %q", test.query, resp.Payload)
+		}
+	}
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Metadata: map[string]string{MetadataQuery: "format=xml"}}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 400 {
+		t.Fatal("Expected an unknown format to be rejected with 400, but got: ", resp.Payload)
+	}
+}
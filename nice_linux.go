@@ -0,0 +1,27 @@
+package processagent
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+)
+
+// setNice sets the niceness (scheduling priority) of the process with the
+// given pid. On Linux the priority is set per thread, so it is set on all
+// threads the process has already started as well.
+func setNice(pid int, nice int) error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, nice); err != nil {
+		return err
+	}
+	tasks, err := ioutil.ReadDir("/proc/" + strconv.Itoa(pid) + "/task")
+	if err != nil {
+		// the process has already exited
+		return nil
+	}
+	for _, task := range tasks {
+		if tid, err := strconv.Atoi(task.Name()); err == nil && tid != pid {
+			syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package processagent
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProcessAgentNice(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"sleep 0.2; nice\"", 0)
+	pa.Nice = 10
+
+	resp := &Response{}
+	if err := pa.ProcessCommand(&Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != nil {
+		t.Fatal("Expected no error, but got: ", resp.Payload)
+	}
+	if strings.TrimSpace(resp.Payload) != "10" {
+		t.Fatal("Expected the process to run with niceness 10, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentNiceNotPermitted(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Raising the priority is permitted to root.")
+	}
+	buff := &bytes.Buffer{}
+	pa := NewProcessAgent("/bin/echo ok", 0)
+	pa.logger = NewDedupLogger(log.New(buff, "", 0), time.Minute)
+	pa.Nice = -5
+	pa.StderrAsError = true
+
+	for i := 0; i < 2; i++ {
+		resp := &Response{}
+		pa.ProcessCommand(&Request{}, resp)
+		if resp.Error != nil || resp.Payload != "ok\n" {
+			t.Fatal("Expected the process to run with the default priority, but got: ", resp.Payload)
+		}
+	}
+	if warnings := strings.Count(buff.String(), "Failed to set process niceness"); warnings != 1 {
+		t.Fatal("Expected the warning to be logged once, but got: ", buff.String())
+	}
+}
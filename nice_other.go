@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package processagent
+
+import (
+	"fmt"
+)
+
+// setNice is not supported on this platform.
+func setNice(pid int, nice int) error {
+	return fmt.Errorf("setting process niceness is not supported on this platform")
+}
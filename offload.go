@@ -0,0 +1,61 @@
+package processagent
+
+import (
+	"context"
+	"log"
+	"strconv"
+)
+
+const (
+	// OffloadURLHeader is the name of the Response Metadata key (and HTTP
+	// header) holding the URL of an offloaded response.
+	OffloadURLHeader = "X-Offload-Url"
+	// OffloadSizeHeader is the name of the Response Metadata key (and HTTP
+	// header) holding the size in bytes of an offloaded response.
+	OffloadSizeHeader = "X-Offload-Size"
+)
+
+// ObjectStore stores response payloads that are too large to be returned
+// directly, for example in S3 or another object storage.
+type ObjectStore interface {
+	// Put stores the data under the given key and returns the URL the data can
+	// be downloaded from, for example a presigned URL.
+	Put(ctx context.Context, key string, data []byte) (string, error)
+}
+
+// OffloadLargeResponses is a Handler that uploads the response payloads larger
+// than threshold bytes to the ObjectStore, instead of returning them to the
+// client. The payload is replaced with the download URL, which is also set in
+// the Response Metadata (see OffloadURLHeader) together with the size of the
+// original payload (see OffloadSizeHeader). The payload is stored under the
+// request ID.
+// Failed responses are never offloaded. If the upload fails, the request fails
+// with error code 502 (Bad Gateway).
+func OffloadLargeResponses(store ObjectStore, threshold int) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			if err := middleware(ctx, req, resp); err != nil {
+				return err
+			}
+			if (resp.Error != nil && *resp.Error) || len(resp.Payload) <= threshold {
+				return nil
+			}
+
+			key := req.ID
+			if key == "" {
+				key = GenerateRandomString(12)
+			}
+			size := len(resp.Payload)
+			url, err := store.Put(ctx, key, []byte(resp.Payload))
+			if err != nil {
+				log.Println("Offload: Failed to upload response: ", err.Error())
+				setErrorResponse(resp, 502, "failed to offload response")
+				return nil
+			}
+			resp.Payload = url
+			resp.SetMetadata(OffloadURLHeader, url)
+			resp.SetMetadata(OffloadSizeHeader, strconv.Itoa(size))
+			return nil
+		}
+	}
+}
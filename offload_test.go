@@ -0,0 +1,76 @@
+package processagent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeStore is an ObjectStore keeping the objects in memory.
+type fakeStore struct {
+	objects map[string][]byte
+	err     error
+}
+
+func (f *fakeStore) Put(ctx context.Context, key string, data []byte) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	f.objects[key] = data
+	return "https://store.example.com/" + key + "?signature=abc", nil
+}
+
+func TestOffloadLargeResponses(t *testing.T) {
+	store := &fakeStore{objects: map[string][]byte{}}
+	payload := ""
+	middleware := OffloadLargeResponses(store, 10)(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = payload
+		return nil
+	})
+
+	payload = "small"
+	resp := &Response{}
+	middleware(context.Background(), &Request{ID: "small-id"}, resp)
+	if resp.Payload != "small" || resp.Metadata[OffloadURLHeader] != "" || len(store.objects) != 0 {
+		t.Fatal("Expected the small response to be returned inline, but got: ", resp.Payload)
+	}
+
+	payload = strings.Repeat("large", 10)
+	resp = &Response{}
+	middleware(context.Background(), &Request{ID: "large-id"}, resp)
+	url := "https://store.example.com/large-id?signature=abc"
+	if resp.Payload != url || resp.Metadata[OffloadURLHeader] != url {
+		t.Fatal("Expected the large response to be replaced with the URL, but got: ", resp.Payload)
+	}
+	if resp.Metadata[OffloadSizeHeader] != "50" {
+		t.Fatal("Expected the size of the offloaded response, but got: ", resp.Metadata[OffloadSizeHeader])
+	}
+	if string(store.objects["large-id"]) != payload {
+		t.Fatal("Expected the large response to be uploaded, but got: ", string(store.objects["large-id"]))
+	}
+}
+
+func TestOffloadLargeResponsesFailures(t *testing.T) {
+	store := &fakeStore{objects: map[string][]byte{}}
+	middleware := OffloadLargeResponses(store, 1)(func(ctx context.Context, req *Request, resp *Response) error {
+		setErrorResponse(resp, 500, "a long error message")
+		return nil
+	})
+	resp := &Response{}
+	middleware(context.Background(), &Request{ID: "id"}, resp)
+	if resp.Payload != "a long error message" || len(store.objects) != 0 {
+		t.Fatal("Expected the failed response not to be offloaded.")
+	}
+
+	store.err = fmt.Errorf("unavailable")
+	middleware = OffloadLargeResponses(store, 1)(func(ctx context.Context, req *Request, resp *Response) error {
+		resp.Payload = "large response"
+		return nil
+	})
+	resp = &Response{}
+	middleware(context.Background(), &Request{ID: "id"}, resp)
+	if resp.Error == nil || *resp.ErrorCode != 502 {
+		t.Fatal("Expected 502 when the upload fails, but got: ", resp.Payload)
+	}
+}
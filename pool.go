@@ -0,0 +1,81 @@
+package processagent
+
+import (
+	"sync"
+)
+
+// WorkerPool runs tasks on a fixed number of worker goroutines, so the number
+// of goroutines stays bounded regardless of the number of incoming requests.
+// Tasks submitted while all workers are busy wait in a bounded queue. Tasks
+// over the capacity of the queue are rejected, so the agent degrades
+// gracefully under a flood of requests instead of running out of memory.
+type WorkerPool struct {
+	size   int
+	tasks  chan func()
+	closed bool
+	lock   sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// NewWorkerPool creates a WorkerPool with size workers and a queue for up to
+// queueSize waiting tasks, and starts the workers.
+func NewWorkerPool(size, queueSize int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	pool := &WorkerPool{
+		size:  size,
+		tasks: make(chan func(), queueSize),
+	}
+	pool.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// Capacity returns the maximal number of tasks the pool holds at once: the
+// tasks run by the workers and the tasks waiting in the queue.
+func (p *WorkerPool) Capacity() int {
+	return p.size + cap(p.tasks)
+}
+
+// work runs the tasks until the pool is closed.
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		task()
+	}
+}
+
+// Submit submits the task to be run by a worker. Does not block: returns false
+// if the task is rejected because all workers are busy and the queue is full,
+// or because the pool is closed.
+func (p *WorkerPool) Submit(task func()) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting new tasks and waits until the workers finish the tasks
+// already submitted.
+func (p *WorkerPool) Close() {
+	p.lock.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+	p.lock.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,93 @@
+package processagent
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := NewWorkerPool(4, 8)
+	release := make(chan bool)
+	var ran int32
+
+	before := runtime.NumGoroutine()
+	accepted := 0
+	for i := 0; i < 1000; i++ {
+		if pool.Submit(func() {
+			<-release
+			atomic.AddInt32(&ran, 1)
+		}) {
+			accepted++
+		}
+	}
+	// the workers may not have picked their first tasks yet, so the queue may
+	// fill up before them
+	if accepted < 8 || accepted > 12 {
+		t.Fatal("Expected the tasks over the workers and the queue to be rejected, but accepted: ", accepted)
+	}
+	if goroutines := runtime.NumGoroutine(); goroutines > before {
+		t.Fatalf("Expected no new goroutines under load, but got %d (before %d).", goroutines, before)
+	}
+
+	close(release)
+	pool.Close()
+	if int(atomic.LoadInt32(&ran)) != accepted {
+		t.Fatal("Expected all accepted tasks to run before Close returns, but ran: ", ran)
+	}
+	if pool.Submit(func() {}) {
+		t.Fatal("Expected a closed pool to reject tasks.")
+	}
+}
+
+func TestWorkerPoolConcurrency(t *testing.T) {
+	pool := NewWorkerPool(3, 100)
+	defer pool.Close()
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		pool.Submit(func() {
+			defer wg.Done()
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			time.Sleep(time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+		})
+	}
+	wg.Wait()
+	if maxRunning > 3 {
+		t.Fatal("Expected at most 3 tasks to run at once, but got: ", maxRunning)
+	}
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	pool := NewWorkerPool(runtime.NumCPU(), 1024)
+	defer pool.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < b.N; i++ {
+		wg.Add(1)
+		for !pool.Submit(wg.Done) {
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+}
+
+func TestWorkerPoolCapacity(t *testing.T) {
+	pool := NewWorkerPool(4, 8)
+	defer pool.Close()
+	if pool.Capacity() != 12 {
+		t.Fatal("Expected the capacity of the workers and the queue, but got: ", pool.Capacity())
+	}
+}
@@ -3,13 +3,20 @@ package processagent
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
 // ProcessAgent defines an interface for the external processes execution and
@@ -30,6 +37,23 @@ type ProcessAgent interface {
 	ProcessCommand(req *Request, resp *Response) (err error)
 }
 
+// contextProcessAgent is a ProcessAgent that can process a Request within a
+// context, so the processing stops when the request is canceled or its deadline
+// passes.
+type contextProcessAgent interface {
+	ProcessCommandContext(ctx context.Context, req *Request, resp *Response) error
+}
+
+// processCommandContext processes the Request with the agent within the given
+// context, if the agent supports it (see contextProcessAgent). Otherwise the
+// context is not passed on.
+func processCommandContext(ctx context.Context, agent ProcessAgent, req *Request, resp *Response) error {
+	if ctxAgent, ok := agent.(contextProcessAgent); ok {
+		return ctxAgent.ProcessCommandContext(ctx, req, resp)
+	}
+	return agent.ProcessCommand(req, resp)
+}
+
 // processEvent defines a function that reacts to process events, such as
 // process start and process end.
 type processEvent func(pw *processWrapper)
@@ -38,18 +62,148 @@ type processEvent func(pw *processWrapper)
 type processWrapper struct {
 	cmd           *exec.Cmd
 	stdin         io.Reader
-	stdout        *bytes.Buffer
+	stdout        *syncBuffer
 	stderr        *bytes.Buffer
 	processStarts processEvent
 	processEnds   processEvent
 	running       bool
+	started       time.Time
+	inputFD       int
+	outputFD      int
+	framed        bool
+	stdinOptions  StdinOptions
+	nice          int
+	niceFailed    func(err error)
+	pty           bool
+	runAs         *runAs
+	maxOutput     int64
+	preExec       func(cmd *exec.Cmd) error
+	allowlist     []string
+	timeout       time.Duration
+	stderrAsError bool
+	errOutput     string
+	// state is the state of the process once exec has waited on it to exit.
+	// Nil if the process did not start, or was left running in the
+	// background, when the state must not be read from cmd.
+	state     *os.ProcessState
+	overLimit bool
+	timedOut  bool
+	lock      sync.Mutex
+}
+
+// StdinOptions defines how the Request payload is normalized before it is
+// written to the process STDIN.
+type StdinOptions struct {
+	// TrimSpace removes the leading and trailing whitespace from the payload.
+	TrimSpace bool
+	// EnsureNewline appends a newline to the payload, unless it already ends
+	// with one. Line-oriented tools may block waiting for input until they
+	// receive a newline.
+	EnsureNewline bool
+	// Delivery defines how the payload is written to STDIN: all at once (the
+	// default), in chunks of ChunkSize bytes or line by line. Interactive
+	// processes can start working on each part as soon as it is received.
+	// Applies to STDIN only, not to the input file descriptor or the PTY.
+	Delivery StdinDelivery
+	// ChunkSize is the size of the chunks in bytes, with StdinChunks delivery.
+	ChunkSize int
+	// Interval is the pause between writing the chunks or lines. If 0, the
+	// parts are written one after another, as fast as the process reads them.
+	Interval time.Duration
+}
+
+// StdinDelivery defines how the payload is written to the process STDIN.
+type StdinDelivery int
+
+const (
+	// StdinAll writes the whole payload at once.
+	StdinAll StdinDelivery = iota
+	// StdinChunks writes the payload in fixed-size chunks.
+	StdinChunks
+	// StdinLines writes the payload line by line.
+	StdinLines
+)
+
+// ParseStdinDelivery parses the name of a StdinDelivery: "all", "chunks" or
+// "lines".
+func ParseStdinDelivery(name string) (StdinDelivery, error) {
+	switch name {
+	case "all":
+		return StdinAll, nil
+	case "chunks":
+		return StdinChunks, nil
+	case "lines":
+		return StdinLines, nil
+	}
+	return StdinAll, fmt.Errorf("unknown stdin delivery: %s", name)
+}
+
+// split splits the payload into the parts written to STDIN one by one.
+func (o StdinOptions) split(payload string) []string {
+	parts := []string{}
+	switch {
+	case o.Delivery == StdinChunks && o.ChunkSize > 0:
+		for len(payload) > o.ChunkSize {
+			parts = append(parts, payload[:o.ChunkSize])
+			payload = payload[o.ChunkSize:]
+		}
+	case o.Delivery == StdinLines:
+		for {
+			end := strings.IndexByte(payload, '\n')
+			if end < 0 {
+				break
+			}
+			parts = append(parts, payload[:end+1])
+			payload = payload[end+1:]
+		}
+	}
+	if payload != "" {
+		parts = append(parts, payload)
+	}
+	return parts
+}
+
+// writeParts writes the parts of the payload to the process input, pausing
+// for the interval between them, then closes the input. Stops writing as soon
+// as exited is closed, as the process may exit before reading its whole input.
+func (o StdinOptions) writeParts(input io.WriteCloser, parts []string, exited <-chan struct{}) {
+	defer input.Close()
+	for i, part := range parts {
+		if i > 0 && o.Interval > 0 {
+			select {
+			case <-exited:
+				return
+			case <-time.After(o.Interval):
+			}
+		}
+		select {
+		case <-exited:
+			return
+		default:
+		}
+		if _, err := io.WriteString(input, part); err != nil {
+			// the process has exited or closed its input
+			return
+		}
+	}
+}
+
+// normalize applies the options to the payload.
+func (o StdinOptions) normalize(payload string) string {
+	if o.TrimSpace {
+		payload = strings.TrimSpace(payload)
+	}
+	if o.EnsureNewline && !strings.HasSuffix(payload, "\n") {
+		payload += "\n"
+	}
+	return payload
 }
 
 // runProcess runs a single process. The executable is specified by execStr and
 // the Request is passed down to the external process on STDIN of the process.
 // The execStr is tokenized into arguments, of which the first is the executable
 // and the rest (if any) are passed as arguments to the process.
-func (w *processWrapper) runProcess(req *Request, execStr string) (string, error) {
+func (w *processWrapper) runProcess(ctx context.Context, req *Request, execStr string) (string, error) {
 	execStr = strings.TrimSpace(execStr)
 	if execStr == "" {
 		return "", fmt.Errorf("no exec specified")
@@ -58,14 +212,25 @@ func (w *processWrapper) runProcess(req *Request, execStr string) (string, error
 	if err != nil {
 		return "", err
 	}
+	return w.runArgs(ctx, req, args)
+}
+
+// runArgs runs a single process like runProcess, but with the executable and
+// the arguments already split, so no tokenization is done.
+func (w *processWrapper) runArgs(ctx context.Context, req *Request, args []string) (string, error) {
+	if len(args) == 0 || args[0] == "" {
+		return "", fmt.Errorf("no exec specified")
+	}
 	executable := args[0]
-	if len(args) > 1 {
-		args = args[1:]
-	} else {
-		args = []string{}
+	args = args[1:]
+	if w.allowlist != nil {
+		if err := checkExecutable(executable, w.allowlist); err != nil {
+			log.Println("ProcessAgent: Denied running executable: ", err.Error())
+			return "", err
+		}
 	}
 
-	outStr, errStr := w.exec(req.Payload, executable, args)
+	outStr, errStr := w.exec(ctx, w.stdinOptions.normalize(req.Payload), executable, args)
 	if errStr != "" {
 		return "", fmt.Errorf(errStr)
 	}
@@ -73,57 +238,260 @@ func (w *processWrapper) runProcess(req *Request, execStr string) (string, error
 	return outStr, nil
 }
 
+// checkExecutable resolves the executable (in PATH, if not a path) and checks
+// that its absolute path is in the allowlist.
+func checkExecutable(executable string, allowlist []string) error {
+	resolved, err := exec.LookPath(executable)
+	if err != nil {
+		return fmt.Errorf("executable %q not allowed: %s", executable, err.Error())
+	}
+	if resolved, err = filepath.Abs(resolved); err != nil {
+		return fmt.Errorf("executable %q not allowed: %s", executable, err.Error())
+	}
+	for _, allowed := range allowlist {
+		if filepath.Clean(allowed) == resolved {
+			return nil
+		}
+	}
+	return fmt.Errorf("executable %q (%s) not allowed: not in the allowlist", executable, resolved)
+}
+
 // callEnd is called when the external process terminates.
 func (w *processWrapper) callEnd() {
-	if w.running {
-		w.running = false
-		if w.processEnds != nil {
-			w.processEnds(w)
-		}
+	w.lock.Lock()
+	wasRunning := w.running
+	w.running = false
+	w.lock.Unlock()
+	if wasRunning && w.processEnds != nil {
+		w.processEnds(w)
 	}
 }
 
+// isRunning checks whether the external process is running.
+func (w *processWrapper) isRunning() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.running
+}
+
 // exec executes an external process. The process command is specified via
 // the executable parameter and any arguments are passed via args.
 // An additional input is passed down to the process via the STDIN on the
 // external process.
 // The function returns whatever the external process prints on the STDOUT and
 // STDERR.
-func (w *processWrapper) exec(input string, executable string, args []string) (outStr, errStr string) {
+// If framed output is configured, only a single frame is read from STDOUT and
+// the process is killed once the frame has been read.
+func (w *processWrapper) exec(ctx context.Context, input string, executable string, args []string) (outStr, errStr string) {
+	w.lock.Lock()
 	if w.running {
+		w.lock.Unlock()
 		return "", "already running"
 	}
 	w.running = true
-	w.cmd = exec.Command(executable, args...)
+	w.lock.Unlock()
+	var execCtx context.Context
+	var cancel context.CancelFunc
+	if w.timeout > 0 {
+		execCtx, cancel = context.WithTimeout(context.Background(), w.timeout)
+	} else {
+		execCtx, cancel = context.WithCancel(context.Background())
+	}
+	// the process is killed when the context is done, see exec.CommandContext
+	w.cmd = exec.CommandContext(execCtx, executable, args...)
+	defer cancel()
+	// the process is killed when the request is canceled
+	returned := make(chan struct{})
+	defer close(returned)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-returned:
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		w.cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", DeadlineEnv, remainingMillis(deadline)))
+	}
+	if w.runAs != nil {
+		if err := setCredential(w.cmd, w.runAs.uid, w.runAs.gid); err != nil {
+			return "", err.Error()
+		}
+	}
 	w.stdin = strings.NewReader(input)
 	w.cmd.Stdin = w.stdin
-	w.cmd.Stdout = w.stdout
-	w.cmd.Stderr = w.stderr
+	var stdout, stderr io.Writer = w.stdout, w.stderr
+	if w.maxOutput > 0 {
+		stdout = &limitWriter{writer: w.stdout, max: w.maxOutput, exceeded: w.outputLimitExceeded}
+		stderr = &limitWriter{writer: w.stderr, max: w.maxOutput, exceeded: w.outputLimitExceeded}
+	}
+	w.cmd.Stdout = stdout
+	w.cmd.Stderr = stderr
 
-	defer func() {
-		w.callEnd()
-	}()
+	defer w.callEnd()
+
+	pipes, err := w.configureFDs(input)
+	if err != nil {
+		return "", err.Error()
+	}
+	pipes.output = stdout
+
+	var stdinPipe io.WriteCloser
+	if w.stdinOptions.Delivery != StdinAll && w.cmd.Stdin != nil && !w.pty {
+		w.cmd.Stdin = nil
+		if stdinPipe, err = w.cmd.StdinPipe(); err != nil {
+			return "", err.Error()
+		}
+	}
+
+	var framedOutput, stdoutPipe io.Reader
+	var ptyMaster, ptySlave *os.File
+	if w.pty {
+		if w.inputFD != 0 || w.outputFD != 0 || w.framed {
+			return "", "PTY cannot be combined with file descriptors or framed output"
+		}
+		if ptyMaster, ptySlave, err = attachPTY(w.cmd); err != nil {
+			return "", err.Error()
+		}
+		defer ptyMaster.Close()
+		stdoutPipe = ptyOutput(ptyMaster)
+	} else if w.framed {
+		if w.outputFD != 0 {
+			return "", "framed output is supported only on STDOUT"
+		}
+		w.cmd.Stdout = nil
+		if framedOutput, err = w.cmd.StdoutPipe(); err != nil {
+			return "", err.Error()
+		}
+	} else if w.outputFD == 0 {
+		w.cmd.Stdout = nil
+		if stdoutPipe, err = w.cmd.StdoutPipe(); err != nil {
+			return "", err.Error()
+		}
+	}
+
+	if w.preExec != nil {
+		if w.cmd.Env == nil {
+			w.cmd.Env = os.Environ()
+		}
+		if err := w.preExec(w.cmd); err != nil {
+			pipes.close()
+			if ptySlave != nil {
+				ptySlave.Close()
+			}
+			return "", fmt.Sprintf("pre-exec hook failed: %s", err.Error())
+		}
+	}
 
 	if err := w.cmd.Start(); err != nil {
+		pipes.close()
+		if ptySlave != nil {
+			ptySlave.Close()
+		}
 		return "", err.Error()
 	}
+	w.started = time.Now()
+	pipes.start()
+	// closed once the process has exited
+	exited := make(chan struct{})
+	if stdinPipe != nil {
+		go w.stdinOptions.writeParts(stdinPipe, w.stdinOptions.split(input), exited)
+	}
+	if ptySlave != nil {
+		ptySlave.Close()
+		go writePTYInput(ptyMaster, input)
+	}
+
+	// the output is copied continuously, so whatever the process wrote is
+	// available in the buffer even if the process gets killed.
+	var copied chan error
+	if stdoutPipe != nil {
+		copied = make(chan error, 1)
+		go func() {
+			_, err := io.Copy(stdout, stdoutPipe)
+			copied <- err
+		}()
+	}
+
+	if w.nice != 0 {
+		if err := setNice(w.cmd.Process.Pid, w.nice); err != nil && w.niceFailed != nil {
+			w.niceFailed(err)
+		}
+	}
 
 	if w.processStarts != nil {
 		go w.processStarts(w)
 	}
 
-	if err := w.cmd.Wait(); err != nil {
-		return "", err.Error()
+	if framedOutput != nil {
+		outStr, errStr = w.readFramedOutput(framedOutput, exited)
+		if errStr != "" && w.checkTimeout(execCtx) {
+			return "", fmt.Sprintf("process timed out after %s", w.timeout)
+		}
+		return outStr, errStr
 	}
 
-	errStr = w.stderr.String()
-	if errStr != "" {
-		return "", errStr
+	if copied != nil {
+		// the pipe must be read completely before calling Wait
+		<-copied
 	}
 
-	outStr = w.stdout.String()
+	// the input not read by the process is discarded: a process may exit
+	// successfully without reading its whole input (like head), the exit
+	// status alone decides the outcome
+	waitErr := w.cmd.Wait()
+	w.state = w.cmd.ProcessState
+	close(exited)
+	if err := pipes.wait(); err != nil && waitErr == nil {
+		waitErr = err
+	}
+	w.errOutput = w.stderr.String()
+	if w.exceededOutput() {
+		return "", fmt.Sprintf("process output exceeds the limit of %d bytes", w.maxOutput)
+	}
+	if waitErr != nil && w.checkTimeout(execCtx) {
+		return "", fmt.Sprintf("process timed out after %s", w.timeout)
+	}
+	if waitErr != nil {
+		return "", waitErr.Error()
+	}
 
-	return outStr, errStr
+	// the exit status decides the outcome, the process may write warnings or
+	// progress to STDERR and still succeed
+	if w.stderrAsError && w.errOutput != "" {
+		return "", w.errOutput
+	}
+
+	return w.stdout.String(), ""
+}
+
+// DeadlineEnv is the name of the environment variable holding the time
+// remaining (in milliseconds) until the deadline of the request, when the
+// request has a deadline. Processes can use it to adapt their work to the
+// available time.
+const DeadlineEnv = "PA_DEADLINE_MS"
+
+// remainingMillis returns the milliseconds remaining until the deadline, or 0
+// if the deadline has passed.
+func remainingMillis(deadline time.Time) int64 {
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		return 0
+	}
+	return int64(remaining / time.Millisecond)
+}
+
+// ptyEOF is the end-of-file character of the terminal (Ctrl-D).
+const ptyEOF = "\x04"
+
+// writePTYInput writes the input to the terminal, followed by an end-of-file,
+// so the process reading the input gets EOF once the input is read.
+func writePTYInput(master io.Writer, input string) {
+	if input != "" && !strings.HasSuffix(input, "\n") {
+		// flushes the incomplete last line first
+		input += ptyEOF
+	}
+	io.WriteString(master, input+ptyEOF)
 }
 
 // stopProcess terminates the external process. The process is signaled with
@@ -132,7 +500,7 @@ func (w *processWrapper) stopProcess() error {
 	defer func() {
 		w.callEnd()
 	}()
-	if !w.running {
+	if !w.isRunning() {
 		// don't try to stop the process
 		return nil
 	}
@@ -145,6 +513,92 @@ func (w *processWrapper) stopProcess() error {
 	return nil
 }
 
+// outputLimitExceeded is called when the process writes more than the maximal
+// output size. Kills the process, so it does not keep producing output that
+// would be discarded anyway.
+func (w *processWrapper) outputLimitExceeded() {
+	w.lock.Lock()
+	first := !w.overLimit
+	w.overLimit = true
+	w.lock.Unlock()
+	if first {
+		if err := w.cmd.Process.Kill(); err != nil {
+			log.Println("ProcessAgent: Failed to kill process over the output limit: ", err.Error())
+		}
+	}
+}
+
+// exceededOutput checks whether the process was killed for writing more than
+// the maximal output size.
+func (w *processWrapper) exceededOutput() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.overLimit
+}
+
+// checkTimeout checks whether the process has been killed because it ran
+// longer than the timeout, given the context the process runs with, and
+// records it, see hasTimedOut.
+func (w *processWrapper) checkTimeout(execCtx context.Context) bool {
+	if w.timeout <= 0 || execCtx.Err() != context.DeadlineExceeded {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.timedOut = true
+	return true
+}
+
+// hasTimedOut checks whether the process has been killed on timeout.
+func (w *processWrapper) hasTimedOut() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.timedOut
+}
+
+// errOutputLimit is returned when writing more than the maximal output size.
+var errOutputLimit = fmt.Errorf("output limit exceeded")
+
+// limitWriter writes up to max bytes to the underlying writer. Once the limit
+// is exceeded, exceeded is called and any further write fails with
+// errOutputLimit, which stops the copying of the output.
+type limitWriter struct {
+	writer   io.Writer
+	max      int64
+	written  int64
+	exceeded func()
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.written+int64(len(p)) <= l.max {
+		n, err := l.writer.Write(p)
+		l.written += int64(n)
+		return n, err
+	}
+	n, _ := l.writer.Write(p[:l.max-l.written])
+	l.written += int64(n)
+	l.exceeded()
+	return n, errOutputLimit
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writing and reading.
+type syncBuffer struct {
+	buffer bytes.Buffer
+	lock   sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
 // newProcessWrapper creates new process wrapper with the given callback handlers
 // for process start and process end.
 // onStart is called right after the process starts and everything is set up.
@@ -153,48 +607,298 @@ func (w *processWrapper) stopProcess() error {
 func newProcessWrapper(onStart, onEnd processEvent) *processWrapper {
 	return &processWrapper{
 		stderr:        &bytes.Buffer{},
-		stdout:        &bytes.Buffer{},
+		stdout:        &syncBuffer{},
 		processEnds:   onEnd,
 		processStarts: onStart,
 	}
 }
 
+// DrainMode defines how the running processes are handled when the agent is
+// shut down.
+type DrainMode int
+
+const (
+	// DrainTerminate terminates all running processes immediately.
+	DrainTerminate DrainMode = iota
+	// DrainFinish lets the running processes finish naturally, up to the drain
+	// deadline, before terminating the remaining ones.
+	DrainFinish
+)
+
+// ParseDrainMode parses the name of the DrainMode: "terminate" or "finish".
+func ParseDrainMode(name string) (DrainMode, error) {
+	switch name {
+	case "terminate":
+		return DrainTerminate, nil
+	case "finish":
+		return DrainFinish, nil
+	}
+	return DrainTerminate, fmt.Errorf("unknown drain mode: %s", name)
+}
+
 // LocalProcessAgent holds the configuration for running local processes.
 // It always runs the same executable (the same command) configurable via
 // execCommand field.
 // If maxParallel is specified (not 0), then it limits the number of processes
 // running at the same time to this number.
+// By default, the Request payload is passed on the process STDIN and the output
+// is read from the process STDOUT. If InputFD or OutputFD is set, the payload is
+// passed or the output is read on that file descriptor instead (must be 3 or
+// greater).
+// Failures are logged with a DedupLogger, so repeated identical errors do not
+// flood the log.
 type LocalProcessAgent struct {
 	execCommand string
+	// execArgs is the command split into the executable and its arguments. If
+	// set, it is used instead of execCommand.
+	execArgs    []string
 	maxParallel int
 	running     map[int]*processWrapper
 	lock        sync.Mutex
+	logger      *DedupLogger
+	// shutdownOnce guards the shutdown, so it is executed only once.
+	shutdownOnce sync.Once
+	// niceWarning guards the warning logged when the niceness cannot be set,
+	// so it is logged only once.
+	niceWarning sync.Once
+	// runAs is the user and group the processes run as, see RunAs.
+	runAs *runAs
+	// nextSpawn is the earliest time the next process can be started, when
+	// MaxSpawnsPerSecond is set. Guarded by spawnLock.
+	nextSpawn time.Time
+	spawnLock sync.Mutex
+	// avgDuration is the moving average of the duration of the processes,
+	// used to estimate when a worker frees up. Guarded by lock.
+	avgDuration time.Duration
+	// cpu accounts the CPU time used by the processes, when MaxCPUShare is
+	// set.
+	cpu cpuAccount
+	// shutdownHooks are run on shutdown, see OnShutdown. Guarded by lock.
+	shutdownHooks []func() error
+	// startErr is the error of the start command, see Start. Guarded by lock.
+	startErr error
+	// closing is set once the shutdown has started. Guarded by lock.
+	closing bool
+
+	// InputFD is the file descriptor on which the payload is passed to the
+	// process. If 0, the payload is passed on STDIN.
+	InputFD int
+	// OutputFD is the file descriptor from which the output of the process is
+	// read. If 0, the output is read from STDOUT.
+	OutputFD int
+	// FramedOutput configures the agent to read a single length-prefixed frame
+	// from the process STDOUT as a response, instead of reading until the
+	// process exits. The process is killed once the frame has been read. See
+	// readFrame for the frame format.
+	FramedOutput bool
+	// MaxErrorLength is the maximal length in bytes of the error message
+	// returned in the Response when the process fails, and of the STDERR output
+	// returned in the Response. Longer messages are truncated on a character
+	// boundary, while the full error message is still logged. If 0, the
+	// messages are not truncated.
+	MaxErrorLength int
+	// Stdin holds the options for normalizing the payload written to the
+	// process STDIN.
+	Stdin StdinOptions
+	// Nice is the niceness (scheduling priority) of the processes, from -20
+	// (highest priority) to 19 (lowest priority). If 0, the processes run with
+	// the same priority as the agent. The priority is set once the process has
+	// started. If it cannot be set (for example, a negative niceness without
+	// the privileges), the processes run with the default priority and a
+	// warning is logged once. Supported on Linux only.
+	Nice int
+	// MaxSpawnsPerSecond limits the rate at which new processes are started,
+	// independently of the number of processes running at the same time. The
+	// process starts are spread evenly, so a burst of requests waits for its
+	// turn instead of starting all processes at once. If 0, the rate is not
+	// limited.
+	MaxSpawnsPerSecond int
+	// PTY runs the processes attached to a pseudo-terminal, for tools that
+	// behave differently when not run in a terminal. The payload is written and
+	// the output is read through the terminal. The terminal processes the input
+	// line by line, so lines longer than 4096 bytes are truncated. Cannot be
+	// combined with InputFD, OutputFD or FramedOutput. Supported on Linux only.
+	PTY bool
+	// MaxOutputSize is the maximal size in bytes of the process output, on
+	// STDOUT (or the output file descriptor) and on STDERR each. A process
+	// writing more is killed right away and the request fails. If 0, the
+	// output size is not limited. Framed output is not limited by this option.
+	MaxOutputSize int64
+	// ReportUsage enables reporting of the resources used by the finished
+	// process (the CPU time and, where supported, the maximal resident set
+	// size) in the Response Metadata, see MetadataCPUTime and MetadataMaxRSS.
+	ReportUsage bool
+	// PreExec is called for each request just before the process is started,
+	// with the command about to run. It can adjust the arguments, the
+	// environment (cmd.Env is already populated with the environment of the
+	// agent) or the working directory of the process based on the Request. If
+	// it returns an error, the process is not started and the request fails.
+	PreExec func(req *Request, cmd *exec.Cmd) error
+	// MaxCPUShare caps the share of the host CPU capacity (from 0 to 1, where 1
+	// is all CPUs fully used) that the processes may use together. While the
+	// running processes use more, new processes are not started: the requests
+	// wait until the usage drops, or fail with error code 503 (Service
+	// Unavailable) if their context is done first. The usage is sampled on
+	// Linux only, on other platforms the processes are never throttled. If 0,
+	// the CPU usage is not capped.
+	MaxCPUShare float64
+	// ExecutableAllowlist restricts the executables the agent may run to the
+	// given absolute paths. The executable of the command is resolved (looked
+	// up in PATH, if not a path) before each run, and if it is not in the
+	// allowlist the process is not started, the request fails and the attempt
+	// is logged. If nil, any executable may run.
+	ExecutableAllowlist []string
+	// Timeout is the maximal time a process may run. A process still running
+	// after the timeout is killed (with SIGKILL) and the request fails with
+	// error code 504 (Gateway Timeout). If 0, the processes may run for as long
+	// as they need.
+	Timeout time.Duration
+	// OnStartCommand is a command run once when the agent starts (see Start),
+	// before any request is processed, for example to set up the environment
+	// of the processes. If it fails, the agent does not start.
+	OnStartCommand string
+	// OnStopCommand is a command run once when the agent shuts down, after the
+	// running processes have finished or have been terminated, for example to
+	// clean up after the processes.
+	OnStopCommand string
+	// StderrAsError fails the request when the process writes anything to
+	// STDERR, even if it exits successfully, with the STDERR output as the
+	// error. Kept for compatibility; by default only the exit status of the
+	// process decides whether the request fails.
+	StderrAsError bool
 }
 
 // GetMiddleware returns a middleware that can be attached to a given InputPort
 // to handle Request by running a local process with this process agent.
 func (p *LocalProcessAgent) GetMiddleware() Middleware {
 	return func(ctx context.Context, req *Request, resp *Response) error {
-		return p.ProcessCommand(req, resp)
+		return p.ProcessCommandContext(ctx, req, resp)
 	}
 }
 
-// Stop shuts down all currently running processes.
+// Stop shuts down all currently running processes. Same as Shutdown with
+// DrainTerminate.
 func (p *LocalProcessAgent) Stop() error {
+	return p.Shutdown(context.Background(), DrainTerminate)
+}
+
+// Shutdown shuts down the agent, handling the currently running processes
+// according to the given DrainMode.
+// With DrainFinish, the running processes are given time to finish until the
+// ctx is done (the drain deadline) and then the remaining processes are
+// terminated. With DrainTerminate, all processes are terminated immediately.
+// Once the shutdown has started, new requests are rejected with error code 503
+// (Service Unavailable), so no new processes start while draining.
+// Shutdown is safe to call multiple times and concurrently. Only the first call
+// shuts down the agent, any other call blocks until the shutdown completes.
+func (p *LocalProcessAgent) Shutdown(ctx context.Context, mode DrainMode) error {
+	p.shutdownOnce.Do(func() {
+		p.lock.Lock()
+		p.closing = true
+		p.lock.Unlock()
+		if mode == DrainFinish {
+			p.waitProcesses(ctx)
+		}
+		for pid, pw := range p.runningProcesses() {
+			if err := pw.stopProcess(); err != nil {
+				log.Printf("Process with pid %d failed to stop: %s\n", pid, err.Error())
+			}
+		}
+		p.cpu.close()
+		if p.OnStopCommand != "" {
+			if err := runLifecycleCommand("stop", p.OnStopCommand); err != nil {
+				log.Println("ProcessAgent: ", err.Error())
+			}
+		}
+		p.lock.Lock()
+		hooks := p.shutdownHooks
+		p.lock.Unlock()
+		for _, hook := range hooks {
+			if err := hook(); err != nil {
+				log.Println("ProcessAgent: Shutdown hook failed: ", err.Error())
+			}
+		}
+		p.logger.Flush()
+	})
+	return nil
+}
+
+// isClosing checks if the shutdown of the agent has started.
+func (p *LocalProcessAgent) isClosing() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.closing
+}
+
+// OnShutdown registers a hook run on shutdown, after the running processes have
+// finished or have been terminated. Use it to flush the buffered data recorded
+// for the last requests (like the entries of a BatchWriter, by its Close), so it
+// is not lost when the agent exits. The hooks run in the order they were
+// registered, and their errors are logged.
+func (p *LocalProcessAgent) OnShutdown(hook func() error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.shutdownHooks = append(p.shutdownHooks, hook)
+}
+
+// runningProcesses returns a snapshot of the currently running processes.
+func (p *LocalProcessAgent) runningProcesses() map[int]*processWrapper {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	running := map[int]*processWrapper{}
 	for pid, pw := range p.running {
-		if err := pw.stopProcess(); err != nil {
-			log.Printf("Process with pid %d failed to stop: %s\n", pid, err.Error())
+		running[pid] = pw
+	}
+	return running
+}
+
+// waitProcesses waits for all running processes to finish or until the ctx is
+// done, whichever comes first.
+func (p *LocalProcessAgent) waitProcesses(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(50) * time.Millisecond)
+	defer ticker.Stop()
+	for len(p.runningProcesses()) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 	}
-	return nil
 }
 
 // ProcessCommand handles a Request by running a new process.
 // If maxParallel is set, and the maximal number of currently running processes
-// is reached, then the call would return an error immediately.
+// is reached, then the request is rejected immediately with error code 429 (Too
+// Many Requests) and the estimated number of seconds until a worker frees up is
+// set in the Retry-After Response Metadata.
 func (p *LocalProcessAgent) ProcessCommand(req *Request, resp *Response) error {
-	if p.maxParallel != 0 && p.maxParallel <= len(p.running) {
-		return fmt.Errorf("max number of workers reached")
+	return p.ProcessCommandContext(context.Background(), req, resp)
+}
+
+// ProcessCommandContext is like ProcessCommand, but runs the process within the
+// given context. If the context has a deadline, the time remaining until the
+// deadline is passed to the process in the DeadlineEnv environment variable.
+// If the context is done (the request is canceled, or its deadline has passed)
+// while the process runs, the process is killed. A request past its deadline
+// fails with error code 504 (Gateway Timeout), while for a canceled request the
+// error of the context is returned. With framed output, the process is killed
+// only if the context is done before the frame has been read.
+func (p *LocalProcessAgent) ProcessCommandContext(ctx context.Context, req *Request, resp *Response) error {
+	p.lock.Lock()
+	startErr := p.startErr
+	p.lock.Unlock()
+	if startErr != nil {
+		setErrorResponse(resp, 503, startErr.Error())
+		return nil
+	}
+	if p.isClosing() {
+		setErrorResponse(resp, 503, "shutting down")
+		return nil
+	}
+	if p.maxParallel != 0 && p.maxParallel <= len(p.runningProcesses()) {
+		resp.SetMetadata("Retry-After", strconv.Itoa(p.retryAfter()))
+		setErrorResponse(resp, 429, "max number of workers reached")
+		return nil
 	}
 
 	pw := newProcessWrapper(func(pw *processWrapper) {
@@ -206,24 +910,180 @@ func (p *LocalProcessAgent) ProcessCommand(req *Request, resp *Response) error {
 		if pw.cmd.Process != nil {
 			p.lock.Lock()
 			delete(p.running, pw.cmd.Process.Pid)
+			p.recordDuration(time.Since(pw.started))
 			p.lock.Unlock()
 		}
 	})
+	pw.inputFD = p.InputFD
+	pw.outputFD = p.OutputFD
+	pw.framed = p.FramedOutput
+	pw.stdinOptions = p.Stdin
+	pw.nice = p.Nice
+	pw.niceFailed = func(err error) {
+		p.niceWarning.Do(func() {
+			p.logger.Println("ProcessAgent: Failed to set process niceness, the processes run with the default priority. Error:", err.Error())
+		})
+	}
+	pw.pty = p.PTY
+	pw.runAs = p.runAs
+	pw.maxOutput = p.MaxOutputSize
+	pw.allowlist = p.ExecutableAllowlist
+	pw.timeout = p.Timeout
+	pw.stderrAsError = p.StderrAsError
+	if p.PreExec != nil {
+		pw.preExec = func(cmd *exec.Cmd) error {
+			return p.PreExec(req, cmd)
+		}
+	}
 
-	output, err := pw.runProcess(req, p.execCommand)
+	// the command may be swapped while the process runs, see SetCommand
+	p.lock.Lock()
+	execCommand, execArgs := p.execCommand, p.execArgs
+	p.lock.Unlock()
+
+	if !p.waitCPU(ctx) {
+		setErrorResponse(resp, 503, "CPU cap exceeded")
+		return nil
+	}
+	p.waitSpawn(ctx)
+	if ctx.Err() != nil {
+		return contextErrorResponse(ctx, resp)
+	}
+	if p.isClosing() {
+		// the shutdown started while waiting to spawn
+		setErrorResponse(resp, 503, "shutting down")
+		return nil
+	}
+	var output string
+	var err error
+	if execArgs != nil {
+		output, err = pw.runArgs(ctx, req, execArgs)
+	} else {
+		output, err = pw.runProcess(ctx, req, execCommand)
+	}
 	resp.Payload = output
+	resp.Stderr = truncateError(pw.errOutput, p.MaxErrorLength)
+	// the state is read only from the wrapper: a process left running in the
+	// background is still being waited on
+	if pw.state != nil {
+		setExitCode(resp, pw.state)
+		if p.ReportUsage {
+			setUsageMetadata(resp, pw.state)
+		}
+		if p.MaxCPUShare > 0 {
+			p.cpu.processEnded(pw.state.Pid(), pw.state)
+		}
+	}
 
+	if err != nil && ctx.Err() != nil {
+		// killed because the request has been canceled or is past its deadline
+		p.logger.Println("ProcessAgent: Process canceled. Error:", ctx.Err().Error())
+		return contextErrorResponse(ctx, resp)
+	}
 	if err != nil {
-		errv := true
-		errCode := 500
-		resp.Error = &errv
-		resp.ErrorCode = &errCode
-		resp.Payload = err.Error()
-		log.Println("ProcessAgent: Failed to process command. Error:", err.Error())
+		code := 500
+		if pw.hasTimedOut() {
+			code = 504
+		}
+		setErrorResponse(resp, code, truncateError(err.Error(), p.MaxErrorLength))
+		p.logger.Println("ProcessAgent: Failed to process command. Error:", err.Error())
 	}
 	return nil
 }
 
+// setExitCode sets the exit code of the process on the Response. A process
+// killed by a signal has no exit code, so it is left unset.
+func setExitCode(resp *Response, state *os.ProcessState) {
+	if code := state.ExitCode(); code >= 0 {
+		resp.ExitCode = &code
+	}
+}
+
+// RunAs configures the agent to run the processes as the given user and group
+// (names or numeric IDs), instead of the user running the agent. If the group is
+// empty, the primary group of the user is used. Returns an error if the user or
+// the group does not exist. Supported on Linux only, and usually requires the
+// agent to run as root.
+func (p *LocalProcessAgent) RunAs(username, group string) error {
+	ids, err := lookupRunAs(username, group)
+	if err != nil {
+		return err
+	}
+	p.runAs = ids
+	return nil
+}
+
+// recordDuration updates the moving average of the process duration with the
+// duration of a finished process. Must be called with the lock held.
+func (p *LocalProcessAgent) recordDuration(duration time.Duration) {
+	if p.avgDuration == 0 {
+		p.avgDuration = duration
+		return
+	}
+	// exponentially weighted, so the estimate follows changes in the workload
+	p.avgDuration = (p.avgDuration*4 + duration) / 5
+}
+
+// retryAfter estimates the number of seconds until a worker frees up: the
+// time remaining until the longest running process finishes, if it takes the
+// average process duration. Returns at least 1.
+func (p *LocalProcessAgent) retryAfter() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	wait := p.avgDuration
+	for _, pw := range p.running {
+		if remaining := p.avgDuration - time.Since(pw.started); remaining < wait {
+			wait = remaining
+		}
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// waitSpawn blocks until a new process can be started according to the
+// MaxSpawnsPerSecond rate, or until the ctx is done.
+func (p *LocalProcessAgent) waitSpawn(ctx context.Context) {
+	if p.MaxSpawnsPerSecond <= 0 {
+		return
+	}
+	p.spawnLock.Lock()
+	now := time.Now()
+	spawnAt := p.nextSpawn
+	if spawnAt.Before(now) {
+		spawnAt = now
+	}
+	p.nextSpawn = spawnAt.Add(time.Second / time.Duration(p.MaxSpawnsPerSecond))
+	p.spawnLock.Unlock()
+
+	timer := time.NewTimer(spawnAt.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// truncatedMarker is appended to truncated error messages.
+const truncatedMarker = "... (truncated)"
+
+// truncateError truncates the error message to at most maxLength bytes,
+// marking it as truncated. The message is cut on a character (rune) boundary,
+// so a multi-byte character is not split. If maxLength is 0, the message is
+// returned as is.
+func truncateError(message string, maxLength int) string {
+	if maxLength <= 0 || len(message) <= maxLength {
+		return message
+	}
+	end := maxLength
+	for end > 0 && !utf8.RuneStart(message[end]) {
+		end--
+	}
+	return message[:end] + truncatedMarker
+}
+
 // NewProcessAgent creates and configures new LocalProcessAgent with the given
 // executable command.
 // The max number of processes that can be run simultaneously is set by maxParallel.
@@ -233,7 +1093,85 @@ func NewProcessAgent(execCommand string, maxParallel int) *LocalProcessAgent {
 		execCommand: execCommand,
 		maxParallel: maxParallel,
 		running:     map[int]*processWrapper{},
+		logger:      defaultLogger(),
+	}
+}
+
+// Validate checks that the agent is configured with a command it can run: the
+// command must not be empty and must tokenize into at least the executable.
+// Call it on startup to fail fast on misconfiguration, instead of failing every
+// request.
+func (p *LocalProcessAgent) Validate() error {
+	p.lock.Lock()
+	execCommand, args := p.execCommand, p.execArgs
+	p.lock.Unlock()
+	_, err := validateCommand(execCommand, args)
+	return err
+}
+
+// validateCommand tokenizes the command, unless it is already split into args,
+// and checks that it contains at least the executable. Returns the arguments.
+func validateCommand(command string, args []string) ([]string, error) {
+	if args == nil {
+		var err error
+		if args, err = Tokenize(strings.TrimSpace(command)); err != nil {
+			return nil, fmt.Errorf("invalid command %q: %s", command, err.Error())
+		}
+	}
+	if len(args) == 0 || strings.TrimSpace(args[0]) == "" {
+		return nil, fmt.Errorf("no command specified: the command must contain at least the executable")
+	}
+	return args, nil
+}
+
+// Command returns the command the agent runs.
+func (p *LocalProcessAgent) Command() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.execCommand
+}
+
+// SetCommand swaps the command the agent runs, without restarting the agent.
+// The command is tokenized and its executable must exist (be an executable
+// file or be found in PATH), otherwise an error is returned and the command is
+// not changed. The processes already running keep running with the old
+// command, only the new requests run the new command.
+func (p *LocalProcessAgent) SetCommand(command string) error {
+	args, err := validateCommand(command, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("invalid command %q: %s", command, err.Error())
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.execCommand = command
+	p.execArgs = args
+	return nil
+}
+
+// NewProcessAgentArgs creates and configures new LocalProcessAgent like
+// NewProcessAgent, but with the command given as the executable followed by its
+// arguments. The command is used as is, without tokenization, which avoids any
+// quoting pitfalls of complex commands.
+func NewProcessAgentArgs(args []string, maxParallel int) *LocalProcessAgent {
+	agent := NewProcessAgent(strings.Join(args, " "), maxParallel)
+	agent.execArgs = append([]string{}, args...)
+	return agent
+}
+
+// ParseCommandArgs parses a command given as a JSON array of strings: the
+// executable followed by its arguments, for example ["/bin/sh", "-c", "echo hi"].
+func ParseCommandArgs(command string) ([]string, error) {
+	args := []string{}
+	if err := json.Unmarshal([]byte(command), &args); err != nil {
+		return nil, fmt.Errorf("invalid command, expected JSON array of strings: %s", err.Error())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("invalid command, expected at least the executable")
 	}
+	return args, nil
 }
 
 // Tokenize parses an input command line string (like a bash/shell command) into
@@ -244,7 +1182,7 @@ func NewProcessAgent(execCommand string, maxParallel int) *LocalProcessAgent {
 func Tokenize(str string) ([]string, error) {
 	tokens := []string{}
 
-	token := ""
+	token := strings.Builder{}
 	i := 0
 
 	strGroup := false
@@ -262,12 +1200,12 @@ func Tokenize(str string) ([]string, error) {
 				c = next
 				i++
 			}
-			token += string(c)
+			token.WriteByte(c)
 			i++
 		} else if c == '"' || c == '\'' {
 			if strGroup {
-				tokens = append(tokens, token)
-				token = ""
+				tokens = append(tokens, token.String())
+				token.Reset()
 				strGroup = false
 				i++
 				continue
@@ -278,25 +1216,25 @@ func Tokenize(str string) ([]string, error) {
 			}
 		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
 			if strGroup {
-				token += string(c)
+				token.WriteByte(c)
 				i++
 			} else {
-				if token != "" {
-					tokens = append(tokens, token)
-					token = ""
+				if token.Len() > 0 {
+					tokens = append(tokens, token.String())
+					token.Reset()
 				}
 				i++
 			}
 		} else {
-			token += string(c)
+			token.WriteByte(c)
 			i++
 		}
 	}
-	if token != "" {
+	if token.Len() > 0 {
 		if strGroup {
 			return nil, fmt.Errorf("unclosed string group")
 		}
-		tokens = append(tokens, token)
+		tokens = append(tokens, token.String())
 	}
 
 	return tokens, nil
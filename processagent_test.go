@@ -1,8 +1,14 @@
 package processagent
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"log"
+	"net/http/httptest"
+	"os/exec"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -46,6 +52,33 @@ func TestTokenize(t *testing.T) {
 	fmt.Println(strings.Join(tokens, "|"))
 }
 
+func TestTokenizeOutput(t *testing.T) {
+	tests := []struct {
+		command string
+		tokens  []string
+	}{
+		{"ls -la ./", []string{"ls", "-la", "./"}},
+		{"ls \"-la ./\"", []string{"ls", "-la ./"}},
+		{"/bin/sh -c \"echo \\\"Hello there, General Kenobi\\\"\"", []string{"/bin/sh", "-c", "echo \"Hello there, General Kenobi\""}},
+		{"a\tb\n\rc  d", []string{"a", "b", "c", "d"}},
+		{"echo \"\" x", []string{"echo", "", "x"}},
+		{"echo 'a b'c", []string{"echo", "a b", "c"}},
+		{"a\\\\b a\\xb", []string{"a\\b", "a\\xb"}},
+		{"echo x\\", []string{"echo", "x"}},
+		{"echo \"grüße\" ☃", []string{"echo", "grüße", "☃"}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		tokens, err := Tokenize(test.command)
+		if err != nil {
+			t.Fatalf("Failed to tokenize %q: %s", test.command, err.Error())
+		}
+		if fmt.Sprintf("%q", tokens) != fmt.Sprintf("%q", test.tokens) {
+			t.Fatalf("Expected %q to be tokenized into %q, but got %q", test.command, test.tokens, tokens)
+		}
+	}
+}
+
 func TestTokenizerErrors(t *testing.T) {
 	tokens, err := Tokenize(`"foobar`)
 	if len(tokens) != 0 {
@@ -75,7 +108,7 @@ func TestNewProcessWrapper(t *testing.T) {
 		processEndExecuted = true
 	})
 
-	out, err := pw.exec("", "/bin/sh", []string{"-c", "echo \"test\""})
+	out, err := pw.exec(context.Background(), "", "/bin/sh", []string{"-c", "echo \"test\""})
 	if err != "" {
 		t.Fatal("Expected no error, but got:", err)
 	}
@@ -94,7 +127,7 @@ func TestNewProcessWrapper(t *testing.T) {
 func TestProcessWrapperRunProcess(t *testing.T) {
 	pw := newProcessWrapper(nil, nil)
 
-	out, err := pw.runProcess(&Request{
+	out, err := pw.runProcess(context.Background(), &Request{
 		Payload: "test",
 	}, "/bin/sh -c \"cat\"")
 
@@ -125,11 +158,41 @@ func TestProcessWrapperStopProcess(t *testing.T) {
 			t.Fatal("Failed to stop process. Error:", err.Error())
 		}
 	}()
-	pw.runProcess(&Request{
+	pw.runProcess(context.Background(), &Request{
 		Payload: "",
 	}, "/bin/sh -c \"sleep 30\"")
 }
 
+func TestProcessWrapperPartialOutputOnStop(t *testing.T) {
+	pw := newProcessWrapper(nil, nil)
+
+	done := make(chan error)
+	go func() {
+		_, err := pw.runProcess(context.Background(), &Request{}, "/bin/sh -c \"echo partial && exec sleep 30\"")
+		done <- err
+	}()
+
+	time.Sleep(time.Duration(300) * time.Millisecond)
+	if out := pw.stdout.String(); out != "partial\n" {
+		t.Fatal("Expected the output to be buffered while the process runs, but got: ", out)
+	}
+	if err := pw.stopProcess(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Expected the killed process to fail.")
+		}
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("Expected the process to be terminated.")
+	}
+	if out := pw.stdout.String(); out != "partial\n" {
+		t.Fatal("Expected the output to be available after the process was killed, but got: ", out)
+	}
+}
+
 func TestProcessAgentStartThenStop(t *testing.T) {
 	pa := NewProcessAgent("/bin/sh -c \"echo 'test'\"", 0)
 	if err := pa.Stop(); err != nil {
@@ -209,13 +272,14 @@ func TestProcessAgentRejectRequest(t *testing.T) {
 	// pause a little to give time for the middlewares to run
 	time.Sleep(time.Duration(500) * time.Millisecond)
 
-	err := paMiddleware(context.Background(), &Request{}, &Response{})
-	if err == nil {
-		defer t.Fatal("Expected the request to be denied as all worker slots are occupied.")
+	resp := &Response{}
+	err := paMiddleware(context.Background(), &Request{}, resp)
+	if err != nil {
+		defer t.Fatal("Expected the request to be rejected, but got error: ", err.Error())
 	}
 
-	if err != nil && err.Error() != "max number of workers reached" {
-		defer t.Fatal("Expected the request to be reject but instead got error: ", err.Error())
+	if resp.Error == nil || *resp.ErrorCode != 429 || resp.Payload != "max number of workers reached" {
+		defer t.Fatal("Expected the request to be denied as all worker slots are occupied.")
 	}
 
 	for i := 0; i < 3; i++ {
@@ -228,3 +292,727 @@ func TestProcessAgentRejectRequest(t *testing.T) {
 		t.Fatal("Expected middleware to be able to run, but got an error:", err.Error())
 	}
 }
+
+func TestProcessAgentMaxErrorLength(t *testing.T) {
+	buff := &bytes.Buffer{}
+	pa := NewProcessAgent("/bin/sh -c \"printf %01000d 0 | tr 0 x >&2\"", 0)
+	pa.logger = NewDedupLogger(log.New(buff, "", 0), time.Minute)
+	pa.MaxErrorLength = 100
+	pa.StderrAsError = true
+
+	resp := &Response{}
+	if err := pa.ProcessCommand(&Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error == nil || !*resp.Error {
+		t.Fatal("Expected the process to fail.")
+	}
+	if resp.Payload != strings.Repeat("x", 100)+truncatedMarker {
+		t.Fatal("Expected the error message to be truncated, but got: ", resp.Payload)
+	}
+	if !strings.Contains(buff.String(), strings.Repeat("x", 1000)) {
+		t.Fatal("Expected the full error message to be logged, but got: ", buff.String())
+	}
+}
+
+func TestTruncateErrorRuneBoundary(t *testing.T) {
+	if truncated := truncateError("ab\u00e9cd", 3); truncated != "ab"+truncatedMarker {
+		t.Fatalf("Expected the message to be truncated before the split character, but got: %q", truncated)
+	}
+	if truncated := truncateError("ab\u00e9cd", 4); truncated != "ab\u00e9"+truncatedMarker {
+		t.Fatalf("Expected the whole character to be kept, but got: %q", truncated)
+	}
+	if truncated := truncateError("ab", 4); truncated != "ab" {
+		t.Fatalf("Expected a short message not to be truncated, but got: %q", truncated)
+	}
+}
+
+func TestParseDrainMode(t *testing.T) {
+	if mode, err := ParseDrainMode("finish"); err != nil || mode != DrainFinish {
+		t.Fatal("Expected to parse the finish drain mode, but got: ", mode, err)
+	}
+	if _, err := ParseDrainMode("other"); err == nil {
+		t.Fatal("Expected an error for an unknown drain mode.")
+	}
+}
+
+func TestProcessAgentShutdownDrainFinish(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"exec sleep $(cat)\"", 0)
+
+	shortResp := &Response{}
+	longResp := &Response{}
+	done := make(chan bool)
+	go func() {
+		pa.ProcessCommand(&Request{Payload: "0.5"}, shortResp)
+		done <- true
+	}()
+	go func() {
+		pa.ProcessCommand(&Request{Payload: "30"}, longResp)
+		done <- true
+	}()
+
+	// give time for the processes to start
+	time.Sleep(time.Duration(200) * time.Millisecond)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(1500)*time.Millisecond)
+	defer cancel()
+	if err := pa.Shutdown(ctx, DrainFinish); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	<-done
+
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > time.Duration(3)*time.Second {
+		t.Fatal("Expected the shutdown to wait for the drain deadline, but took: ", elapsed)
+	}
+	if shortResp.Error != nil {
+		t.Fatal("Expected the short process to finish, but got: ", shortResp.Payload)
+	}
+	if longResp.Error == nil || !*longResp.Error {
+		t.Fatal("Expected the long process to be terminated at the deadline.")
+	}
+}
+
+func TestProcessAgentRejectsWhileShuttingDown(t *testing.T) {
+	pa := NewProcessAgent("sleep 0.5", 0)
+
+	done := make(chan bool)
+	go func() {
+		pa.ProcessCommand(&Request{}, &Response{})
+		done <- true
+	}()
+	time.Sleep(time.Duration(100) * time.Millisecond)
+
+	shutdown := make(chan bool)
+	go func() {
+		pa.Shutdown(context.Background(), DrainFinish)
+		shutdown <- true
+	}()
+	for !pa.isClosing() {
+		time.Sleep(time.Millisecond)
+	}
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 || resp.Payload != "shutting down" {
+		t.Fatal("Expected the request to be rejected with 503 while draining, but got: ", resp.Payload)
+	}
+	<-done
+	<-shutdown
+}
+
+func TestStdinOptionsNormalize(t *testing.T) {
+	tests := []struct {
+		options  StdinOptions
+		payload  string
+		expected string
+	}{
+		{StdinOptions{}, " test ", " test "},
+		{StdinOptions{EnsureNewline: true}, "test", "test\n"},
+		{StdinOptions{EnsureNewline: true}, "test\n", "test\n"},
+		{StdinOptions{TrimSpace: true}, " test \n", "test"},
+		{StdinOptions{TrimSpace: true, EnsureNewline: true}, " test \n\n", "test\n"},
+	}
+	for _, test := range tests {
+		if result := test.options.normalize(test.payload); result != test.expected {
+			t.Fatalf("Expected %q to be normalized to %q, but got %q", test.payload, test.expected, result)
+		}
+	}
+}
+
+func TestProcessAgentStdinNewline(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"read line && echo got $line\"", 0)
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{Payload: "test"}, resp)
+	if resp.Payload == "got test\n" {
+		t.Fatal("Expected the line not to be read without a trailing newline.")
+	}
+
+	pa.Stdin.EnsureNewline = true
+	resp = &Response{}
+	pa.ProcessCommand(&Request{Payload: "test"}, resp)
+	if resp.Payload != "got test\n" {
+		t.Fatal("Expected the line to be read with a trailing newline, but got: ", resp.Payload)
+	}
+}
+
+func TestStdinOptionsSplit(t *testing.T) {
+	tests := []struct {
+		options StdinOptions
+		payload string
+		parts   []string
+	}{
+		{StdinOptions{}, "a\nb\n", []string{"a\nb\n"}},
+		{StdinOptions{Delivery: StdinChunks, ChunkSize: 2}, "abcde", []string{"ab", "cd", "e"}},
+		{StdinOptions{Delivery: StdinChunks, ChunkSize: 2}, "abcd", []string{"ab", "cd"}},
+		{StdinOptions{Delivery: StdinLines}, "a\nb\nc", []string{"a\n", "b\n", "c"}},
+		{StdinOptions{Delivery: StdinLines}, "a\n\nb\n", []string{"a\n", "\n", "b\n"}},
+		{StdinOptions{Delivery: StdinLines}, "", []string{}},
+	}
+	for _, test := range tests {
+		if parts := test.options.split(test.payload); fmt.Sprint(parts) != fmt.Sprint(test.parts) || len(parts) != len(test.parts) {
+			t.Fatalf("Expected %q to be split into %q, but got %q", test.payload, test.parts, parts)
+		}
+	}
+}
+
+func TestProcessAgentStdinLines(t *testing.T) {
+	// prints the time (in milliseconds) each line arrives at
+	pa := NewProcessAgentArgs([]string{"/bin/sh", "-c", "while read line; do echo \"$line $(date +%s%3N)\"; done"}, 0)
+	pa.Stdin = StdinOptions{
+		Delivery: StdinLines,
+		Interval: time.Duration(100) * time.Millisecond,
+	}
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{Payload: "one\ntwo\nthree\n"}, resp)
+	lines := strings.Split(strings.TrimSpace(resp.Payload), "\n")
+	if len(lines) != 3 {
+		t.Fatal("Expected each line to be echoed, but got: ", resp.Payload)
+	}
+	var previous int64
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		arrived, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			t.Fatal("Expected the arrival time, but got: ", line)
+		}
+		if i > 0 && arrived-previous < 80 {
+			t.Fatalf("Expected the lines to arrive separately, but %q arrived %dms after the previous one.", fields[0], arrived-previous)
+		}
+		previous = arrived
+	}
+}
+
+func TestParseStdinDelivery(t *testing.T) {
+	for name, expected := range map[string]StdinDelivery{"all": StdinAll, "chunks": StdinChunks, "lines": StdinLines} {
+		if delivery, err := ParseStdinDelivery(name); err != nil || delivery != expected {
+			t.Fatal("Expected stdin delivery for: ", name)
+		}
+	}
+	if _, err := ParseStdinDelivery("bytes"); err == nil {
+		t.Fatal("Expected an error for unknown stdin delivery.")
+	}
+}
+
+func TestProcessAgentConcurrentStop(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"exec sleep 30\"", 0)
+
+	done := make(chan bool)
+	resp := &Response{}
+	go func() {
+		pa.ProcessCommand(&Request{}, resp)
+		done <- true
+	}()
+
+	// give time for the process to start
+	time.Sleep(time.Duration(200) * time.Millisecond)
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- pa.Stop()
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal("Expected Stop to succeed, but got: ", err.Error())
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("Expected the process to be terminated.")
+	}
+	if resp.Error == nil || !*resp.Error {
+		t.Fatal("Expected the process to be terminated with an error.")
+	}
+	if len(pa.runningProcesses()) != 0 {
+		t.Fatal("Expected no running processes after Stop.")
+	}
+}
+
+func TestProcessAgentMaxSpawnsPerSecond(t *testing.T) {
+	pa := NewProcessAgent("/bin/true", 0)
+	pa.MaxSpawnsPerSecond = 10
+
+	start := time.Now()
+	done := make(chan bool)
+	for i := 0; i < 5; i++ {
+		go func() {
+			pa.ProcessCommand(&Request{}, &Response{})
+			done <- true
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		<-done
+	}
+
+	// 5 spawns at 10 per second - the last one starts after at least 400ms.
+	if elapsed := time.Since(start); elapsed < time.Duration(400)*time.Millisecond {
+		t.Fatal("Expected the process starts to be rate limited, but all completed in: ", elapsed)
+	}
+}
+
+func TestProcessAgentMaxSpawnsPerSecondContext(t *testing.T) {
+	pa := NewProcessAgent("/bin/true", 0)
+	pa.MaxSpawnsPerSecond = 1
+	defer pa.Stop()
+
+	pa.ProcessCommand(&Request{}, &Response{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	resp := &Response{}
+	start := time.Now()
+	pa.ProcessCommandContext(ctx, &Request{}, resp)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("Expected the wait for the spawn to end with the context, but it took: ", elapsed)
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 504 {
+		t.Fatal("Expected 504 when the deadline is exceeded while waiting to spawn.")
+	}
+}
+
+func BenchmarkTokenizeLongToken(b *testing.B) {
+	command := "/bin/echo \"" + strings.Repeat("x", 100000) + "\" " + strings.Repeat("y", 100000)
+	for i := 0; i < b.N; i++ {
+		if _, err := Tokenize(command); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestProcessAgentDeadlineEnv(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"echo $PA_DEADLINE_MS\"", 0)
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Payload != "\n" {
+		t.Fatal("Expected no deadline without a context deadline, but got: ", resp.Payload)
+	}
+
+	resp = &Response{}
+	middleware := Deadline(time.Duration(10) * time.Second)(pa.GetMiddleware())
+	if err := middleware(context.Background(), &Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	remaining, err := strconv.Atoi(strings.TrimSpace(resp.Payload))
+	if err != nil {
+		t.Fatal("Expected the remaining time in the environment, but got: ", resp.Payload)
+	}
+	if remaining <= 9000 || remaining > 10000 {
+		t.Fatal("Expected the remaining time to reflect the context deadline, but got: ", remaining)
+	}
+}
+
+func TestNewProcessAgentArgs(t *testing.T) {
+	pa := NewProcessAgentArgs([]string{"/bin/sh", "-c", "echo \"it's $0\" 'quoted'", "args"}, 0)
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected no error, but got: ", resp.Payload)
+	}
+	if resp.Payload != "it's args quoted\n" {
+		t.Fatal("Expected the arguments to be passed as they are, but got: ", resp.Payload)
+	}
+}
+
+func TestParseCommandArgs(t *testing.T) {
+	args, err := ParseCommandArgs(`["/bin/sh", "-c", "echo hi"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 3 || args[2] != "echo hi" {
+		t.Fatal("Unexpected arguments: ", args)
+	}
+
+	for _, command := range []string{`[]`, `"/bin/sh"`, `[1, 2]`} {
+		if _, err := ParseCommandArgs(command); err == nil {
+			t.Fatalf("Expected an error for command %s.", command)
+		}
+	}
+}
+
+func TestProcessAgentMaxOutputSize(t *testing.T) {
+	pa := NewProcessAgent("yes", 0)
+	pa.MaxOutputSize = 1024
+
+	resp := &Response{}
+	start := time.Now()
+	if err := pa.ProcessCommand(&Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Expected the process to be terminated promptly.")
+	}
+	if resp.Error == nil || !*resp.Error || !strings.Contains(resp.Payload, "exceeds the limit of 1024 bytes") {
+		t.Fatal("Expected an over-limit error, but got: ", resp)
+	}
+	if len(pa.runningProcesses()) != 0 {
+		t.Fatal("Expected no running processes.")
+	}
+
+	resp = &Response{}
+	pa = NewProcessAgent("echo within limit", 0)
+	pa.MaxOutputSize = 1024
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Payload != "within limit\n" {
+		t.Fatal("Expected the output within the limit, but got: ", resp.Payload)
+	}
+}
+
+func TestLimitWriter(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	exceeded := 0
+	writer := &limitWriter{writer: buffer, max: 5, exceeded: func() { exceeded++ }}
+
+	if n, err := writer.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatal("Expected the write within the limit to succeed.")
+	}
+	if n, err := writer.Write([]byte("defg")); n != 2 || err != errOutputLimit {
+		t.Fatal("Expected the write over the limit to fail, but got: ", n, err)
+	}
+	if buffer.String() != "abcde" || exceeded != 1 {
+		t.Fatal("Expected the output up to the limit, but got: ", buffer.String(), exceeded)
+	}
+}
+
+func TestProcessAgentPreExec(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"echo $DEVICE; cat\"", 0)
+	pa.PreExec = func(req *Request, cmd *exec.Cmd) error {
+		if req.Payload == "reject" {
+			return fmt.Errorf("rejected by hook")
+		}
+		if strings.HasPrefix(req.Payload, "gpu") {
+			cmd.Env = append(cmd.Env, "DEVICE=gpu0")
+		}
+		return nil
+	}
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{Payload: "gpu job"}, resp)
+	if resp.Payload != "gpu0\ngpu job" {
+		t.Fatal("Expected the child to observe the variable set by the hook, but got: ", resp.Payload)
+	}
+
+	resp = &Response{}
+	pa.ProcessCommand(&Request{Payload: "cpu job"}, resp)
+	if resp.Payload != "\ncpu job" {
+		t.Fatal("Expected no variable set by the hook, but got: ", resp.Payload)
+	}
+
+	resp = &Response{}
+	pa.ProcessCommand(&Request{Payload: "reject"}, resp)
+	if resp.Error == nil || !*resp.Error || resp.Payload != "pre-exec hook failed: rejected by hook" {
+		t.Fatal("Expected the hook to abort the run, but got: ", resp.Payload)
+	}
+	if len(pa.runningProcesses()) != 0 {
+		t.Fatal("Expected no running processes.")
+	}
+}
+
+func TestProcessAgentValidate(t *testing.T) {
+	for _, command := range []string{"", "   ", "\"\""} {
+		if err := NewProcessAgent(command, 0).Validate(); err == nil {
+			t.Fatalf("Expected validation to fail for command %q.", command)
+		}
+	}
+	if err := NewProcessAgentArgs([]string{""}, 0).Validate(); err == nil {
+		t.Fatal("Expected validation to fail for an empty executable.")
+	}
+	if err := NewProcessAgent("echo hello", 0).Validate(); err != nil {
+		t.Fatal("Expected a valid command, but got: ", err)
+	}
+	if err := NewProcessAgentArgs([]string{"echo", ""}, 0).Validate(); err != nil {
+		t.Fatal("Expected a valid command, but got: ", err)
+	}
+}
+
+func TestProcessAgentRetryAfter(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"sleep 2\"", 1)
+	endpoint := &HTTPEndpoint{InputPort: NewMiddlewarePort()}
+	endpoint.AddMiddleware(pa.GetMiddleware())
+
+	// learn the duration of the process
+	pa.ProcessCommand(&Request{}, &Response{})
+
+	done := make(chan bool)
+	go func() {
+		pa.ProcessCommand(&Request{}, &Response{})
+		done <- true
+	}()
+	time.Sleep(time.Duration(300) * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	endpoint.handleHTTPRequest(rec, httptest.NewRequest("POST", "/", strings.NewReader("")))
+	if rec.Code != 429 {
+		t.Fatal("Expected the request to be rejected with 429, but got: ", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "2" {
+		t.Fatal("Expected Retry-After to reflect the time until the worker frees up, but got: ", rec.Header().Get("Retry-After"))
+	}
+	<-done
+}
+
+func TestProcessAgentSetCommand(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"sleep 0.5; echo old\"", 0)
+
+	oldResp := &Response{}
+	done := make(chan bool)
+	go func() {
+		pa.ProcessCommand(&Request{}, oldResp)
+		done <- true
+	}()
+	time.Sleep(time.Duration(100) * time.Millisecond)
+
+	if err := pa.SetCommand("echo new"); err != nil {
+		t.Fatal(err)
+	}
+	if pa.Command() != "echo new" {
+		t.Fatal("Expected the command to be swapped, but got: ", pa.Command())
+	}
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Payload != "new\n" {
+		t.Fatal("Expected the new request to run the new command, but got: ", resp.Payload)
+	}
+
+	<-done
+	if oldResp.Payload != "old\n" {
+		t.Fatal("Expected the running request to complete with the old command, but got: ", oldResp.Payload)
+	}
+
+	for _, command := range []string{"", "/no/such/executable arg", "no-such-executable-in-path"} {
+		if err := pa.SetCommand(command); err == nil {
+			t.Fatalf("Expected an error for invalid command %q.", command)
+		}
+	}
+	if pa.Command() != "echo new" {
+		t.Fatal("Expected the command not to change on error, but got: ", pa.Command())
+	}
+}
+
+func TestProcessAgentExecutableAllowlist(t *testing.T) {
+	echo, err := exec.LookPath("echo")
+	if err != nil {
+		t.Skip("echo not found: ", err)
+	}
+	pa := NewProcessAgent("echo hello", 0)
+	pa.ExecutableAllowlist = []string{echo}
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil || resp.Payload != "hello\n" {
+		t.Fatal("Expected the allowed executable to run, but got: ", resp.Payload)
+	}
+
+	pa = NewProcessAgentArgs([]string{"/bin/sh", "-c", "echo hello"}, 0)
+	pa.ExecutableAllowlist = []string{echo}
+
+	resp = &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error == nil || !*resp.Error {
+		t.Fatal("Expected the disallowed executable not to run, but got: ", resp.Payload)
+	}
+	if resp.Payload != "executable \"/bin/sh\" (/bin/sh) not allowed: not in the allowlist" {
+		t.Fatal("Expected a clear error, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentPartialStdinRead(t *testing.T) {
+	payload := strings.Repeat("x", 4<<20)
+	options := map[string]StdinOptions{
+		"all":      {},
+		"chunks":   {Delivery: StdinChunks, ChunkSize: 1024},
+		"lines":    {Delivery: StdinLines},
+		"interval": {Delivery: StdinChunks, ChunkSize: 1024, Interval: time.Hour},
+	}
+	before := runtime.NumGoroutine()
+	for name, stdin := range options {
+		pa := NewProcessAgent("head -c 4", 0)
+		pa.Stdin = stdin
+
+		resp := &Response{}
+		pa.ProcessCommand(&Request{Payload: payload}, resp)
+		if resp.Error != nil || resp.Payload != "xxxx" {
+			t.Fatalf("Expected the partial read to succeed with %s delivery, but got: %s", name, resp.Payload)
+		}
+	}
+
+	pa := NewProcessAgentArgs([]string{"/bin/sh", "-c", "head -c 4 <&3"}, 0)
+	pa.InputFD = 3
+	resp := &Response{}
+	pa.ProcessCommand(&Request{Payload: payload}, resp)
+	if resp.Error != nil || resp.Payload != "xxxx" {
+		t.Fatal("Expected the partial read to succeed on the input file descriptor, but got: ", resp.Payload)
+	}
+
+	pa = NewProcessAgentArgs([]string{"/bin/sh", "-c", "head -c 4; exit 3"}, 0)
+	resp = &Response{}
+	pa.ProcessCommand(&Request{Payload: payload}, resp)
+	if resp.Error == nil || resp.Payload != "exit status 3" {
+		t.Fatal("Expected the exit status to fail the request, but got: ", resp.Payload)
+	}
+
+	// the input writers stop once the processes exit
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the input writers to stop, but got %d goroutines (before %d).", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+}
+
+func TestProcessAgentOnShutdown(t *testing.T) {
+	pa := NewProcessAgent("echo hello", 0)
+	audit := &bytes.Buffer{}
+	writer := NewBatchWriter(audit, 100, 0, OverflowBlock)
+
+	order := []string{}
+	pa.OnShutdown(func() error {
+		order = append(order, "failing")
+		return fmt.Errorf("failed")
+	})
+	pa.OnShutdown(func() error {
+		order = append(order, "audit")
+		return writer.Close()
+	})
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{ID: "req-1"}, resp)
+	fmt.Fprintf(writer, "%s %s", "req-1", resp.Payload)
+	if audit.Len() != 0 {
+		t.Fatal("Expected the audit entry to be buffered.")
+	}
+
+	pa.Shutdown(context.Background(), DrainFinish)
+	if audit.String() != "req-1 hello\n" {
+		t.Fatal("Expected the pending audit entry to be flushed on shutdown, but got: ", audit.String())
+	}
+	if strings.Join(order, ",") != "failing,audit" {
+		t.Fatal("Expected all hooks to run in order, but got: ", order)
+	}
+}
+
+func TestProcessAgentTimeout(t *testing.T) {
+	pa := NewProcessAgent("sleep 30", 0)
+	pa.Timeout = time.Duration(200) * time.Millisecond
+
+	resp := &Response{}
+	start := time.Now()
+	pa.ProcessCommand(&Request{}, resp)
+	if elapsed := time.Since(start); elapsed > time.Duration(2)*time.Second {
+		t.Fatal("Expected the process to be killed on timeout, but it ran for: ", elapsed)
+	}
+	if resp.Error == nil || !*resp.Error || *resp.ErrorCode != 504 {
+		t.Fatal("Expected the request to fail with 504, but got: ", resp.Payload)
+	}
+	if resp.Payload != "process timed out after 200ms" {
+		t.Fatal("Expected a timeout error, but got: ", resp.Payload)
+	}
+	if len(pa.runningProcesses()) != 0 {
+		t.Fatal("Expected no running processes.")
+	}
+
+	resp = &Response{}
+	pa = NewProcessAgent("/bin/sh -c \"sleep 0.3; echo done\"", 0)
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil || resp.Payload != "done\n" {
+		t.Fatal("Expected no timeout by default, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentContextCanceled(t *testing.T) {
+	pa := NewProcessAgent("sleep 30", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Duration(200) * time.Millisecond)
+		cancel()
+	}()
+
+	resp := &Response{}
+	start := time.Now()
+	err := pa.ProcessCommandContext(ctx, &Request{}, resp)
+	if elapsed := time.Since(start); elapsed > time.Duration(1200)*time.Millisecond {
+		t.Fatal("Expected the process to be killed when the context is canceled, but it ran for: ", elapsed)
+	}
+	if err != context.Canceled {
+		t.Fatal("Expected a cancellation error, but got: ", err)
+	}
+	if len(pa.runningProcesses()) != 0 {
+		t.Fatal("Expected no running processes.")
+	}
+
+	resp = &Response{}
+	if err := pa.ProcessCommandContext(ctx, &Request{}, resp); err != context.Canceled {
+		t.Fatal("Expected a canceled request not to start a process, but got: ", err)
+	}
+}
+
+func TestProcessAgentExitCode(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"echo bad input >&2; exit 2\"", 0)
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.ExitCode == nil || *resp.ExitCode != 2 {
+		t.Fatal("Expected exit code 2, but got: ", resp.ExitCode)
+	}
+
+	pa = NewProcessAgent("echo hello", 0)
+	resp = &Response{}
+	JSONResponse(pa.ProcessCommandContext)(context.Background(), &Request{}, resp)
+	if !strings.Contains(resp.Payload, `"exitCode":0`) {
+		t.Fatal("Expected exit code 0 in the serialized response, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentStderr(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"echo progress >&2; echo done\"", 0)
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil || resp.Payload != "done\n" {
+		t.Fatal("Expected a process exiting successfully not to fail, but got: ", resp.Payload)
+	}
+	if resp.Stderr != "progress\n" {
+		t.Fatalf("Expected the STDERR output in the response, but got: %q", resp.Stderr)
+	}
+
+	pa.MaxErrorLength = 4
+	resp = &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Stderr != "prog"+truncatedMarker {
+		t.Fatalf("Expected the STDERR output to be truncated, but got: %q", resp.Stderr)
+	}
+	pa.MaxErrorLength = 0
+
+	pa.StderrAsError = true
+	resp = &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error == nil || !*resp.Error || resp.Payload != "progress\n" {
+		t.Fatal("Expected the request to fail with the STDERR output, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentDeadlineExceeded(t *testing.T) {
+	pa := NewProcessAgent("sleep 30", 0)
+	middleware := Deadline(time.Duration(200) * time.Millisecond)(pa.GetMiddleware())
+
+	resp := &Response{}
+	start := time.Now()
+	if err := middleware(context.Background(), &Request{}, resp); err != nil {
+		t.Fatal("Expected no error past the deadline, but got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Duration(1200)*time.Millisecond {
+		t.Fatal("Expected the process to be killed on the deadline, but it ran for: ", elapsed)
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 504 {
+		t.Fatal("Expected the request to fail with 504, but got: ", resp.Payload)
+	}
+}
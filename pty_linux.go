@@ -0,0 +1,99 @@
+package processagent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl performs the ioctl system call on the given file descriptor.
+func ioctl(fd, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPTY opens a new pseudo-terminal and returns its master and slave side.
+// The echo of the input and the output processing (like translating "\n" to
+// "\r\n") are turned off on the terminal, so the output is passed as the
+// process wrote it.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			master.Close()
+		}
+	}()
+
+	var unlock int32
+	if err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		return nil, nil, err
+	}
+	var number uint32
+	if err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number))); err != nil {
+		return nil, nil, err
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", number), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	termios := syscall.Termios{}
+	if err = ioctl(slave.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); err == nil {
+		termios.Lflag &^= syscall.ECHO
+		termios.Oflag &^= syscall.OPOST
+		err = ioctl(slave.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&termios)))
+	}
+	if err != nil {
+		slave.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// attachPTY attaches the STDIN and STDOUT of the command to a new
+// pseudo-terminal, which becomes the controlling terminal of the process.
+// Returns the master side of the terminal, on which the input is written and the
+// output is read, and the slave side, which must be closed once the process has
+// started.
+func attachPTY(cmd *exec.Cmd) (master, slave *os.File, err error) {
+	if master, slave, err = openPTY(); err != nil {
+		return nil, nil, err
+	}
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	return master, slave, nil
+}
+
+// ptyOutput returns the reader of the output of a process attached to the
+// pseudo-terminal with the given master side.
+func ptyOutput(master *os.File) io.Reader {
+	return &ptyReader{master: master}
+}
+
+// ptyReader reads the output from the master side of a pseudo-terminal.
+// Once all processes have closed the slave side, reading fails with EIO, which
+// is reported as the end of the output.
+type ptyReader struct {
+	master *os.File
+}
+
+func (r *ptyReader) Read(p []byte) (int, error) {
+	n, err := r.master.Read(p)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EIO {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,41 @@
+package processagent
+
+import (
+	"testing"
+)
+
+func TestProcessAgentPTY(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"test -t 1 && echo tty || echo notty\"", 0)
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Payload != "notty\n" {
+		t.Fatal("Expected the process not to run in a terminal, but got: ", resp.Payload)
+	}
+
+	pa.PTY = true
+	resp = &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil {
+		t.Fatal("Expected no error, but got: ", resp.Payload)
+	}
+	if resp.Payload != "tty\n" {
+		t.Fatal("Expected the process to run in a terminal, but got: ", resp.Payload)
+	}
+}
+
+func TestProcessAgentPTYInput(t *testing.T) {
+	pa := NewProcessAgent("/bin/sh -c \"cat\"", 0)
+	pa.PTY = true
+
+	for _, payload := range []string{"line 1\nline 2\n", "no newline", ""} {
+		resp := &Response{}
+		pa.ProcessCommand(&Request{Payload: payload}, resp)
+		if resp.Error != nil {
+			t.Fatal("Expected no error, but got: ", resp.Payload)
+		}
+		if resp.Payload != payload {
+			t.Fatalf("Expected the input %q to be read through the terminal, but got: %q", payload, resp.Payload)
+		}
+	}
+}
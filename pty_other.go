@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package processagent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// attachPTY is not supported on this platform, PTY is supported on Linux only.
+func attachPTY(cmd *exec.Cmd) (master, slave *os.File, err error) {
+	return nil, nil, fmt.Errorf("running the process with a PTY is supported on Linux only")
+}
+
+// ptyOutput is not supported on this platform, as attachPTY always fails.
+func ptyOutput(master *os.File) io.Reader {
+	return master
+}
@@ -0,0 +1,171 @@
+package processagent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RemoteProcessAgent is a ProcessAgent that does not run the processes locally,
+// but forwards the requests to another (remote) process agent over HTTP.
+// The Request is POSTed in a JSON envelope (see JSONEnvelopeDecoder), so the
+// remote agent must run with the "json-envelope" request format. The remote
+// agent responds with the Response serialized as JSON (see JSONResponse), and
+// its Payload, error, ExitCode, Stderr and Metadata are set on the Response.
+// The Request Metadata is not forwarded, as it holds the headers of the
+// incoming request (like Authorization). Only the Request ID and the Payload
+// are sent.
+// Calls that failed to connect to the remote agent are retried up to the
+// configured number of retries. Other failures are not retried: the remote
+// agent may have already run the command.
+type RemoteProcessAgent struct {
+	url     string
+	retries int
+	backoff time.Duration
+	client  *http.Client
+}
+
+// GetMiddleware returns a middleware that can be attached to a given InputPort
+// to handle Request by forwarding it to the remote process agent.
+func (r *RemoteProcessAgent) GetMiddleware() Middleware {
+	return r.ProcessCommandContext
+}
+
+// Stop closes any idle connections to the remote agent.
+func (r *RemoteProcessAgent) Stop() error {
+	if transport, ok := r.client.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// ProcessCommand forwards the Request to the remote agent and populates the
+// Response with the result. If the remote agent cannot be reached, the Response
+// is marked as an error with error code 502.
+func (r *RemoteProcessAgent) ProcessCommand(req *Request, resp *Response) error {
+	return r.ProcessCommandContext(context.Background(), req, resp)
+}
+
+// ProcessCommandContext is like ProcessCommand, but the call to the remote
+// agent is canceled when the context is done.
+func (r *RemoteProcessAgent) ProcessCommandContext(ctx context.Context, req *Request, resp *Response) error {
+	var statusCode int
+	var body []byte
+	var err error
+	for attempt := 0; attempt <= r.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(r.backoff * time.Duration(attempt)):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return contextErrorResponse(ctx, resp)
+		}
+		statusCode, body, err = r.post(ctx, req)
+		if err == nil || !isDialError(err) {
+			break
+		}
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return contextErrorResponse(ctx, resp)
+	}
+	if err != nil {
+		setErrorResponse(resp, 502, fmt.Sprintf("remote agent failed: %s", err.Error()))
+		log.Println("RemoteProcessAgent: Failed to forward request. Error:", err.Error())
+		return nil
+	}
+
+	remote := &Response{}
+	if err := json.Unmarshal(body, remote); err != nil {
+		if statusCode >= 400 {
+			// rejected before the middleware chain, like "server busy"
+			setErrorResponse(resp, statusCode, string(body))
+			return nil
+		}
+		setErrorResponse(resp, 502, "remote agent failed: invalid response")
+		log.Println("RemoteProcessAgent: Invalid response from the remote agent. Error:", err.Error())
+		return nil
+	}
+	copyRemoteResponse(resp, remote)
+	if statusCode >= 400 && (resp.Error == nil || !*resp.Error) {
+		setErrorResponse(resp, statusCode, resp.Payload)
+	}
+	return nil
+}
+
+// copyRemoteResponse sets the result of the remote Response on the Response.
+// The ID, the Port and the Timestamp are left to the local middlewares.
+func copyRemoteResponse(resp, remote *Response) {
+	resp.Payload = remote.Payload
+	resp.Error = remote.Error
+	resp.ErrorCode = remote.ErrorCode
+	resp.ExitCode = remote.ExitCode
+	resp.Stderr = remote.Stderr
+	for key, value := range remote.Metadata {
+		resp.SetMetadata(key, value)
+	}
+}
+
+// isDialError checks if the call failed to connect to the remote agent, so the
+// request has certainly not been sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// post sends the Request in a JSON envelope to the remote agent and returns the
+// status code and the body of the response.
+func (r *RemoteProcessAgent) post(ctx context.Context, req *Request) (int, []byte, error) {
+	payload, err := json.Marshal(req.Payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := json.Marshal(&jsonEnvelope{
+		ID:      req.ID,
+		Payload: payload,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", r.url, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := r.client.Do(httpReq)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return httpResp.StatusCode, body, nil
+}
+
+// NewRemoteProcessAgent creates new RemoteProcessAgent that forwards the
+// requests to the process agent available on the given URL.
+// Each call to the remote agent times out after the given timeout (0 means no
+// timeout) and calls failing to connect are retried up to retries times.
+func NewRemoteProcessAgent(url string, timeout time.Duration, retries int) *RemoteProcessAgent {
+	return &RemoteProcessAgent{
+		url:     url,
+		retries: retries,
+		backoff: time.Duration(100) * time.Millisecond,
+		client: &http.Client{
+			Transport: &http.Transport{},
+			Timeout:   timeout,
+		},
+	}
+}
@@ -0,0 +1,198 @@
+package processagent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newRemoteEndpoint creates an HTTPEndpoint wired like the one of a stock agent
+// running with the json-envelope request format.
+func newRemoteEndpoint(worker Middleware) *HTTPEndpoint {
+	endpoint := &HTTPEndpoint{
+		InputPort: NewMiddlewarePort(),
+		Decoder:   JSONEnvelopeDecoder,
+	}
+	for _, handler := range []Handler{
+		ResponseTimestamp,
+		JSONResponse,
+		ValidatedRequestID(9, nil, RequestIDPattern(DefaultRequestIDPattern, DefaultRequestIDMaxLength), RegenerateInvalidID),
+		RequestTimestamp,
+	} {
+		worker = handler(worker)
+	}
+	endpoint.AddMiddleware(worker)
+	return endpoint
+}
+
+func TestRemoteProcessAgentForward(t *testing.T) {
+	var received *Request
+	processAgent := NewProcessAgent("/bin/sh -c \"cat; echo warning >&2\"", 0)
+	endpoint := newRemoteEndpoint(func(ctx context.Context, req *Request, resp *Response) error {
+		received = req
+		resp.SetMetadata("X-Remote", "yes")
+		return processAgent.GetMiddleware()(ctx, req, resp)
+	})
+	server := httptest.NewServer(http.HandlerFunc(endpoint.handleHTTPRequest))
+	defer server.Close()
+
+	agent := NewRemoteProcessAgent(server.URL, time.Second, 0)
+	defer agent.Stop()
+
+	resp := &Response{}
+	if err := agent.ProcessCommand(&Request{
+		ID:       "req-id",
+		Payload:  "test",
+		Metadata: map[string]string{"Authorization": "Bearer secret"},
+	}, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Error != nil {
+		t.Fatal("Expected no error, but got: ", resp.Payload)
+	}
+	if resp.Payload != "test" {
+		t.Fatal("Expected the payload of the remote response, but got: ", resp.Payload)
+	}
+	if resp.ExitCode == nil || *resp.ExitCode != 0 || resp.Stderr != "warning\n" {
+		t.Fatal("Expected the exit code and the STDERR output of the remote process.")
+	}
+	if resp.Metadata["X-Remote"] != "yes" {
+		t.Fatal("Expected the metadata of the remote response, but got: ", resp.Metadata)
+	}
+	if received.ID != "req-id" {
+		t.Fatal("Expected the request ID to be forwarded, but got: ", received.ID)
+	}
+	if _, ok := received.Metadata["Authorization"]; ok {
+		t.Fatal("Expected the request metadata not to be forwarded.")
+	}
+}
+
+func TestRemoteProcessAgentRemoteError(t *testing.T) {
+	endpoint := newRemoteEndpoint(NewProcessAgent("/bin/sh -c \"exit 3\"", 0).GetMiddleware())
+	server := httptest.NewServer(http.HandlerFunc(endpoint.handleHTTPRequest))
+	defer server.Close()
+
+	agent := NewRemoteProcessAgent(server.URL, time.Second, 0)
+	resp := &Response{}
+	agent.ProcessCommand(&Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 500 || resp.Payload != "exit status 3" {
+		t.Fatal("Expected the remote error to be returned, but got: ", resp.Payload)
+	}
+	if resp.ExitCode == nil || *resp.ExitCode != 3 {
+		t.Fatal("Expected the exit code of the remote process.")
+	}
+}
+
+func TestRemoteProcessAgentInvalidResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("not json"))
+	}))
+	defer server.Close()
+
+	agent := NewRemoteProcessAgent(server.URL, time.Second, 0)
+	resp := &Response{}
+	agent.ProcessCommand(&Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 502 {
+		t.Fatal("Expected an invalid remote response to fail with 502, but got: ", resp.Payload)
+	}
+}
+
+func TestRemoteProcessAgentNoRetryAfterSent(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		rw.WriteHeader(503)
+	}))
+	defer server.Close()
+
+	agent := NewRemoteProcessAgent(server.URL, time.Second, 2)
+	agent.backoff = time.Millisecond
+
+	resp := &Response{}
+	agent.ProcessCommand(&Request{}, resp)
+	if calls != 1 {
+		t.Fatal("Expected a request that reached the remote agent not to be retried, but was called times: ", calls)
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 503 {
+		t.Fatal("Expected the request to fail with 503.")
+	}
+}
+
+func TestRemoteProcessAgentRetryConnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	// the remote agent comes up after the first attempt has failed
+	go func() {
+		time.Sleep(time.Duration(50) * time.Millisecond)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		http.Serve(listener, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(`{"payload": "ok"}`))
+		}))
+	}()
+
+	agent := NewRemoteProcessAgent("http://"+addr, time.Second, 5)
+	resp := &Response{}
+	agent.ProcessCommand(&Request{}, resp)
+	if resp.Error != nil || resp.Payload != "ok" {
+		t.Fatal("Expected the failed connection to be retried, but got: ", resp.Payload)
+	}
+}
+
+func TestRemoteProcessAgentTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Duration(500) * time.Millisecond)
+	}))
+	defer server.Close()
+
+	agent := NewRemoteProcessAgent(server.URL, time.Duration(50)*time.Millisecond, 0)
+
+	resp := &Response{}
+	agent.ProcessCommand(&Request{}, resp)
+	if resp.ErrorCode == nil || *resp.ErrorCode != 502 {
+		t.Fatal("Expected the request to fail with 502 on timeout.")
+	}
+}
+
+func TestRemoteProcessAgentContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Duration(5) * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	agent := NewRemoteProcessAgent(server.URL, 0, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(50)*time.Millisecond)
+	defer cancel()
+	resp := &Response{}
+	start := time.Now()
+	if err := agent.GetMiddleware()(ctx, &Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("Expected the call to be aborted on the deadline.")
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 504 {
+		t.Fatal("Expected the request to fail with 504 past its deadline, but got: ", resp.Payload)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := agent.ProcessCommandContext(ctx, &Request{}, &Response{}); err != context.Canceled {
+		t.Fatal("Expected a cancellation error, but got: ", err)
+	}
+}
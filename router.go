@@ -0,0 +1,60 @@
+package processagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lookupJSONPath parses the payload as JSON and looks up the value of the field
+// on the given path. The path is a dot-separated list of field names, for
+// example "type" or "message.type".
+// Returns false if the payload is not a JSON object or the field does not exist.
+func lookupJSONPath(payload string, path string) (interface{}, bool) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		return nil, false
+	}
+	for _, field := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[field]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// RouteByField creates a Middleware that routes the requests to different
+// process agents based on the content of the Request payload.
+// The payload is parsed as JSON and the value of the field on jsonPath (see
+// lookupJSONPath) is used to pick the ProcessAgent from routes, which then
+// processes the request.
+// If the field is missing or there is no route for its value, the request is
+// rejected with error code 404.
+// The context of the request is passed on to the agents that support it (like
+// LocalProcessAgent), so the routed requests are canceled with the request.
+func RouteByField(jsonPath string, routes map[string]ProcessAgent) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		value, ok := lookupJSONPath(req.Payload, jsonPath)
+		if !ok {
+			setErrorResponse(resp, 404, fmt.Sprintf("no route: field %s not found", jsonPath))
+			return nil
+		}
+		route := fmt.Sprint(value)
+		if number, isNumber := value.(float64); isNumber {
+			// not in the exponent notation, like 1e+06
+			route = strconv.FormatFloat(number, 'f', -1, 64)
+		}
+		agent, ok := routes[route]
+		if !ok {
+			setErrorResponse(resp, 404, fmt.Sprintf("no route for %s: %s", jsonPath, route))
+			return nil
+		}
+		return processCommandContext(ctx, agent, req, resp)
+	}
+}
@@ -0,0 +1,88 @@
+package processagent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLookupJSONPath(t *testing.T) {
+	value, ok := lookupJSONPath(`{"message": {"type": "a"}}`, "message.type")
+	if !ok || value != "a" {
+		t.Fatal("Expected to find the nested field, but got: ", value)
+	}
+	if _, ok = lookupJSONPath(`{"message": "a"}`, "message.type"); ok {
+		t.Fatal("Expected not to find a field in a non-object value.")
+	}
+	if _, ok = lookupJSONPath(`not json`, "type"); ok {
+		t.Fatal("Expected not to find a field in invalid JSON.")
+	}
+}
+
+func TestRouteByField(t *testing.T) {
+	middleware := RouteByField("type", map[string]ProcessAgent{
+		"upper": NewProcessAgent("/bin/sh -c \"echo upper\"", 0),
+		"lower": NewProcessAgent("/bin/sh -c \"echo lower\"", 0),
+	})
+
+	for _, route := range []string{"upper", "lower"} {
+		resp := &Response{}
+		if err := middleware(context.Background(), &Request{
+			Payload: `{"type": "` + route + `"}`,
+		}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Payload != route+"\n" {
+			t.Fatalf("Expected the request to be routed to %s, but got: %s", route, resp.Payload)
+		}
+	}
+}
+
+func TestRouteByFieldUnmapped(t *testing.T) {
+	middleware := RouteByField("type", map[string]ProcessAgent{})
+
+	for _, payload := range []string{`{"type": "other"}`, `{}`, `not json`} {
+		resp := &Response{}
+		if err := middleware(context.Background(), &Request{
+			Payload: payload,
+		}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ErrorCode == nil || *resp.ErrorCode != 404 {
+			t.Fatalf("Expected payload %s to be rejected with 404.", payload)
+		}
+	}
+}
+
+func TestRouteByFieldNumber(t *testing.T) {
+	middleware := RouteByField("version", map[string]ProcessAgent{
+		"1000000": NewProcessAgent("/bin/sh -c \"echo v1\"", 0),
+		"1.5":     NewProcessAgent("/bin/sh -c \"echo v1.5\"", 0),
+	})
+
+	for payload, expected := range map[string]string{`{"version": 1000000}`: "v1\n", `{"version": 1.5}`: "v1.5\n"} {
+		resp := &Response{}
+		middleware(context.Background(), &Request{Payload: payload}, resp)
+		if resp.Payload != expected {
+			t.Fatalf("Expected %s to be routed to %q, but got: %s", payload, expected, resp.Payload)
+		}
+	}
+}
+
+func TestRouteByFieldContext(t *testing.T) {
+	middleware := RouteByField("type", map[string]ProcessAgent{
+		"slow": NewProcessAgent("sleep 30", 0),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(200)*time.Millisecond)
+	defer cancel()
+	resp := &Response{}
+	start := time.Now()
+	middleware(ctx, &Request{Payload: `{"type": "slow"}`}, resp)
+	if elapsed := time.Since(start); elapsed > time.Duration(1200)*time.Millisecond {
+		t.Fatal("Expected the routed process to be killed on the deadline, but it ran for: ", elapsed)
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 504 {
+		t.Fatal("Expected the request to fail with 504, but got: ", resp.Payload)
+	}
+}
@@ -0,0 +1,73 @@
+package processagent
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// selfTestTimeout is the maximal time to wait for a port to respond.
+const selfTestTimeout = 10 * time.Second
+
+// selfTestHTTP sends the payload to the HTTP port on the given URL and checks
+// that the port responded successfully.
+func selfTestHTTP(url string, payload string) error {
+	client := &http.Client{
+		Timeout: selfTestTimeout,
+	}
+	resp, err := client.Post(url, "text/plain", strings.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// selfTestHost returns the host on which the ports of the running agent can be
+// reached: the configured host, or the loopback if the agent listens on all
+// interfaces.
+func selfTestHost(cfg *Config) string {
+	if cfg.Host == nil || *cfg.Host == "" {
+		return "127.0.0.1"
+	}
+	if ip := net.ParseIP(*cfg.Host); ip != nil && ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+	return *cfg.Host
+}
+
+// SelfTest sends a canned request (the payload) to each of the ports configured
+// in the Config of a running agent and reports whether each port responded
+// correctly. The report is written to out.
+// Returns an error if any of the ports failed.
+func SelfTest(cfg *Config, payload string, out io.Writer) error {
+	tests := map[string]func() error{
+		"http": func() error {
+			return selfTestHTTP(fmt.Sprintf("http://%s/", net.JoinHostPort(selfTestHost(cfg), strconv.Itoa(*cfg.Port))), payload)
+		},
+	}
+
+	failed := 0
+	for port, test := range tests {
+		if err := test(); err != nil {
+			failed++
+			fmt.Fprintf(out, "%s: FAILED: %s\n", port, err.Error())
+			continue
+		}
+		fmt.Fprintf(out, "%s: OK\n", port)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("self-test failed on %d port(s)", failed)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package processagent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfTestHTTPPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	httpEndpoint, err := NewHTTPEndpoint("127.0.0.1", port, "/selftest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpEndpoint.Close()
+
+	received := ""
+	httpEndpoint.AddMiddleware(func(ctx context.Context, req *Request, resp *Response) error {
+		received = req.Payload
+		resp.Payload = "ok"
+		return nil
+	})
+
+	// give time for the server to start serving
+	time.Sleep(time.Duration(100) * time.Millisecond)
+
+	if err := selfTestHTTP(fmt.Sprintf("http://127.0.0.1:%d/selftest", port), "ping"); err != nil {
+		t.Fatal("Expected the self-test to pass, but got: ", err.Error())
+	}
+	if received != "ping" {
+		t.Fatal("Expected the canned request to be received, but got: ", received)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	status := 200
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	cfg := &Config{
+		Port: &port,
+	}
+
+	out := &bytes.Buffer{}
+	if err := SelfTest(cfg, "", out); err != nil {
+		t.Fatal("Expected the self-test to pass, but got: ", err.Error())
+	}
+	if out.String() != "http: OK\n" {
+		t.Fatal("Unexpected self-test report: ", out.String())
+	}
+
+	status = 500
+	out = &bytes.Buffer{}
+	if err := SelfTest(cfg, "", out); err == nil {
+		t.Fatal("Expected the self-test to fail.")
+	}
+	if !strings.HasPrefix(out.String(), "http: FAILED") {
+		t.Fatal("Unexpected self-test report: ", out.String())
+	}
+}
+
+func TestSelfTestHost(t *testing.T) {
+	tests := map[string]string{
+		"":          "127.0.0.1",
+		"0.0.0.0":   "127.0.0.1",
+		"::":        "127.0.0.1",
+		"10.0.0.1":  "10.0.0.1",
+		"localhost": "localhost",
+	}
+	for host, expected := range tests {
+		h := host
+		if actual := selfTestHost(&Config{Host: &h}); actual != expected {
+			t.Fatalf("Expected self-test host %q for %q, but got %q.", expected, host, actual)
+		}
+	}
+	if actual := selfTestHost(&Config{}); actual != "127.0.0.1" {
+		t.Fatal("Expected the loopback when no host is configured, but got: ", actual)
+	}
+}
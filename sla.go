@@ -0,0 +1,83 @@
+package processagent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MetadataSLAViolation is the Response Metadata key set to "true" when the
+// request exceeded the latency budget of its route, see SLABudget.
+const MetadataSLAViolation = "sla_violation"
+
+// SLABudget tracks the latency budgets of the routes (the request paths, see
+// MetadataPath) for SLO tracking. Requests that take longer than the budget of
+// their route are recorded as SLA violations.
+type SLABudget struct {
+	budgets    map[string]time.Duration
+	violations map[string]int64
+	lock       sync.Mutex
+	// FlagResponses sets MetadataSLAViolation in the Response of the requests
+	// that exceeded the budget.
+	FlagResponses bool
+}
+
+// budget returns the latency budget of the route. Routes without own budget
+// get the budget of the "" route, if set.
+func (s *SLABudget) budget(route string) (time.Duration, bool) {
+	if budget, ok := s.budgets[route]; ok {
+		return budget, true
+	}
+	budget, ok := s.budgets[""]
+	return budget, ok
+}
+
+// Handler is a Handler that measures the time spent in the rest of the chain
+// (including the process) and records an SLA violation of the route if it
+// exceeds the budget of the route. Requests are never rejected or interrupted
+// because of the budget.
+func (s *SLABudget) Handler(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		route := req.Metadata[MetadataPath]
+		budget, ok := s.budget(route)
+		if !ok {
+			return middleware(ctx, req, resp)
+		}
+		start := time.Now()
+		err := middleware(ctx, req, resp)
+		if time.Since(start) > budget {
+			s.lock.Lock()
+			s.violations[route]++
+			s.lock.Unlock()
+			if s.FlagResponses {
+				resp.SetMetadata(MetadataSLAViolation, "true")
+			}
+		}
+		return err
+	}
+}
+
+// Violations returns the number of SLA violations recorded for each route.
+func (s *SLABudget) Violations() map[string]int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	violations := map[string]int64{}
+	for route, count := range s.violations {
+		violations[route] = count
+	}
+	return violations
+}
+
+// NewSLABudget creates an SLABudget with the latency budget of each route. The
+// budget of the "" route applies to all routes without own budget; if not set,
+// only the given routes are tracked.
+func NewSLABudget(perRoute map[string]time.Duration) *SLABudget {
+	budgets := map[string]time.Duration{}
+	for route, budget := range perRoute {
+		budgets[route] = budget
+	}
+	return &SLABudget{
+		budgets:    budgets,
+		violations: map[string]int64{},
+	}
+}
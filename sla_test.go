@@ -0,0 +1,59 @@
+package processagent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSLABudget(t *testing.T) {
+	sla := NewSLABudget(map[string]time.Duration{
+		"/slow": 10 * time.Millisecond,
+		"/fast": time.Second,
+	})
+	sla.FlagResponses = true
+	middleware := sla.Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		if req.Metadata[MetadataPath] == "/slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Metadata: map[string]string{MetadataPath: "/slow"}}, resp)
+	if resp.Metadata[MetadataSLAViolation] != "true" {
+		t.Fatal("Expected the slow response to be flagged.")
+	}
+	if resp.Error != nil {
+		t.Fatal("Expected the slow request not to fail.")
+	}
+
+	resp = &Response{}
+	middleware(context.Background(), &Request{Metadata: map[string]string{MetadataPath: "/fast"}}, resp)
+	if _, ok := resp.Metadata[MetadataSLAViolation]; ok {
+		t.Fatal("Expected the fast response not to be flagged.")
+	}
+	middleware(context.Background(), &Request{Metadata: map[string]string{MetadataPath: "/other"}}, &Response{})
+
+	violations := sla.Violations()
+	if violations["/slow"] != 1 || len(violations) != 1 {
+		t.Fatal("Expected a violation of the slow route to be recorded, but got: ", violations)
+	}
+}
+
+func TestSLABudgetDefaultRoute(t *testing.T) {
+	sla := NewSLABudget(map[string]time.Duration{"": time.Nanosecond})
+	middleware := sla.Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Metadata: map[string]string{MetadataPath: "/any"}}, resp)
+	if sla.Violations()["/any"] != 1 {
+		t.Fatal("Expected the default budget to apply, but got: ", sla.Violations())
+	}
+	if _, ok := resp.Metadata[MetadataSLAViolation]; ok {
+		t.Fatal("Expected the response not to be flagged unless enabled.")
+	}
+}
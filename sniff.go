@@ -0,0 +1,50 @@
+package processagent
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// contentTypeAllowed checks whether the media type matches any of the allowed
+// types. An allowed type may be a whole class of types, like "image/*".
+func contentTypeAllowed(mediaType string, allowed []string) bool {
+	for _, allowedType := range allowed {
+		allowedType = strings.ToLower(strings.TrimSpace(allowedType))
+		if allowedType == mediaType || allowedType == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(allowedType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowedType, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectContentType is a Handler that detects the actual content type of the
+// payload from its content (the magic bytes), regardless of the content type
+// declared by the client, and rejects the requests whose content type is not
+// allowed with error code 415 (Unsupported Media Type), before the request is
+// processed. The content type is detected with http.DetectContentType, which
+// falls back to "application/octet-stream" for unknown binary content and to
+// "text/plain" for text.
+// The allowed types are media types without parameters, like "image/png", or
+// whole classes of types, like "image/*".
+func DetectContentType(allowed []string) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			detected := http.DetectContentType([]byte(req.Payload))
+			mediaType, _, err := mime.ParseMediaType(detected)
+			if err != nil {
+				mediaType = detected
+			}
+			if !contentTypeAllowed(mediaType, allowed) {
+				setErrorResponse(resp, 415, fmt.Sprintf("unsupported content type: %s", mediaType))
+				return nil
+			}
+			return middleware(ctx, req, resp)
+		}
+	}
+}
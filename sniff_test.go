@@ -0,0 +1,52 @@
+package processagent
+
+import (
+	"context"
+	"testing"
+)
+
+// pngHeader is the signature of a PNG image.
+const pngHeader = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+func TestDetectContentType(t *testing.T) {
+	called := false
+	middleware := DetectContentType([]string{"image/*"})(func(ctx context.Context, req *Request, resp *Response) error {
+		called = true
+		return nil
+	})
+
+	resp := &Response{}
+	middleware(context.Background(), &Request{Payload: pngHeader}, resp)
+	if !called || resp.Error != nil {
+		t.Fatal("Expected a PNG payload to be processed, but got: ", resp.Payload)
+	}
+
+	called = false
+	resp = &Response{}
+	middleware(context.Background(), &Request{Payload: "just some text", Metadata: map[string]string{"Content-Type": "image/png"}}, resp)
+	if called {
+		t.Fatal("Expected a text payload not to be processed.")
+	}
+	if resp.ErrorCode == nil || *resp.ErrorCode != 415 {
+		t.Fatal("Expected a text payload to be rejected with 415.")
+	}
+	if resp.Payload != "unsupported content type: text/plain" {
+		t.Fatal("Expected the detected content type in the error, but got: ", resp.Payload)
+	}
+}
+
+func TestContentTypeAllowed(t *testing.T) {
+	allowed := []string{"image/png", "text/*"}
+	tests := map[string]bool{
+		"image/png":                true,
+		"image/gif":                false,
+		"text/html":                true,
+		"application/octet-stream": false,
+		"textual/plain":            false,
+	}
+	for mediaType, expected := range tests {
+		if contentTypeAllowed(mediaType, allowed) != expected {
+			t.Fatalf("Expected %s allowed to be %v.", mediaType, expected)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package processagent
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestSummary is a summary of a processed request, recorded by RequestTail.
+type RequestSummary struct {
+	ID   string `json:"id"`
+	Port string `json:"port"`
+	// Outcome is "ok" for successful requests and "error" for failed ones.
+	Outcome string `json:"outcome"`
+	// Status is the status code of the response, as for HTTP.
+	Status int `json:"status"`
+	// Duration is the processing time in milliseconds.
+	Duration float64 `json:"durationMs"`
+	// Timestamp is the Unix timestamp (in milliseconds) when the request
+	// completed.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// tailSubscriberBuffer is the number of summaries buffered for each follower.
+// Summaries are dropped for followers that do not keep up.
+const tailSubscriberBuffer = 64
+
+// RequestTail keeps the summaries of the last processed requests in memory, for
+// debugging without a full audit log. New summaries can be followed live.
+type RequestTail struct {
+	entries     []RequestSummary
+	next        int
+	size        int
+	subscribers map[chan RequestSummary]bool
+	lock        sync.Mutex
+}
+
+// record adds the summary to the tail, dropping the oldest one if the tail is
+// full, and passes it to the followers.
+func (t *RequestTail) record(summary RequestSummary) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.entries) < t.size {
+		t.entries = append(t.entries, summary)
+	} else {
+		t.entries[t.next] = summary
+	}
+	t.next = (t.next + 1) % t.size
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- summary:
+		default:
+			// never slow down the requests because of a slow follower
+		}
+	}
+}
+
+// Recent returns the summaries of the last requests, oldest first.
+func (t *RequestTail) Recent() []RequestSummary {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	recent := make([]RequestSummary, 0, len(t.entries))
+	if len(t.entries) == t.size {
+		recent = append(recent, t.entries[t.next:]...)
+		return append(recent, t.entries[:t.next]...)
+	}
+	return append(recent, t.entries...)
+}
+
+// follow returns the recent summaries and subscribes to the new ones.
+func (t *RequestTail) follow() ([]RequestSummary, chan RequestSummary) {
+	recent := t.Recent()
+	subscriber := make(chan RequestSummary, tailSubscriberBuffer)
+	t.lock.Lock()
+	t.subscribers[subscriber] = true
+	t.lock.Unlock()
+	return recent, subscriber
+}
+
+// unfollow unsubscribes from the new summaries.
+func (t *RequestTail) unfollow(subscriber chan RequestSummary) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.subscribers, subscriber)
+}
+
+// Handler is a Handler that records the summary of each processed request.
+func (t *RequestTail) Handler(middleware Middleware) Middleware {
+	return func(ctx context.Context, req *Request, resp *Response) error {
+		start := time.Now()
+		err := middleware(ctx, req, resp)
+		summary := RequestSummary{
+			ID:        req.ID,
+			Port:      req.Port,
+			Outcome:   "ok",
+			Status:    httpStatus(resp),
+			Duration:  float64(time.Since(start)) / float64(time.Millisecond),
+			Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		}
+		if err != nil {
+			summary.Status = 500
+		}
+		if summary.Status >= 400 {
+			summary.Outcome = "error"
+		}
+		t.record(summary)
+		return err
+	}
+}
+
+// ServeHTTP serves the admin endpoint of the tail. Responds with the summaries
+// of the last requests as a JSON array. With the "follow=true" query parameter,
+// the summaries are streamed as newline-delimited JSON instead, followed by the
+// summaries of the new requests as they complete, until the client disconnects.
+func (t *RequestTail) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("follow") != "true" {
+		writeJSON(rw, 200, t.Recent())
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.WriteHeader(500)
+		rw.Write([]byte("streaming not supported"))
+		return
+	}
+
+	recent, subscriber := t.follow()
+	defer t.unfollow(subscriber)
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(200)
+	encoder := json.NewEncoder(rw)
+	for _, summary := range recent {
+		encoder.Encode(summary)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case summary := <-subscriber:
+			if err := encoder.Encode(summary); err != nil {
+				log.Println("Tail: Failed to write summary: ", err.Error())
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// NewRequestTail creates new RequestTail that keeps the summaries of the last
+// size requests.
+func NewRequestTail(size int) *RequestTail {
+	if size < 1 {
+		size = 1
+	}
+	return &RequestTail{
+		size:        size,
+		subscribers: map[chan RequestSummary]bool{},
+	}
+}
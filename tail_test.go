@@ -0,0 +1,84 @@
+package processagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTail(t *testing.T) {
+	tail := NewRequestTail(3)
+	middleware := tail.Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		if req.Payload == "fail" {
+			setErrorResponse(resp, 502, "failed")
+		}
+		return nil
+	})
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		middleware(context.Background(), &Request{ID: id, Port: "http"}, &Response{})
+	}
+	middleware(context.Background(), &Request{ID: "5", Port: "http", Payload: "fail"}, &Response{})
+
+	recent := tail.Recent()
+	if len(recent) != 3 || recent[0].ID != "3" || recent[1].ID != "4" || recent[2].ID != "5" {
+		t.Fatal("Expected the last 3 requests, oldest first, but got: ", recent)
+	}
+	if recent[0].Outcome != "ok" || recent[0].Status != 200 || recent[0].Port != "http" {
+		t.Fatal("Expected a successful summary, but got: ", recent[0])
+	}
+	if recent[2].Outcome != "error" || recent[2].Status != 502 {
+		t.Fatal("Expected a failed summary, but got: ", recent[2])
+	}
+}
+
+func TestRequestTailServeHTTP(t *testing.T) {
+	tail := NewRequestTail(10)
+	middleware := tail.Handler(func(ctx context.Context, req *Request, resp *Response) error {
+		return nil
+	})
+	middleware(context.Background(), &Request{ID: "before"}, &Response{})
+
+	rec := httptest.NewRecorder()
+	tail.ServeHTTP(rec, httptest.NewRequest("GET", "/tail", nil))
+	recent := []RequestSummary{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &recent); err != nil || len(recent) != 1 || recent[0].ID != "before" {
+		t.Fatal("Expected the recent requests, but got: ", rec.Body.String())
+	}
+
+	server := httptest.NewServer(tail)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/tail?follow=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := bufio.NewScanner(resp.Body)
+	summary := RequestSummary{}
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &summary) != nil || summary.ID != "before" {
+		t.Fatal("Expected the recent request first, but got: ", lines.Text())
+	}
+
+	go func() {
+		// wait for the follower to be subscribed
+		for {
+			tail.lock.Lock()
+			subscribed := len(tail.subscribers) > 0
+			tail.lock.Unlock()
+			if subscribed {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		middleware(context.Background(), &Request{ID: "live"}, &Response{})
+	}()
+
+	if !lines.Scan() || json.Unmarshal(lines.Bytes(), &summary) != nil || summary.ID != "live" {
+		t.Fatal("Expected the new request to be streamed, but got: ", lines.Text())
+	}
+}
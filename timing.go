@@ -0,0 +1,51 @@
+package processagent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ServerTimingHeader is the name of the HTTP header holding the server
+	// timing metrics.
+	ServerTimingHeader = "Server-Timing"
+	// MetadataTimingPrefix is the prefix of the Response Metadata keys holding
+	// the durations recorded by ServerTiming. The rest of the key is the name
+	// of the metric.
+	MetadataTimingPrefix = "timing:"
+)
+
+// ServerTiming is a Handler that records the duration of the execution of the
+// wrapped middleware in the Response Metadata as the given metric, in
+// milliseconds. Wrap different parts of the chain (like the whole chain and the
+// process execution) to get the break down of the time spent in each part.
+// The HTTP endpoint reports the recorded metrics in the Server-Timing header.
+func ServerTiming(metric string) Handler {
+	return func(middleware Middleware) Middleware {
+		return func(ctx context.Context, req *Request, resp *Response) error {
+			start := time.Now()
+			err := middleware(ctx, req, resp)
+			duration := float64(time.Since(start)) / float64(time.Millisecond)
+			resp.SetMetadata(MetadataTimingPrefix+metric, fmt.Sprintf("%.3f", duration))
+			return err
+		}
+	}
+}
+
+// formatServerTiming formats the metrics recorded in the Response Metadata as
+// a Server-Timing header value, for example: "process;dur=12.500, total;dur=13.100".
+// The metrics are sorted by name. Returns an empty string if no metrics were
+// recorded.
+func formatServerTiming(metadata map[string]string) string {
+	metrics := []string{}
+	for key, duration := range metadata {
+		if strings.HasPrefix(key, MetadataTimingPrefix) {
+			metrics = append(metrics, strings.TrimPrefix(key, MetadataTimingPrefix)+";dur="+duration)
+		}
+	}
+	sort.Strings(metrics)
+	return strings.Join(metrics, ", ")
+}
@@ -0,0 +1,43 @@
+package processagent
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServerTiming(t *testing.T) {
+	middleware := ServerTiming("total")(ServerTiming("process")(func(ctx context.Context, req *Request, resp *Response) error {
+		time.Sleep(time.Duration(20) * time.Millisecond)
+		return nil
+	}))
+
+	resp := &Response{}
+	if err := middleware(context.Background(), &Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	process, err := strconv.ParseFloat(resp.Metadata[MetadataTimingPrefix+"process"], 64)
+	if err != nil || process < 20 {
+		t.Fatal("Expected the process duration to be recorded, but got: ", resp.Metadata)
+	}
+	total, err := strconv.ParseFloat(resp.Metadata[MetadataTimingPrefix+"total"], 64)
+	if err != nil || total < process {
+		t.Fatal("Expected the total duration to be recorded, but got: ", resp.Metadata)
+	}
+}
+
+func TestFormatServerTiming(t *testing.T) {
+	header := formatServerTiming(map[string]string{
+		MetadataTimingPrefix + "total":   "2.500",
+		MetadataTimingPrefix + "process": "1.000",
+		"Content-Type":                   "text/plain",
+	})
+	if header != "process;dur=1.000, total;dur=2.500" {
+		t.Fatal("Unexpected Server-Timing header: ", header)
+	}
+	if formatServerTiming(map[string]string{}) != "" {
+		t.Fatal("Expected no Server-Timing without metrics.")
+	}
+}
@@ -0,0 +1,23 @@
+package processagent
+
+import (
+	"log"
+	"time"
+)
+
+// UptimeLimit returns a channel that is closed once the agent has been running
+// for maxUptime, logging the reason. It is used to initiate a graceful shutdown
+// of long running agents, so they can be restarted fresh (for example, by an
+// orchestrator).
+// If maxUptime is 0, the channel is never closed.
+func UptimeLimit(maxUptime time.Duration) <-chan struct{} {
+	reached := make(chan struct{})
+	if maxUptime <= 0 {
+		return reached
+	}
+	time.AfterFunc(maxUptime, func() {
+		log.Printf("Max uptime of %s reached. Shutting down.\n", maxUptime)
+		close(reached)
+	})
+	return reached
+}
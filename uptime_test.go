@@ -0,0 +1,20 @@
+package processagent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUptimeLimit(t *testing.T) {
+	select {
+	case <-UptimeLimit(time.Duration(50) * time.Millisecond):
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("Expected the shutdown to be initiated after the max uptime.")
+	}
+
+	select {
+	case <-UptimeLimit(0):
+		t.Fatal("Expected no shutdown without max uptime.")
+	case <-time.After(time.Duration(100) * time.Millisecond):
+	}
+}
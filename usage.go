@@ -0,0 +1,29 @@
+package processagent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Metadata keys of the Response holding the resource usage of the process,
+// see LocalProcessAgent ReportUsage.
+const (
+	// MetadataCPUTime is the CPU time (user and system) used by the process, in
+	// milliseconds.
+	MetadataCPUTime = "X-Process-Cpu-Time"
+	// MetadataMaxRSS is the maximal resident set size of the process, in bytes.
+	MetadataMaxRSS = "X-Process-Max-Rss"
+)
+
+// setUsageMetadata sets the resource usage of the finished process in the
+// Response Metadata. The maximal resident set size is set only on platforms
+// that report it.
+func setUsageMetadata(resp *Response, state *os.ProcessState) {
+	cpuTime := state.UserTime() + state.SystemTime()
+	resp.SetMetadata(MetadataCPUTime, fmt.Sprintf("%.3f", float64(cpuTime)/float64(time.Millisecond)))
+	if rss, ok := maxRSS(state); ok {
+		resp.SetMetadata(MetadataMaxRSS, strconv.FormatInt(rss, 10))
+	}
+}
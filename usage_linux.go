@@ -0,0 +1,17 @@
+package processagent
+
+import (
+	"os"
+	"syscall"
+)
+
+// maxRSS returns the maximal resident set size of the finished process in
+// bytes.
+func maxRSS(state *os.ProcessState) (int64, bool) {
+	usage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || usage == nil {
+		return 0, false
+	}
+	// reported in kilobytes on Linux
+	return usage.Maxrss * 1024, true
+}
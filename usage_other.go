@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package processagent
+
+import (
+	"os"
+)
+
+// maxRSS is not supported on this platform.
+func maxRSS(state *os.ProcessState) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,40 @@
+package processagent
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestProcessAgentReportUsage(t *testing.T) {
+	pa := NewProcessAgentArgs([]string{"/bin/sh", "-c", "i=0; while [ $i -lt 200000 ]; do i=$((i+1)); done; echo done"}, 0)
+	pa.ReportUsage = true
+
+	resp := &Response{}
+	if err := pa.ProcessCommand(&Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Payload != "done\n" {
+		t.Fatal("Expected the process to complete, but got: ", resp.Payload)
+	}
+	cpuTime, err := strconv.ParseFloat(resp.Metadata[MetadataCPUTime], 64)
+	if err != nil || cpuTime <= 0 {
+		t.Fatal("Expected non-zero CPU time, but got: ", resp.Metadata[MetadataCPUTime])
+	}
+	if runtime.GOOS == "linux" {
+		rss, err := strconv.ParseInt(resp.Metadata[MetadataMaxRSS], 10, 64)
+		if err != nil || rss <= 0 {
+			t.Fatal("Expected non-zero max RSS, but got: ", resp.Metadata[MetadataMaxRSS])
+		}
+	}
+}
+
+func TestProcessAgentReportUsageDisabled(t *testing.T) {
+	pa := NewProcessAgent("echo hello", 0)
+
+	resp := &Response{}
+	pa.ProcessCommand(&Request{}, resp)
+	if _, ok := resp.Metadata[MetadataCPUTime]; ok {
+		t.Fatal("Expected no resource usage to be reported.")
+	}
+}
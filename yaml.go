@@ -0,0 +1,48 @@
+package processagent
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// yamlString encodes the string as a YAML double-quoted scalar, so special
+// characters and multi-line strings need no further handling.
+func yamlString(value string) string {
+	return strconv.Quote(value)
+}
+
+// marshalYAML encodes the Response as a YAML document, a mapping with the same
+// keys (in the same order) as the JSON encoding of the Response.
+func marshalYAML(resp *Response) []byte {
+	buffer := bytes.Buffer{}
+	fmt.Fprintf(&buffer, "id: %s\n", yamlString(resp.ID))
+	fmt.Fprintf(&buffer, "port: %s\n", yamlString(resp.Port))
+	fmt.Fprintf(&buffer, "payload: %s\n", yamlString(resp.Payload))
+	fmt.Fprintf(&buffer, "timestamp: %d\n", resp.Timestamp)
+	if resp.Error != nil {
+		fmt.Fprintf(&buffer, "error: %t\n", *resp.Error)
+	}
+	if resp.ErrorCode != nil {
+		fmt.Fprintf(&buffer, "errorCode: %d\n", *resp.ErrorCode)
+	}
+	if resp.ExitCode != nil {
+		fmt.Fprintf(&buffer, "exitCode: %d\n", *resp.ExitCode)
+	}
+	if resp.Stderr != "" {
+		fmt.Fprintf(&buffer, "stderr: %s\n", yamlString(resp.Stderr))
+	}
+	if len(resp.Metadata) > 0 {
+		keys := make([]string, 0, len(resp.Metadata))
+		for key := range resp.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buffer.WriteString("metadata:\n")
+		for _, key := range keys {
+			fmt.Fprintf(&buffer, "  %s: %s\n", yamlString(key), yamlString(resp.Metadata[key]))
+		}
+	}
+	return buffer.Bytes()
+}
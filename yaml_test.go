@@ -0,0 +1,35 @@
+package processagent
+
+import (
+	"testing"
+)
+
+func TestMarshalYAML(t *testing.T) {
+	data := marshalYAML(&Response{
+		ID:        "a",
+		Port:      "p",
+		Payload:   "x",
+		Timestamp: 1,
+	})
+	if string(data) != "id: \"a\"\nport: \"p\"\npayload: \"x\"\ntimestamp: 1\n" {
+		t.Fatalf("Unexpected YAML encoding: %q", data)
+	}
+
+	errv := true
+	errorCode := 500
+	exitCode := 2
+	data = marshalYAML(&Response{
+		Payload:   "line 1\nline \"2\": #",
+		Timestamp: 1000,
+		Error:     &errv,
+		ErrorCode: &errorCode,
+		ExitCode:  &exitCode,
+		Stderr:    "warning",
+		Metadata:  map[string]string{"b": "2", "a": "1"},
+	})
+	expected := "id: \"\"\nport: \"\"\npayload: \"line 1\\nline \\\"2\\\": #\"\ntimestamp: 1000\n" +
+		"error: true\nerrorCode: 500\nexitCode: 2\nstderr: \"warning\"\nmetadata:\n  \"a\": \"1\"\n  \"b\": \"2\"\n"
+	if string(data) != expected {
+		t.Fatalf("Unexpected YAML encoding: %q", data)
+	}
+}